@@ -0,0 +1,351 @@
+// Package cgrouptest 提供基于临时目录的 cgroup 文件系统，模拟内核创建、删除 cgroup 目录
+// 和开启 controller 时的行为，供 cgroup 和 subsystems 包的测试使用
+package cgrouptest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// v1Files 模拟内核在 v1 的各个 hierarchy 中创建 cgroup 目录时自动生成的文件及其默认值
+var v1Files = map[string]map[string]string{
+	"memory": {
+		"memory.limit_in_bytes":       "9223372036854771712",
+		"memory.memsw.limit_in_bytes": "9223372036854771712",
+		"memory.soft_limit_in_bytes":  "9223372036854771712",
+		"memory.kmem.limit_in_bytes":  "9223372036854771712",
+		"memory.usage_in_bytes":       "0",
+		"memory.oom_control":          "oom_kill_disable 0\nunder_oom 0\noom_kill 0\n",
+	},
+	"cpu": {
+		"cpu.shares":        "1024",
+		"cpu.cfs_period_us": "100000",
+		"cpu.cfs_quota_us":  "-1",
+	},
+	"cpuacct": {
+		"cpuacct.usage": "0",
+	},
+	"cpuset": {
+		"cpuset.cpus": "",
+		"cpuset.mems": "",
+	},
+	"pids": {
+		"pids.max":     "max",
+		"pids.current": "0",
+	},
+	"blkio": {
+		"blkio.weight":                    "500",
+		"blkio.throttle.read_bps_device":  "",
+		"blkio.throttle.write_bps_device": "",
+		"blkio.throttle.io_service_bytes": "Total 0\n",
+	},
+	"freezer": {
+		"freezer.state": "THAWED",
+	},
+	"devices": {
+		"devices.allow": "",
+		"devices.deny":  "",
+		"devices.list":  "a *:* rwm",
+	},
+}
+
+// v2Controllers 是 v2 中可以开启的 controller，按照内核在 cgroup.subtree_control 中展示的顺序排列
+var v2Controllers = []string{"cpuset", "cpu", "io", "memory", "pids"}
+
+// v2Files 模拟内核在 v2 中创建 cgroup 目录时自动生成的文件及其默认值，key 为 controller，
+// "" 中是每个 cgroup 都有的核心文件，其他文件只有在父 cgroup 开启了对应 controller 时才会生成
+var v2Files = map[string]map[string]string{
+	"": {
+		"cgroup.subtree_control": "",
+		"cgroup.freeze":          "0",
+		"cgroup.events":          "populated 0\nfrozen 0\n",
+		"cpu.stat":               "usage_usec 0\n",
+	},
+	"memory": {
+		"memory.max":      "max",
+		"memory.swap.max": "max",
+		"memory.low":      "0",
+		"memory.current":  "0",
+		"memory.events":   "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n",
+	},
+	"cpu": {
+		"cpu.weight": "100",
+		"cpu.max":    "max 100000",
+	},
+	"cpuset": {
+		"cpuset.cpus": "",
+	},
+	"pids": {
+		"pids.max":     "max",
+		"pids.current": "0",
+	},
+	"io": {
+		"io.weight": "default 100",
+		"io.max":    "",
+		"io.stat":   "",
+	},
+}
+
+// FakeRoot 是基于临时目录的 cgroup 文件系统，v1 中每个 subsystem 单独挂载在
+// <Dir>/<subsystem> 下，v2 中所有 controller 共用 <Dir>
+type FakeRoot struct {
+	Dir     string
+	Unified bool
+	// MountInfo 记录了各个 subsystem 挂载点的 mountinfo 文件
+	MountInfo string
+	// ProcDir 模拟 /proc，进程所在的 cgroup 可以通过 SetProcCgroup 写入
+	ProcDir string
+	// Killed 记录被 kill 的进程
+	Killed []int
+}
+
+// New 创建一个 FakeRoot，测试结束时删除，v1 中只挂载 mounted 中的 subsystem，为空时挂载所有的 subsystem；
+// 调用者需要将它的各个方法通过 subsystems.SetRoot 设置为当前的 cgroup 文件系统
+func New(t testing.TB, unified bool, mounted ...string) *FakeRoot {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fakedocker-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	f := &FakeRoot{
+		Dir:       dir,
+		Unified:   unified,
+		MountInfo: filepath.Join(dir, "mountinfo"),
+		ProcDir:   filepath.Join(dir, "proc"),
+	}
+	var mountInfo strings.Builder
+	if unified {
+		if err := f.populate(dir); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&mountInfo, "30 23 0:26 / %s rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw\n", dir)
+	} else {
+		if len(mounted) == 0 {
+			for subsystem := range v1Files {
+				mounted = append(mounted, subsystem)
+			}
+		}
+		id := 31
+		for _, subsystem := range mounted {
+			mountPoint := filepath.Join(dir, subsystem)
+			if err := os.Mkdir(mountPoint, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.populate(mountPoint); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(&mountInfo, "%d 25 0:%d / %s rw,nosuid,nodev,noexec,relatime shared:%d - cgroup cgroup rw,%s\n",
+				id, id-4, mountPoint, id-19, subsystem)
+			id++
+			// 根 cgroup 中的 cpuset 包含所有的 cpu 和内存节点
+			if subsystem == "cpuset" {
+				f.Write(t, subsystem, "", "cpuset.cpus", "0-3")
+				f.Write(t, subsystem, "", "cpuset.mems", "0")
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(f.MountInfo, []byte(mountInfo.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(f.ProcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// subsystemOf 返回 v1 中 dir 所属的 subsystem
+func (f *FakeRoot) subsystemOf(dir string) string {
+	rel, err := filepath.Rel(f.Dir, dir)
+	if err != nil {
+		return ""
+	}
+	return strings.Split(rel, string(filepath.Separator))[0]
+}
+
+// populate 在 dir 中生成 cgroup 的默认文件，v2 中根 cgroup 可以使用所有的 controller，
+// 子 cgroup 只能使用父 cgroup 开启了的 controller，只生成这些 controller 的文件
+func (f *FakeRoot) populate(dir string) error {
+	if !f.Unified {
+		return writeFiles(dir, v1Files[f.subsystemOf(dir)], map[string]string{"cgroup.procs": "", "tasks": ""})
+	}
+
+	controllers := v2Controllers
+	if dir != f.Dir {
+		b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(dir), "cgroup.subtree_control"))
+		if err != nil {
+			return err
+		}
+		controllers = strings.Fields(string(b))
+	}
+	files := []map[string]string{
+		v2Files[""],
+		{"cgroup.procs": "", "cgroup.controllers": strings.Join(controllers, " ")},
+	}
+	if dir != f.Dir {
+		for _, c := range controllers {
+			files = append(files, v2Files[c])
+		}
+	}
+	return writeFiles(dir, files...)
+}
+
+func writeFiles(dir string, files ...map[string]string) error {
+	for _, m := range files {
+		for name, value := range m {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Mkdir 创建 cgroup 目录并生成默认文件
+func (f *FakeRoot) Mkdir(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	return f.populate(dir)
+}
+
+// Rmdir 和内核一样，只有不包含子 cgroup 的目录才能被删除，目录中的文件随目录一起删除
+func (f *FakeRoot) Rmdir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			return &os.PathError{Op: "rmdir", Path: dir, Err: fmt.Errorf("directory not empty")}
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// Kill 模拟进程退出后内核将其从所有 cgroup 中移除
+func (f *FakeRoot) Kill(pid int) error {
+	f.Killed = append(f.Killed, pid)
+	return filepath.Walk(f.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || (info.Name() != "cgroup.procs" && info.Name() != "tasks") {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var remain []string
+		for _, s := range strings.Fields(string(b)) {
+			if s != strconv.Itoa(pid) {
+				remain = append(remain, s)
+			}
+		}
+		return ioutil.WriteFile(p, []byte(strings.Join(remain, "\n")), 0644)
+	})
+}
+
+// EnableController 和内核一样，只能开启 cgroup.controllers 中可用的 controller，
+// 开启后在已经存在的子 cgroup 中生成该 controller 的文件
+func (f *FakeRoot) EnableController(dir, controller string) error {
+	available, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	if !containsField(string(available), controller) {
+		return &os.PathError{Op: "write", Path: filepath.Join(dir, "cgroup.subtree_control"), Err: os.ErrNotExist}
+	}
+
+	subtree := filepath.Join(dir, "cgroup.subtree_control")
+	b, err := ioutil.ReadFile(subtree)
+	if err != nil {
+		return err
+	}
+	if containsField(string(b), controller) {
+		return nil
+	}
+	var enabled []string
+	for _, c := range v2Controllers {
+		if c == controller || containsField(string(b), c) {
+			enabled = append(enabled, c)
+		}
+	}
+	if err := ioutil.WriteFile(subtree, []byte(strings.Join(enabled, " ")), 0644); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		child := filepath.Join(dir, e.Name())
+		controllers := map[string]string{"cgroup.controllers": strings.Join(enabled, " ")}
+		if err := writeFiles(child, controllers, v2Files[controller]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// SetProcCgroup 写入 <ProcDir>/<pid>/cgroup，content 的格式与 /proc/<pid>/cgroup 相同
+func (f *FakeRoot) SetProcCgroup(t testing.TB, pid int, content string) {
+	t.Helper()
+	dir := filepath.Join(f.ProcDir, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Path 返回 subsystem 中 cgroupPath 对应的目录
+func (f *FakeRoot) Path(subsystem, cgroupPath string) string {
+	if f.Unified {
+		return filepath.Join(f.Dir, cgroupPath)
+	}
+	return filepath.Join(f.Dir, subsystem, cgroupPath)
+}
+
+// Read 读取 subsystem 中 cgroupPath 下的文件，去掉首尾的空白
+func (f *FakeRoot) Read(t testing.TB, subsystem, cgroupPath, file string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(f.Path(subsystem, cgroupPath), file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Write 写入 subsystem 中 cgroupPath 下的文件
+func (f *FakeRoot) Write(t testing.TB, subsystem, cgroupPath, file, value string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(f.Path(subsystem, cgroupPath), file), []byte(value), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Exists 返回 subsystem 中是否存在 cgroupPath 对应的目录
+func (f *FakeRoot) Exists(subsystem, cgroupPath string) bool {
+	_, err := os.Stat(f.Path(subsystem, cgroupPath))
+	return err == nil
+}
@@ -1,14 +1,28 @@
 package cgroup
 
 import (
+	"fmt"
+
 	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
+var (
+	memorySubSys  = &subsystems.MemorySubSystem{}
+	freezerSubSys = &subsystems.FreezerSubSystem{}
+)
+
 var allSubSys = []subsystems.Interface{
 	&subsystems.CPUSubSystem{},
-	&subsystems.MemorySubSystem{},
+	&subsystems.CPUAcctSubSystem{},
+	&subsystems.CpusetSubSystem{},
+	memorySubSys,
+	&subsystems.PidsSubSystem{},
+	&subsystems.BlkioSubSystem{},
+	freezerSubSys,
+	&subsystems.DevicesSubSystem{},
 }
 
 type CgroupManager struct {
@@ -26,54 +40,126 @@ func NewCgroupManager(path string, resConf *subsystems.ResourceConfig) *CgroupMa
 	}
 }
 
-// SetAll 根据 ResourceConfig 设置各个 subsystem 挂载中的 cgroup 资源限制
-func (m *CgroupManager) SetAll() (err error) {
-	for _, v := range allSubSys {
-		err = v.Set(m.Path, m.ResourceConfig)
-		if err != nil {
+// SetAll 根据 ResourceConfig 设置各个 subsystem 挂载中的 cgroup 资源限制，
+// 某个 subsystem 设置失败时，删除本次调用中新创建的 cgroup，已经存在的 cgroup（比如 update 时）保持不变
+func (m *CgroupManager) SetAll() error {
+	return m.set(allSubSys)
+}
+
+// set 设置 subs 中各个 subsystem 的资源限制
+func (m *CgroupManager) set(subs []subsystems.Interface) error {
+	var created []subsystems.Interface
+	for _, v := range subs {
+		if !subsystems.CgroupExists(v.Name(), m.Path) {
+			created = append(created, v)
+		}
+		if err := v.Set(m.Path, m.ResourceConfig); err != nil {
 			zlog.New().Error(
 				"set cgroup error",
 				zap.String("subsystem name", v.Name()),
 				zap.String("subsystem path", m.Path),
 				zap.Error(err),
 			)
-			break
+			return multierr.Append(err, m.remove(created))
 		}
 	}
-	return
+	return nil
 }
 
-// ApplyAll 将进程 pid 加入到每个 cgroup 中
-func (m *CgroupManager) ApplyAll(pid int64) (err error) {
-	for _, v := range allSubSys {
-		err = v.Apply(m.Path, pid)
+// ApplyAll 将进程 pid 加入到每个 cgroup 中，某个 subsystem 加入失败时，
+// 将进程移回它在已经加入的 subsystem 中原来所在的 cgroup
+func (m *CgroupManager) ApplyAll(pid int64) error {
+	origins := make([]string, len(allSubSys))
+	for i, v := range allSubSys {
+		origin, err := subsystems.ProcessCgroupPath(v.Name(), int(pid))
 		if err != nil {
-			zlog.New().Error(
-				"apply process to cgroup error",
-				zap.String("subsystem name", v.Name()),
-				zap.Int64("pid", pid),
-				zap.String("subsystem path", m.Path),
-				zap.Error(err),
-			)
-			break
+			// 读取失败时只能退回到根 cgroup
+			zlog.New().Warn("read process cgroup error", zap.String("subsystem name", v.Name()), zap.Int64("pid", pid), zap.Error(err))
+			origin = "/"
 		}
+		origins[i] = origin
 	}
-	return
+
+	for i, v := range allSubSys {
+		err := v.Apply(m.Path, pid)
+		if err == nil {
+			continue
+		}
+		zlog.New().Error(
+			"apply process to cgroup error",
+			zap.String("subsystem name", v.Name()),
+			zap.Int64("pid", pid),
+			zap.String("subsystem path", m.Path),
+			zap.Error(err),
+		)
+		for j, applied := range allSubSys[:i] {
+			if rerr := applied.Apply(origins[j], pid); rerr != nil {
+				err = multierr.Append(err, fmt.Errorf("move process back to %s cgroup %s error: %v", applied.Name(), origins[j], rerr))
+			}
+		}
+		return err
+	}
+	return nil
 }
 
-// RemoveAll 释放各个 subsystem 挂载中的 cgroup
-func (m *CgroupManager) RemoveAll() (err error) {
-	for _, v := range allSubSys {
-		err = v.Remove(m.Path)
-		if err != nil {
+// RemoveAll 释放各个 subsystem 挂载中的 cgroup，某个 subsystem 删除失败时继续删除其他的，
+// 最后返回所有的错误
+func (m *CgroupManager) RemoveAll() error {
+	return m.remove(allSubSys)
+}
+
+// remove 按照与创建相反的顺序删除 subs 中的 cgroup
+func (m *CgroupManager) remove(subs []subsystems.Interface) (err error) {
+	for i := len(subs) - 1; i >= 0; i-- {
+		v := subs[i]
+		if rerr := v.Remove(m.Path); rerr != nil {
 			zlog.New().Error(
 				"remove cgroup error",
 				zap.String("subsystem name", v.Name()),
 				zap.String("subsystem path", m.Path),
-				zap.Error(err),
+				zap.Error(rerr),
 			)
-			return
+			err = multierr.Append(err, fmt.Errorf("remove %s cgroup error: %v", v.Name(), rerr))
 		}
 	}
 	return
-}
\ No newline at end of file
+}
+
+// GetStats 从各个 subsystem 的 cgroup 文件中读取资源使用情况
+func (m *CgroupManager) GetStats() (*subsystems.Stats, error) {
+	stats := &subsystems.Stats{}
+	for _, v := range allSubSys {
+		g, ok := v.(subsystems.StatsGetter)
+		if !ok {
+			continue
+		}
+		if err := g.GetStats(m.Path, stats); err != nil {
+			return nil, fmt.Errorf("get %s stats error: %v", v.Name(), err)
+		}
+	}
+	return stats, nil
+}
+
+// Freeze 挂起 cgroup 中的所有进程
+func (m *CgroupManager) Freeze() error {
+	return freezerSubSys.Freeze(m.Path)
+}
+
+// Thaw 恢复 cgroup 中被挂起的所有进程
+func (m *CgroupManager) Thaw() error {
+	return freezerSubSys.Thaw(m.Path)
+}
+
+// NotifyOOM 监听容器 cgroup 中的 OOM 事件
+func (m *CgroupManager) NotifyOOM() (<-chan struct{}, error) {
+	return memorySubSys.NotifyOOM(m.Path)
+}
+
+// OOMKilled 返回 cgroup 中是否有进程因为 OOM 被 kill
+func (m *CgroupManager) OOMKilled() (bool, error) {
+	n, err := memorySubSys.OOMKillCount(m.Path)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,99 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/cgrouptest"
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+)
+
+// setUpV1Root 在临时目录中模拟 v1 的 cgroup 文件系统，只挂载 mounted 中的 subsystem
+func setUpV1Root(t *testing.T, mounted ...string) *cgrouptest.FakeRoot {
+	f := cgrouptest.New(t, false, mounted...)
+	t.Cleanup(subsystems.SetRoot(&subsystems.Root{
+		MountInfo: f.MountInfo,
+		ProcDir:   f.ProcDir,
+		Mkdir:     f.Mkdir,
+		Rmdir:     f.Rmdir,
+		Kill:      f.Kill,
+	}))
+	return f
+}
+
+func TestSetAllRollback(t *testing.T) {
+	// 没有挂载 blkio，设置到 blkio 时会失败
+	f := setUpV1Root(t, "cpu", "cpuacct", "cpuset", "memory", "pids", "freezer", "devices")
+
+	// 已经存在的 cgroup 在回滚时需要保留
+	if err := os.MkdirAll(f.Path("cpu", "fakedocker/test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewCgroupManager("fakedocker/test", &subsystems.ResourceConfig{})
+	if err := m.SetAll(); err == nil {
+		t.Fatal("SetAll should fail when blkio is not mounted")
+	}
+	for _, subsystem := range []string{"cpuacct", "cpuset", "memory", "pids"} {
+		if f.Exists(subsystem, "fakedocker") {
+			t.Fatalf("cgroup created in %s is not rolled back", subsystem)
+		}
+	}
+	if !f.Exists("cpu", "fakedocker/test") {
+		t.Fatal("existing cpu cgroup should be kept")
+	}
+}
+
+func TestRemoveAllBestEffort(t *testing.T) {
+	f := setUpV1Root(t, "cpu", "cpuacct", "cpuset", "memory", "pids", "blkio", "freezer", "devices")
+
+	m := NewCgroupManager("fakedocker/test", &subsystems.ResourceConfig{})
+	if err := m.SetAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// memory 的 cgroup 中还有子 cgroup，无法删除，其他 subsystem 仍然需要删除
+	if err := os.Mkdir(filepath.Join(f.Path("memory", "fakedocker/test"), "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.RemoveAll()
+	if err == nil || !strings.Contains(err.Error(), "memory") {
+		t.Fatalf("RemoveAll should return the memory error, got: %v", err)
+	}
+	for _, subsystem := range []string{"cpu", "cpuacct", "cpuset", "pids", "blkio", "freezer", "devices"} {
+		if f.Exists(subsystem, "fakedocker/test") {
+			t.Fatalf("cgroup in %s is not removed", subsystem)
+		}
+	}
+}
+
+func TestApplyAllRollback(t *testing.T) {
+	// 没有挂载 blkio，加入到 blkio 时会失败
+	f := setUpV1Root(t, "cpu", "cpuacct", "cpuset", "memory", "pids", "freezer", "devices")
+	for _, subsystem := range []string{"cpu", "cpuacct", "cpuset", "memory", "pids"} {
+		if err := os.MkdirAll(f.Path(subsystem, "fakedocker/test"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 进程原来在 user.slice 中，memory 只有根 cgroup
+	f.SetProcCgroup(t, 1234, "12:pids:/user.slice\n4:cpu,cpuacct:/user.slice\n3:cpuset:/\n2:memory:/\n0::/user.slice\n")
+	for _, subsystem := range []string{"cpu", "cpuacct", "pids"} {
+		if err := f.Mkdir(f.Path(subsystem, "user.slice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewCgroupManager("fakedocker/test", &subsystems.ResourceConfig{})
+	if err := m.ApplyAll(1234); err == nil {
+		t.Fatal("ApplyAll should fail when blkio is not mounted")
+	}
+	for subsystem, origin := range map[string]string{"cpu": "user.slice", "cpuacct": "user.slice", "pids": "user.slice", "cpuset": "", "memory": ""} {
+		if got := f.Read(t, subsystem, origin, "tasks"); got != "1234" {
+			t.Fatalf("process is not moved back to %s cgroup %q, tasks = %q", subsystem, origin, got)
+		}
+	}
+}
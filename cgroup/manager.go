@@ -0,0 +1,82 @@
+package cgroup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+)
+
+// cgroup driver，决定由谁来创建和管理容器的 cgroup
+const (
+	// DriverCgroupfs 直接在 cgroupfs 中创建目录、写入文件
+	DriverCgroupfs = "cgroupfs"
+	// DriverSystemd 通过 D-Bus 让 systemd 为每个容器创建一个 transient scope unit
+	DriverSystemd = "systemd"
+)
+
+// Manager 管理容器的 cgroup
+type Manager interface {
+	// 根据 ResourceConfig 设置资源限制
+	SetAll() error
+
+	// 将进程加入到 cgroup 中
+	ApplyAll(pid int64) error
+
+	// 释放 cgroup
+	RemoveAll() error
+
+	// 读取资源使用情况
+	GetStats() (*subsystems.Stats, error)
+
+	// 挂起和恢复 cgroup 中的所有进程
+	Freeze() error
+	Thaw() error
+
+	// 监听 OOM 事件，以及判断是否有进程因为 OOM 被 kill
+	NotifyOOM() (<-chan struct{}, error)
+	OOMKilled() (bool, error)
+}
+
+// DefaultCgroupfsParent cgroupfs driver 默认将所有容器的 cgroup 放在该目录下，
+// 这样可以在该目录上对所有容器的资源进行总体限制
+const DefaultCgroupfsParent = "fakedocker"
+
+var (
+	_ Manager = &CgroupManager{}
+	_ Manager = &SystemdManager{}
+)
+
+// NewManager 根据 driver 创建对应的 Manager，driver 为空时使用 cgroupfs，
+// path 为相对于各个 subsystem 根目录的路径
+func NewManager(driver, path string, resConf *subsystems.ResourceConfig) (Manager, error) {
+	switch driver {
+	case "", DriverCgroupfs:
+		return NewCgroupManager(path, resConf), nil
+	case DriverSystemd:
+		return NewSystemdManager(path, resConf), nil
+	}
+	return nil, fmt.Errorf("unsupported cgroup driver %q, use %s or %s", driver, DriverCgroupfs, DriverSystemd)
+}
+
+// ContainerCgroupPath 返回容器 id 在 parent 下的 cgroup 路径，parent 为空时使用 driver 的默认值，
+// cgroupfs 中 parent 是一个相对路径，比如 fakedocker 或 fakedocker/ci，
+// systemd 中 parent 是一个 slice，比如 fakedocker.slice
+func ContainerCgroupPath(driver, parent, id string) (string, error) {
+	if driver == DriverSystemd {
+		if parent == "" {
+			parent = DefaultSystemdSlice
+		}
+		return SystemdScopePath(parent, id)
+	}
+
+	if parent == "" {
+		parent = DefaultCgroupfsParent
+	}
+	p := path.Clean(strings.TrimPrefix(parent, "/"))
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("invalid cgroup parent %q", parent)
+	}
+	return path.Join(p, id), nil
+}
@@ -0,0 +1,264 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type BlkioSubSystem struct{}
+
+func (b *BlkioSubSystem) Name() string {
+	return subBlkio
+}
+
+// Set 限制块设备 IO，v1 写入 blkio.weight 和 blkio.throttle.* 文件，
+// v2 写入 io.weight 和 io.max 文件
+func (b *BlkioSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	subPath, err := GetCgroupPath(b.Name(), cgroupPath, true)
+	if err != nil {
+		return err
+	}
+
+	if res.BlkioWeight == "" && len(res.DeviceReadBps) == 0 && len(res.DeviceWriteBps) == 0 &&
+		len(res.DeviceReadIOps) == 0 && len(res.DeviceWriteIOps) == 0 {
+		return nil
+	}
+
+	if IsCgroup2UnifiedMode() {
+		return b.setV2(subPath, res)
+	}
+	return b.setV1(subPath, res)
+}
+
+func (b *BlkioSubSystem) setV1(subPath string, res *ResourceConfig) error {
+	if res.BlkioWeight != "" {
+		w, err := parseBlkioWeight(res.BlkioWeight)
+		if err != nil {
+			return err
+		}
+		// 较新的内核使用 bfq 调度器，权重文件为 blkio.bfq.weight
+		weightFile := path.Join(subPath, "blkio.weight")
+		if _, err := os.Stat(weightFile); os.IsNotExist(err) {
+			weightFile = path.Join(subPath, "blkio.bfq.weight")
+		}
+		if err := ioutil.WriteFile(weightFile, []byte(strconv.FormatUint(w, 10)), 0644); err != nil {
+			return fmt.Errorf("set cgroup blkio weight error: %v", err)
+		}
+	}
+
+	throttles := []struct {
+		file    string
+		devices []string
+		bps     bool
+	}{
+		{"blkio.throttle.read_bps_device", res.DeviceReadBps, true},
+		{"blkio.throttle.write_bps_device", res.DeviceWriteBps, true},
+		{"blkio.throttle.read_iops_device", res.DeviceReadIOps, false},
+		{"blkio.throttle.write_iops_device", res.DeviceWriteIOps, false},
+	}
+	for _, t := range throttles {
+		for _, d := range t.devices {
+			major, minor, rate, err := parseThrottleDevice(d, t.bps)
+			if err != nil {
+				return err
+			}
+			// 每次写入会新增（或覆盖）一条设备规则
+			rule := throttleRuleV1(major, minor, rate)
+			if err := ioutil.WriteFile(path.Join(subPath, t.file), []byte(rule), 0644); err != nil {
+				return fmt.Errorf("set cgroup %s error: %v", t.file, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BlkioSubSystem) setV2(subPath string, res *ResourceConfig) error {
+	if res.BlkioWeight != "" {
+		w, err := parseBlkioWeight(res.BlkioWeight)
+		if err != nil {
+			return err
+		}
+		weight := fmt.Sprintf("default %d", ConvertBlkioWeightToIOWeight(w))
+		if err := ioutil.WriteFile(path.Join(subPath, "io.weight"), []byte(weight), 0644); err != nil {
+			return fmt.Errorf("set cgroup io weight error: %v", err)
+		}
+	}
+
+	throttles := []struct {
+		key     string
+		devices []string
+		bps     bool
+	}{
+		{"rbps", res.DeviceReadBps, true},
+		{"wbps", res.DeviceWriteBps, true},
+		{"riops", res.DeviceReadIOps, false},
+		{"wiops", res.DeviceWriteIOps, false},
+	}
+	for _, t := range throttles {
+		for _, d := range t.devices {
+			major, minor, rate, err := parseThrottleDevice(d, t.bps)
+			if err != nil {
+				return err
+			}
+			// 未写入的 key 保持不变，所以可以每次只写一项
+			rule := throttleRuleV2(major, minor, t.key, rate)
+			if err := ioutil.WriteFile(path.Join(subPath, "io.max"), []byte(rule), 0644); err != nil {
+				return fmt.Errorf("set cgroup io.max error: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetStats 读取块设备累计读写字节数，
+// v1 为 blkio.throttle.io_service_bytes_recursive，每行格式为 <major>:<minor> <Read|Write|...> <bytes>，
+// v2 为 io.stat，每行格式为 <major>:<minor> rbytes=<n> wbytes=<n> ...
+func (b *BlkioSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subPath, err := GetCgroupPath(b.Name(), cgroupPath, false)
+	if err != nil {
+		return err
+	}
+
+	file := "blkio.throttle.io_service_bytes_recursive"
+	if IsCgroup2UnifiedMode() {
+		file = "io.stat"
+	}
+	content, err := ioutil.ReadFile(path.Join(subPath, file))
+	if err != nil {
+		return err
+	}
+
+	read, write := parseBlkioStats(string(content), IsCgroup2UnifiedMode())
+	stats.BlkioRead += read
+	stats.BlkioWrite += write
+	return nil
+}
+
+// parseBlkioStats 累加 blkio.throttle.io_service_bytes_recursive（v1）或 io.stat（v2）中所有设备的读写字节数
+func parseBlkioStats(content string, unified bool) (read, write uint64) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if unified {
+			for _, f := range fields[1:] {
+				kv := strings.SplitN(f, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				n, _ := strconv.ParseUint(kv[1], 10, 64)
+				switch kv[0] {
+				case "rbytes":
+					read += n
+				case "wbytes":
+					write += n
+				}
+			}
+			continue
+		}
+
+		// v1 中最后一行是 "Total <bytes>"，只有两列，会在这里被跳过
+		if len(fields) != 3 {
+			continue
+		}
+		n, _ := strconv.ParseUint(fields[2], 10, 64)
+		switch fields[1] {
+		case "Read":
+			read += n
+		case "Write":
+			write += n
+		}
+	}
+	return read, write
+}
+
+// Apply 将进程添加到 cgroup 中
+func (b *BlkioSubSystem) Apply(cgroupPath string, pid int64) error {
+	return apply(b.Name(), cgroupPath, int(pid))
+}
+
+// Remove 删除 cgroup
+func (b *BlkioSubSystem) Remove(cgroupPath string) error {
+	return remove(b.Name(), cgroupPath)
+}
+
+// ConvertBlkioWeightToIOWeight v1 的权重范围为 10-1000，v2 为 1-10000，这里按比例进行转换
+func ConvertBlkioWeightToIOWeight(weight uint64) uint64 {
+	if weight < 10 {
+		weight = 10
+	}
+	return 1 + (weight-10)*9999/990
+}
+
+// parseBlkioWeight 解析 IO 权重，合法范围为 10-1000
+func parseBlkioWeight(s string) (uint64, error) {
+	w, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || w < 10 || w > 1000 {
+		return 0, fmt.Errorf("invalid blkio weight %q, range is 10-1000", s)
+	}
+	return w, nil
+}
+
+// throttleRuleV1 返回 blkio.throttle.* 的一条设备规则，格式为 <major>:<minor> <rate>
+func throttleRuleV1(major, minor uint32, rate uint64) string {
+	return fmt.Sprintf("%d:%d %d", major, minor, rate)
+}
+
+// throttleRuleV2 返回 io.max 中设备的一项限制，io.max 的格式为
+// <major>:<minor> rbps=<n> wbps=<n> riops=<n> wiops=<n>
+func throttleRuleV2(major, minor uint32, key string, rate uint64) string {
+	return fmt.Sprintf("%d:%d %s=%d", major, minor, key, rate)
+}
+
+// parseThrottleDevice 解析 <设备路径>:<值> 格式的限制，并将设备路径转换为设备号，
+// bps 为 true 时值可以带单位，比如 /dev/sda:1mb
+func parseThrottleDevice(s string, bps bool) (major, minor uint32, rate uint64, err error) {
+	devicePath, rate, err := SplitThrottleDevice(s, bps)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, minor, err = blockDeviceNumber(devicePath)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return major, minor, rate, nil
+}
+
+// SplitThrottleDevice 将 <设备路径>:<值> 拆分为设备路径和限制值
+func SplitThrottleDevice(s string, bps bool) (devicePath string, rate uint64, err error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return "", 0, fmt.Errorf("invalid device limit %q, usage <device-path>:<number>", s)
+	}
+
+	if bps {
+		var n int64
+		n, err = ParseSize(s[i+1:])
+		rate = uint64(n)
+	} else {
+		rate, err = strconv.ParseUint(s[i+1:], 10, 64)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid device limit %q: %v", s, err)
+	}
+	return s[:i], rate, nil
+}
+
+// blockDeviceNumber 返回块设备文件对应的主设备号和次设备号
+func blockDeviceNumber(devicePath string) (major, minor uint32, err error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devicePath, &st); err != nil {
+		return 0, 0, fmt.Errorf("stat device %s error: %v", devicePath, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", devicePath)
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), nil
+}
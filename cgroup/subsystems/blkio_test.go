@@ -0,0 +1,152 @@
+package subsystems
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSplitThrottleDevice(t *testing.T) {
+	tests := []struct {
+		in     string
+		bps    bool
+		device string
+		rate   uint64
+	}{
+		{"/dev/sda:1048576", true, "/dev/sda", 1 << 20},
+		{"/dev/sda:1mb", true, "/dev/sda", 1 << 20},
+		{"/dev/sda:512k", true, "/dev/sda", 512 << 10},
+		{"/dev/sda:1000", false, "/dev/sda", 1000},
+		{"/dev/disk/by-id/a:b:10", false, "/dev/disk/by-id/a:b", 10},
+	}
+	for _, tt := range tests {
+		device, rate, err := SplitThrottleDevice(tt.in, tt.bps)
+		if err != nil {
+			t.Fatalf("SplitThrottleDevice(%q) error: %v", tt.in, err)
+		}
+		if device != tt.device || rate != tt.rate {
+			t.Fatalf("SplitThrottleDevice(%q) = %q, %d, want %q, %d", tt.in, device, rate, tt.device, tt.rate)
+		}
+	}
+
+	invalid := []struct {
+		in  string
+		bps bool
+	}{
+		{"", true},
+		{"/dev/sda", true},
+		{"/dev/sda:", true},
+		{":1mb", true},
+		{"/dev/sda:-1", true},
+		{"/dev/sda:1mb", false}, // iops 不能带单位
+		{"/dev/sda:1.5", false},
+	}
+	for _, tt := range invalid {
+		if _, _, err := SplitThrottleDevice(tt.in, tt.bps); err == nil {
+			t.Fatalf("SplitThrottleDevice(%q, %v) should fail", tt.in, tt.bps)
+		}
+	}
+}
+
+func TestParseThrottleDevice(t *testing.T) {
+	var st unix.Stat_t
+	if err := unix.Stat("/dev/loop0", &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		t.Skip("/dev/loop0 is not available")
+	}
+	major, minor, rate, err := parseThrottleDevice("/dev/loop0:2mb", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if major != unix.Major(uint64(st.Rdev)) || minor != unix.Minor(uint64(st.Rdev)) || rate != 2<<20 {
+		t.Fatalf("parseThrottleDevice = %d:%d %d", major, minor, rate)
+	}
+	// 不是块设备
+	if _, _, _, err := parseThrottleDevice(os.DevNull+":1mb", true); err == nil {
+		t.Fatal("parseThrottleDevice with character device should fail")
+	}
+}
+
+func TestThrottleRule(t *testing.T) {
+	tests := []struct {
+		major, minor uint32
+		key          string
+		rate         uint64
+		v1, v2       string
+	}{
+		{8, 0, "rbps", 1 << 20, "8:0 1048576", "8:0 rbps=1048576"},
+		{8, 16, "wbps", 0, "8:16 0", "8:16 wbps=0"},
+		{259, 1, "riops", 1000, "259:1 1000", "259:1 riops=1000"},
+		{7, 3, "wiops", 20, "7:3 20", "7:3 wiops=20"},
+	}
+	for _, tt := range tests {
+		if got := throttleRuleV1(tt.major, tt.minor, tt.rate); got != tt.v1 {
+			t.Fatalf("throttleRuleV1 = %q, want %q", got, tt.v1)
+		}
+		if got := throttleRuleV2(tt.major, tt.minor, tt.key, tt.rate); got != tt.v2 {
+			t.Fatalf("throttleRuleV2 = %q, want %q", got, tt.v2)
+		}
+	}
+}
+
+func TestBlkioWeight(t *testing.T) {
+	tests := []struct {
+		in       string
+		weight   uint64
+		ioWeight uint64
+	}{
+		{"10", 10, 1},
+		{"500", 500, 4950},
+		{"1000", 1000, 10000},
+	}
+	for _, tt := range tests {
+		w, err := parseBlkioWeight(tt.in)
+		if err != nil {
+			t.Fatalf("parseBlkioWeight(%q) error: %v", tt.in, err)
+		}
+		if w != tt.weight {
+			t.Fatalf("parseBlkioWeight(%q) = %d", tt.in, w)
+		}
+		if got := ConvertBlkioWeightToIOWeight(w); got != tt.ioWeight {
+			t.Fatalf("ConvertBlkioWeightToIOWeight(%d) = %d, want %d", w, got, tt.ioWeight)
+		}
+	}
+	for _, in := range []string{"", "9", "1001", "abc", "-10"} {
+		if _, err := parseBlkioWeight(in); err == nil {
+			t.Fatalf("parseBlkioWeight(%q) should fail", in)
+		}
+	}
+}
+
+func TestParseBlkioStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		unified   bool
+		wantRead  uint64
+		wantWrite uint64
+	}{
+		{"v1 empty", "Total 0\n", false, 0, 0},
+		{
+			"v1 devices",
+			"8:0 Read 4096\n8:0 Write 8192\n8:0 Sync 12288\n8:0 Async 0\n8:0 Total 12288\n" +
+				"8:16 Read 100\n8:16 Write 200\n8:16 Total 300\nTotal 12588\n",
+			false, 4196, 8392,
+		},
+		{"v1 invalid value", "8:0 Read abc\n8:0 Write 10\n", false, 0, 10},
+		{"v2 empty", "", true, 0, 0},
+		{
+			"v2 devices",
+			"8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n" +
+				"253:0 rbytes=100 wbytes=200 rios=3 wios=4 dbytes=0 dios=0\n",
+			true, 4196, 8392,
+		},
+		{"v2 malformed field", "8:0 rbytes wbytes=5\n", true, 0, 5},
+	}
+	for _, tt := range tests {
+		read, write := parseBlkioStats(tt.content, tt.unified)
+		if read != tt.wantRead || write != tt.wantWrite {
+			t.Fatalf("%s: parseBlkioStats = %d, %d, want %d, %d", tt.name, read, write, tt.wantRead, tt.wantWrite)
+		}
+	}
+}
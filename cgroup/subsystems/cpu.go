@@ -1,9 +1,11 @@
 package subsystems
 
 import (
-	"io/ioutil"
 	"fmt"
+	"io/ioutil"
 	"path"
+	"strconv"
+	"strings"
 )
 
 type CPUSubSystem struct{}
@@ -12,26 +14,83 @@ func (m *CPUSubSystem) Name() string {
 	return subCPU
 }
 
-// Set 限制内存使用
+// Set 限制 CPU 时间片权重和 CFS 带宽
 func (m *CPUSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	subPath, err := GetCgroupPath(m.Name(), cgroupPath, true)
 	if err != nil {
 		return err
 	}
 
-	if res.CPUShare == "" {
+	if IsCgroup2UnifiedMode() {
+		return m.setV2(subPath, res)
+	}
+
+	// 通过将值写入到 cpu.shares 文件中来达到限制的效果
+	if res.CPUShare != "" {
+		if err := writeCPUFile(subPath, "cpu.shares", res.CPUShare); err != nil {
+			return err
+		}
+	}
+	// 每个 cpu.cfs_period_us 周期内最多可以使用 cpu.cfs_quota_us 的 CPU 时间
+	if res.CPUPeriod != "" {
+		if err := writeCPUFile(subPath, "cpu.cfs_period_us", res.CPUPeriod); err != nil {
+			return err
+		}
+	}
+	if res.CPUQuota != "" {
+		if err := writeCPUFile(subPath, "cpu.cfs_quota_us", res.CPUQuota); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *CPUSubSystem) setV2(subPath string, res *ResourceConfig) error {
+	if res.CPUShare != "" {
+		shares, _ := strconv.ParseUint(res.CPUShare, 10, 64)
+		weight := ConvertCPUSharesToWeight(shares)
+		if err := writeCPUFile(subPath, "cpu.weight", strconv.FormatUint(weight, 10)); err != nil {
+			return err
+		}
+	}
+
+	if res.CPUPeriod == "" && res.CPUQuota == "" {
 		return nil
 	}
+	// cpu.max 的格式为 "<quota> <period>"，只修改其中一项时需要保留另一项原来的值
+	b, err := ioutil.ReadFile(path.Join(subPath, "cpu.max"))
+	if err != nil {
+		return fmt.Errorf("read cgroup cpu.max error: %v", err)
+	}
+	current := strings.Fields(string(b))
+	quota, period := "max", "100000"
+	if len(current) == 2 {
+		quota, period = current[0], current[1]
+	}
+	if res.CPUQuota != "" {
+		quota = res.CPUQuota
+		if quota == "-1" {
+			quota = "max"
+		}
+	}
+	if res.CPUPeriod != "" {
+		period = res.CPUPeriod
+	}
+	return writeCPUFile(subPath, "cpu.max", quota+" "+period)
+}
 
-	// 通过将值写入到 memory.limit_in_bytes 文件中来达到限制的效果
-	if err := ioutil.WriteFile(
-		path.Join(subPath, "memory.limit_in_bytes"),
-		[]byte(res.MemoryLimit),
-		0644,
-	); err != nil {
-		return fmt.Errorf("set cgroup cpu error: %v", err)
+// ConvertCPUSharesToWeight v1 cpu.shares 的范围为 2-262144，v2 cpu.weight 为 1-10000，这里按比例进行转换
+func ConvertCPUSharesToWeight(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
 	}
+	return 1 + (shares-2)*9999/262142
+}
 
+func writeCPUFile(subPath, file, value string) error {
+	if err := ioutil.WriteFile(path.Join(subPath, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("set cgroup cpu %s error: %v", file, err)
+	}
 	return nil
 }
 
@@ -0,0 +1,52 @@
+package subsystems
+
+import (
+	"path"
+)
+
+// CPUAcctSubSystem 只用于统计 CPU 使用时间，不做任何限制
+type CPUAcctSubSystem struct{}
+
+func (c *CPUAcctSubSystem) Name() string {
+	return subCPUAcct
+}
+
+// Set cpuacct 没有可以设置的限制，只需要创建 cgroup
+func (c *CPUAcctSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	_, err := GetCgroupPath(c.Name(), cgroupPath, true)
+	return err
+}
+
+// Apply 将进程添加到 cgroup 中
+func (c *CPUAcctSubSystem) Apply(cgroupPath string, pid int64) error {
+	return apply(c.Name(), cgroupPath, int(pid))
+}
+
+// Remove 删除 cgroup
+func (c *CPUAcctSubSystem) Remove(cgroupPath string) error {
+	return remove(c.Name(), cgroupPath)
+}
+
+// GetStats 读取 CPU 累计使用时间，v1 为 cpuacct.usage（纳秒），v2 为 cpu.stat 中的 usage_usec（微秒）
+func (c *CPUAcctSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subPath, err := GetCgroupPath(c.Name(), cgroupPath, false)
+	if err != nil {
+		return err
+	}
+
+	if IsCgroup2UnifiedMode() {
+		usec, err := readKeyValue(path.Join(subPath, "cpu.stat"), "usage_usec")
+		if err != nil {
+			return err
+		}
+		stats.CPUUsage = usec * 1000
+		return nil
+	}
+
+	usage, err := readUint(path.Join(subPath, "cpuacct.usage"))
+	if err != nil {
+		return err
+	}
+	stats.CPUUsage = usage
+	return nil
+}
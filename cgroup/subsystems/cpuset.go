@@ -0,0 +1,40 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+type CpusetSubSystem struct{}
+
+func (c *CpusetSubSystem) Name() string {
+	return subCpuset
+}
+
+// Set 限制进程可以使用的 CPU 核心
+func (c *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	subPath, err := GetCgroupPath(c.Name(), cgroupPath, true)
+	if err != nil {
+		return err
+	}
+
+	if res.CPUSet == "" {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path.Join(subPath, "cpuset.cpus"), []byte(res.CPUSet), 0644); err != nil {
+		return fmt.Errorf("set cgroup cpuset error: %v", err)
+	}
+	return nil
+}
+
+// Apply 将进程添加到 cgroup 中
+func (c *CpusetSubSystem) Apply(cgroupPath string, pid int64) error {
+	return apply(c.Name(), cgroupPath, int(pid))
+}
+
+// Remove 删除 cgroup
+func (c *CpusetSubSystem) Remove(cgroupPath string) error {
+	return remove(c.Name(), cgroupPath)
+}
@@ -0,0 +1,287 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// 设备类型
+const (
+	DeviceTypeAll   = 'a' // 所有设备
+	DeviceTypeChar  = 'c' // 字符设备
+	DeviceTypeBlock = 'b' // 块设备
+)
+
+// Wildcard 表示匹配任意的主设备号或次设备号，对应规则中的 *
+const Wildcard = -1
+
+// DeviceRule 对应 devices cgroup 中的一条规则，文本格式与 v1 的 devices.allow 相同：
+// <类型> <主设备号>:<次设备号> <权限>，比如 c 1:3 rwm，设备号可以为 *
+type DeviceRule struct {
+	Type   rune
+	Major  int64
+	Minor  int64
+	Access string // r 读、w 写、m mknod 的组合
+}
+
+// DefaultDeviceRules 容器默认可以访问的设备，其他设备只能通过 --device 或
+// --device-cgroup-rule 添加
+var DefaultDeviceRules = []string{
+	"c *:* m", // 允许 mknod 任意设备，但只有下面的设备可以读写
+	"b *:* m",
+	"c 1:3 rwm",   // /dev/null
+	"c 1:5 rwm",   // /dev/zero
+	"c 1:7 rwm",   // /dev/full
+	"c 1:8 rwm",   // /dev/random
+	"c 1:9 rwm",   // /dev/urandom
+	"c 5:0 rwm",   // /dev/tty
+	"c 5:2 rwm",   // /dev/ptmx
+	"c 136:* rwm", // /dev/pts/*
+}
+
+// ParseDeviceRule 解析文本格式的设备规则
+func ParseDeviceRule(s string) (*DeviceRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 1 && fields[0] == "a" {
+		// v1 中 "a" 等价于 "a *:* rwm"
+		return &DeviceRule{Type: DeviceTypeAll, Major: Wildcard, Minor: Wildcard, Access: "rwm"}, nil
+	}
+	if len(fields) != 3 || len(fields[0]) != 1 {
+		return nil, fmt.Errorf("invalid device cgroup rule %q, format is: <type> <major>:<minor> <access>", s)
+	}
+
+	r := &DeviceRule{Type: rune(fields[0][0])}
+	switch r.Type {
+	case DeviceTypeAll, DeviceTypeChar, DeviceTypeBlock:
+	default:
+		return nil, fmt.Errorf("invalid device type %q in rule %q", fields[0], s)
+	}
+
+	numbers := strings.Split(fields[1], ":")
+	if len(numbers) != 2 {
+		return nil, fmt.Errorf("invalid device number %q in rule %q", fields[1], s)
+	}
+	var err error
+	if r.Major, err = parseDeviceNumber(numbers[0]); err != nil {
+		return nil, fmt.Errorf("invalid major number in rule %q: %v", s, err)
+	}
+	if r.Minor, err = parseDeviceNumber(numbers[1]); err != nil {
+		return nil, fmt.Errorf("invalid minor number in rule %q: %v", s, err)
+	}
+
+	if fields[2] == "" || len(fields[2]) > 3 {
+		return nil, fmt.Errorf("invalid access %q in rule %q", fields[2], s)
+	}
+	for _, c := range fields[2] {
+		if !strings.ContainsRune("rwm", c) || strings.Count(fields[2], string(c)) > 1 {
+			return nil, fmt.Errorf("invalid access %q in rule %q", fields[2], s)
+		}
+	}
+	r.Access = fields[2]
+	return r, nil
+}
+
+func parseDeviceNumber(s string) (int64, error) {
+	if s == "*" {
+		return Wildcard, nil
+	}
+	return strconv.ParseInt(s, 10, 32)
+}
+
+// DeviceRuleFromPath 根据宿主机上的设备文件生成规则，用于 --device 将宿主机设备传递给容器
+func DeviceRuleFromPath(devicePath, access string) (*DeviceRule, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devicePath, &st); err != nil {
+		return nil, fmt.Errorf("stat device %s error: %v", devicePath, err)
+	}
+
+	var t rune
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		t = DeviceTypeChar
+	case unix.S_IFBLK:
+		t = DeviceTypeBlock
+	default:
+		return nil, fmt.Errorf("%s is not a device", devicePath)
+	}
+	return ParseDeviceRule(fmt.Sprintf(
+		"%c %d:%d %s", t, unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), access,
+	))
+}
+
+func (r *DeviceRule) String() string {
+	number := func(n int64) string {
+		if n == Wildcard {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, number(r.Major), number(r.Minor), r.Access)
+}
+
+// DevicesSubSystem 限制容器可以访问的设备，v1 中通过 devices.deny 和 devices.allow 实现，
+// v2 中没有对应的接口文件，需要在 cgroup 上挂载一个 BPF_PROG_TYPE_CGROUP_DEVICE 类型的 eBPF 程序
+type DevicesSubSystem struct{}
+
+func (d *DevicesSubSystem) Name() string {
+	return subDevices
+}
+
+// Set 只允许访问默认规则和 res.DeviceRules 中的设备，v1 中 cgroup 刚创建时可以访问所有设备，
+// 此时先禁止访问所有设备再逐条放开；已经是白名单时（比如 update）只写入与 devices.list
+// 不同的规则，避免容器在规则重新放开之前短暂地无法访问任何设备
+func (d *DevicesSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	subPath, err := GetCgroupPath(d.Name(), cgroupPath, true)
+	if err != nil {
+		return err
+	}
+
+	var rules []*DeviceRule
+	for _, s := range append(DefaultDeviceRules, res.DeviceRules...) {
+		r, err := ParseDeviceRule(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+
+	if IsCgroup2UnifiedMode() {
+		return attachDeviceFilter(subPath, rules)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(subPath, "devices.list"))
+	if err != nil {
+		return fmt.Errorf("read cgroup devices.list error: %v", err)
+	}
+	var current []*DeviceRule
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		r, err := ParseDeviceRule(line)
+		if err != nil {
+			return fmt.Errorf("parse cgroup devices.list error: %v", err)
+		}
+		current = append(current, r)
+	}
+
+	reset, allow, deny := diffDeviceRules(current, rules)
+	if reset {
+		if err := ioutil.WriteFile(path.Join(subPath, "devices.deny"), []byte("a"), 0644); err != nil {
+			return fmt.Errorf("set cgroup devices.deny error: %v", err)
+		}
+	}
+	// 先放开新增的设备，再收回多余的权限
+	for _, r := range allow {
+		zlog.New().Info("allow device", zap.String("path", subPath), zap.String("rule", r.String()))
+		if err := ioutil.WriteFile(path.Join(subPath, "devices.allow"), []byte(r.String()), 0644); err != nil {
+			return fmt.Errorf("set cgroup devices.allow %q error: %v", r.String(), err)
+		}
+	}
+	for _, r := range deny {
+		zlog.New().Info("deny device", zap.String("path", subPath), zap.String("rule", r.String()))
+		if err := ioutil.WriteFile(path.Join(subPath, "devices.deny"), []byte(r.String()), 0644); err != nil {
+			return fmt.Errorf("set cgroup devices.deny %q error: %v", r.String(), err)
+		}
+	}
+	return nil
+}
+
+// deviceKey 标识 devices.list 中的一个设备，同一个设备的多条规则在内核中会合并为一条
+type deviceKey struct {
+	Type         rune
+	Major, Minor int64
+}
+
+// diffDeviceRules 比较 v1 devices.list 中的规则 current 和期望的白名单 want，同一个设备的规则合并后比较，
+// current 中包含类型 a 的规则时表示可以访问所有设备，需要先写入 devices.deny a 重置（reset 为 true），
+// 再放开 want 中的所有规则；否则只返回需要放开的权限 allow 和需要收回的权限 deny
+func diffDeviceRules(current, want []*DeviceRule) (reset bool, allow, deny []*DeviceRule) {
+	// 白名单中包含类型 a 的规则时可以访问所有设备，只需要写入这一条
+	for _, r := range want {
+		if r.Type != DeviceTypeAll {
+			continue
+		}
+		for _, c := range current {
+			if c.Type == DeviceTypeAll {
+				return false, nil, nil
+			}
+		}
+		return false, []*DeviceRule{r}, nil
+	}
+
+	has := map[deviceKey]string{}
+	for _, r := range current {
+		if r.Type == DeviceTypeAll {
+			return true, want, nil
+		}
+		k := deviceKey{r.Type, r.Major, r.Minor}
+		has[k] = mergeAccess(has[k], r.Access)
+	}
+
+	wanted := map[deviceKey]string{}
+	var keys []deviceKey
+	for _, r := range want {
+		k := deviceKey{r.Type, r.Major, r.Minor}
+		if _, ok := wanted[k]; !ok {
+			keys = append(keys, k)
+		}
+		wanted[k] = mergeAccess(wanted[k], r.Access)
+	}
+
+	for _, k := range keys {
+		if missing := subtractAccess(wanted[k], has[k]); missing != "" {
+			allow = append(allow, &DeviceRule{Type: k.Type, Major: k.Major, Minor: k.Minor, Access: missing})
+		}
+	}
+	for _, r := range current {
+		k := deviceKey{r.Type, r.Major, r.Minor}
+		extra := subtractAccess(has[k], wanted[k])
+		if extra == "" {
+			continue
+		}
+		deny = append(deny, &DeviceRule{Type: k.Type, Major: k.Major, Minor: k.Minor, Access: extra})
+		// 同一个设备只收回一次
+		has[k] = wanted[k]
+	}
+	return false, allow, deny
+}
+
+// mergeAccess 返回 a 和 b 中权限的并集，按照 rwm 的顺序排列
+func mergeAccess(a, b string) string {
+	var merged strings.Builder
+	for _, c := range "rwm" {
+		if strings.ContainsRune(a, c) || strings.ContainsRune(b, c) {
+			merged.WriteRune(c)
+		}
+	}
+	return merged.String()
+}
+
+// subtractAccess 返回 a 中有而 b 中没有的权限
+func subtractAccess(a, b string) string {
+	var diff strings.Builder
+	for _, c := range "rwm" {
+		if strings.ContainsRune(a, c) && !strings.ContainsRune(b, c) {
+			diff.WriteRune(c)
+		}
+	}
+	return diff.String()
+}
+
+// Apply 将进程添加到 cgroup 中
+func (d *DevicesSubSystem) Apply(cgroupPath string, pid int64) error {
+	return apply(d.Name(), cgroupPath, int(pid))
+}
+
+// Remove 删除 cgroup，v2 中挂载在 cgroup 上的 eBPF 程序会随 cgroup 一起释放
+func (d *DevicesSubSystem) Remove(cgroupPath string) error {
+	return remove(d.Name(), cgroupPath)
+}
@@ -0,0 +1,283 @@
+package subsystems
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// v2 的 devices 控制通过 eBPF 程序实现：内核在 cgroup 中的进程访问设备时调用挂载在 cgroup 上的
+// BPF_PROG_TYPE_CGROUP_DEVICE 程序，程序的参数为 struct bpf_cgroup_dev_ctx：
+//
+//	struct bpf_cgroup_dev_ctx {
+//		__u32 access_type; // 低 16 位为设备类型，高 16 位为访问类型
+//		__u32 major;
+//		__u32 minor;
+//	};
+//
+// 返回 1 表示允许访问，0 表示拒绝。这里根据 DeviceRule 直接生成字节码，每条规则对应一段
+// 指令，匹配时返回 1，不匹配时跳到下一条规则，所有规则都不匹配时返回 0
+
+// 指令的操作码，见 include/uapi/linux/bpf.h 和 bpf_common.h
+const (
+	bpfLdxMemW   = 0x61 // BPF_LDX | BPF_MEM | BPF_W：dst = *(u32 *)(src + off)
+	bpfAlu64AndK = 0x57 // BPF_ALU64 | BPF_AND | BPF_K：dst &= imm
+	bpfAlu64RshK = 0x77 // BPF_ALU64 | BPF_RSH | BPF_K：dst >>= imm
+	bpfMov64K    = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K：dst = imm
+	bpfMov64X    = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X：dst = src
+	bpfJneK      = 0x55 // BPF_JMP | BPF_JNE | BPF_K：if dst != imm goto pc + off
+	bpfJneX      = 0x5d // BPF_JMP | BPF_JNE | BPF_X：if dst != src goto pc + off
+	bpfExit      = 0x95 // BPF_JMP | BPF_EXIT：return r0
+)
+
+// bpf_cgroup_dev_ctx 中设备类型和访问类型的取值
+const (
+	bpfDevcgDevBlock = 1
+	bpfDevcgDevChar  = 2
+
+	bpfDevcgAccMknod = 1
+	bpfDevcgAccRead  = 2
+	bpfDevcgAccWrite = 4
+)
+
+// bpfInsn 对应 struct bpf_insn，regs 的低 4 位为目标寄存器，高 4 位为源寄存器
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// deviceFilterProgram 根据规则生成 eBPF 程序，寄存器的用途：
+// r1 bpf_cgroup_dev_ctx，加载完成后用作临时寄存器；r2 设备类型；r3 访问类型；r4 主设备号；r5 次设备号
+func deviceFilterProgram(rules []*DeviceRule) []bpfInsn {
+	prog := []bpfInsn{
+		insn(bpfLdxMemW, 2, 1, 0, 0),
+		insn(bpfAlu64AndK, 2, 0, 0, 0xffff),
+		insn(bpfLdxMemW, 3, 1, 0, 0),
+		insn(bpfAlu64RshK, 3, 0, 0, 16),
+		insn(bpfLdxMemW, 4, 1, 4, 0),
+		insn(bpfLdxMemW, 5, 1, 8, 0),
+	}
+
+	for _, r := range rules {
+		// 跳转指令的 off 先记录为 -1，整段规则生成完之后再改为跳到下一条规则的偏移量
+		var block []bpfInsn
+		switch r.Type {
+		case DeviceTypeChar:
+			block = append(block, insn(bpfJneK, 2, 0, -1, bpfDevcgDevChar))
+		case DeviceTypeBlock:
+			block = append(block, insn(bpfJneK, 2, 0, -1, bpfDevcgDevBlock))
+		}
+		if access := bpfAccess(r.Access); access != bpfDevcgAccMknod|bpfDevcgAccRead|bpfDevcgAccWrite {
+			// 请求的访问类型必须是规则中访问类型的子集：(r3 & access) == r3
+			block = append(block,
+				insn(bpfMov64X, 1, 3, 0, 0),
+				insn(bpfAlu64AndK, 1, 0, 0, access),
+				insn(bpfJneX, 1, 3, -1, 0),
+			)
+		}
+		if r.Major != Wildcard {
+			block = append(block, insn(bpfJneK, 4, 0, -1, int32(r.Major)))
+		}
+		if r.Minor != Wildcard {
+			block = append(block, insn(bpfJneK, 5, 0, -1, int32(r.Minor)))
+		}
+		block = append(block, insn(bpfMov64K, 0, 0, 0, 1), insn(bpfExit, 0, 0, 0, 0))
+
+		for i := range block {
+			if block[i].off == -1 {
+				block[i].off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+
+	return append(prog, insn(bpfMov64K, 0, 0, 0, 0), insn(bpfExit, 0, 0, 0, 0))
+}
+
+func bpfAccess(access string) int32 {
+	var a int32
+	for _, c := range access {
+		switch c {
+		case 'm':
+			a |= bpfDevcgAccMknod
+		case 'r':
+			a |= bpfDevcgAccRead
+		case 'w':
+			a |= bpfDevcgAccWrite
+		}
+	}
+	return a
+}
+
+// bpf 系统调用中各个命令使用的 union bpf_attr
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+type bpfProgQueryAttr struct {
+	targetFd    uint32
+	attachType  uint32
+	queryFlags  uint32
+	attachFlags uint32
+	progIDs     uint64
+	progCnt     uint32
+	_           uint32
+}
+
+type bpfGetFdByIDAttr struct {
+	id        uint32
+	nextID    uint32
+	openFlags uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// loadDeviceFilter 将程序加载到内核中，返回程序的文件描述符
+func loadDeviceFilter(prog []bpfInsn) (int, error) {
+	license := []byte("Apache\x00")
+	attr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	defer runtime.KeepAlive(prog)
+	defer runtime.KeepAlive(license)
+
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	// 5.11 之前的内核使用 RLIMIT_MEMLOCK 限制 eBPF 程序占用的内存，默认值较小
+	if err == unix.EPERM {
+		unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+		fd, err = bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	}
+	if err == nil {
+		return fd, nil
+	}
+
+	// 加载失败时打开 verifier 的日志再加载一次，用于定位错误
+	logBuf := make([]byte, 64*1024)
+	attr.logLevel = 1
+	attr.logSize = uint32(len(logBuf))
+	attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+	if fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+		return fd, nil
+	}
+	runtime.KeepAlive(logBuf)
+	return -1, fmt.Errorf("load device filter error: %v, verifier log: %s", err, cString(logBuf))
+}
+
+// queryDeviceFilters 返回 cgroup 上已经挂载的 device 程序的文件描述符
+func queryDeviceFilters(dirFd int) ([]int, error) {
+	ids := make([]uint32, 64)
+	attr := bpfProgQueryAttr{
+		targetFd:   uint32(dirFd),
+		attachType: unix.BPF_CGROUP_DEVICE,
+		progIDs:    uint64(uintptr(unsafe.Pointer(&ids[0]))),
+		progCnt:    uint32(len(ids)),
+	}
+	_, err := bpf(unix.BPF_PROG_QUERY, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(ids)
+	if err != nil {
+		return nil, fmt.Errorf("query device filters error: %v", err)
+	}
+
+	var fds []int
+	for _, id := range ids[:attr.progCnt] {
+		getAttr := bpfGetFdByIDAttr{id: id}
+		fd, err := bpf(unix.BPF_PROG_GET_FD_BY_ID, unsafe.Pointer(&getAttr), unsafe.Sizeof(getAttr))
+		if err != nil {
+			closeAll(fds)
+			return nil, fmt.Errorf("get device filter %d error: %v", id, err)
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// attachDeviceFilter 生成并挂载新的 device 程序，然后卸载之前挂载的程序（比如 update 时），
+// 同时挂载多个程序时需要所有程序都允许才能访问，先挂载新程序可以保证中间不会出现没有限制的窗口
+func attachDeviceFilter(subPath string, rules []*DeviceRule) error {
+	progFd, err := loadDeviceFilter(deviceFilterProgram(rules))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(progFd)
+
+	dirFd, err := unix.Open(subPath, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open cgroup %s error: %v", subPath, err)
+	}
+	defer unix.Close(dirFd)
+
+	oldFds, err := queryDeviceFilters(dirFd)
+	if err != nil {
+		return err
+	}
+	defer closeAll(oldFds)
+
+	attr := bpfProgAttachAttr{
+		targetFd:    uint32(dirFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return fmt.Errorf("attach device filter to %s error: %v", subPath, err)
+	}
+
+	for _, fd := range oldFds {
+		detach := bpfProgAttachAttr{
+			targetFd:    uint32(dirFd),
+			attachBpfFd: uint32(fd),
+			attachType:  unix.BPF_CGROUP_DEVICE,
+		}
+		if _, err := bpf(unix.BPF_PROG_DETACH, unsafe.Pointer(&detach), unsafe.Sizeof(detach)); err != nil {
+			return fmt.Errorf("detach old device filter from %s error: %v", subPath, err)
+		}
+	}
+	return nil
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
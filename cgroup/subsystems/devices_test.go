@@ -0,0 +1,229 @@
+package subsystems
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDeviceRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want DeviceRule
+	}{
+		{"c 1:3 rwm", DeviceRule{DeviceTypeChar, 1, 3, "rwm"}},
+		{"b 8:* r", DeviceRule{DeviceTypeBlock, 8, Wildcard, "r"}},
+		{"c *:* m", DeviceRule{DeviceTypeChar, Wildcard, Wildcard, "m"}},
+		{"a", DeviceRule{DeviceTypeAll, Wildcard, Wildcard, "rwm"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseDeviceRule(tt.in)
+		if err != nil {
+			t.Fatalf("ParseDeviceRule(%q) error: %v", tt.in, err)
+		}
+		if *got != tt.want {
+			t.Fatalf("ParseDeviceRule(%q) = %+v, want %+v", tt.in, *got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "c 1:3", "x 1:3 rwm", "c 1 rwm", "c a:3 rwm", "c 1:3 rwx", "c 1:3 rr", "c 1:3 rwmr"} {
+		if _, err := ParseDeviceRule(in); err == nil {
+			t.Fatalf("ParseDeviceRule(%q) should fail", in)
+		}
+	}
+}
+
+// runDeviceFilter 解释执行 deviceFilterProgram 生成的程序，只支持其中用到的指令
+func runDeviceFilter(t *testing.T, prog []bpfInsn, devType, access, major, minor uint32) bool {
+	ctx := []uint32{access<<16 | devType, major, minor}
+	var regs [11]uint64
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		dst, src := ins.regs&0x0f, ins.regs>>4
+		switch ins.code {
+		case bpfLdxMemW:
+			regs[dst] = uint64(ctx[ins.off/4])
+		case bpfAlu64AndK:
+			regs[dst] &= uint64(ins.imm)
+		case bpfAlu64RshK:
+			regs[dst] >>= uint64(ins.imm)
+		case bpfMov64K:
+			regs[dst] = uint64(ins.imm)
+		case bpfMov64X:
+			regs[dst] = regs[src]
+		case bpfJneK:
+			if regs[dst] != uint64(ins.imm) {
+				pc += int(ins.off)
+			}
+		case bpfJneX:
+			if regs[dst] != regs[src] {
+				pc += int(ins.off)
+			}
+		case bpfExit:
+			return regs[0] == 1
+		default:
+			t.Fatalf("unknown instruction %#x at %d", ins.code, pc)
+		}
+	}
+	t.Fatal("program does not exit")
+	return false
+}
+
+func TestDeviceFilterProgram(t *testing.T) {
+	var rules []*DeviceRule
+	for _, s := range append(DefaultDeviceRules, "b 8:0 r") {
+		r, err := ParseDeviceRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	prog := deviceFilterProgram(rules)
+
+	const (
+		r, w, m = bpfDevcgAccRead, bpfDevcgAccWrite, bpfDevcgAccMknod
+		c, b    = bpfDevcgDevChar, bpfDevcgDevBlock
+	)
+	tests := []struct {
+		name                        string
+		devType, access, maj, minor uint32
+		allowed                     bool
+	}{
+		{"read /dev/null", c, r, 1, 3, true},
+		{"write /dev/urandom", c, w, 1, 9, true},
+		{"read write /dev/pts/3", c, r | w, 136, 3, true},
+		{"mknod any char device", c, m, 10, 200, true},
+		{"mknod any block device", b, m, 8, 16, true},
+		{"read /dev/mem", c, r, 1, 1, false},
+		{"read /dev/kmsg", c, r, 1, 11, false},
+		{"read /dev/sda", b, r, 8, 0, true},
+		{"write /dev/sda", b, w, 8, 0, false},
+		{"read /dev/sdb", b, r, 8, 16, false},
+		{"read char device 8:0", c, r, 8, 0, false},
+	}
+	for _, tt := range tests {
+		if got := runDeviceFilter(t, prog, tt.devType, tt.access, tt.maj, tt.minor); got != tt.allowed {
+			t.Fatalf("%s: allowed = %v, want %v", tt.name, got, tt.allowed)
+		}
+	}
+
+	// 没有规则时拒绝所有访问
+	if runDeviceFilter(t, deviceFilterProgram(nil), c, r, 1, 3) {
+		t.Fatal("empty program should deny all devices")
+	}
+}
+
+func TestDiffDeviceRules(t *testing.T) {
+	parse := func(rules ...string) []*DeviceRule {
+		var parsed []*DeviceRule
+		for _, s := range rules {
+			r, err := ParseDeviceRule(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed = append(parsed, r)
+		}
+		return parsed
+	}
+	join := func(rules []*DeviceRule) string {
+		var s []string
+		for _, r := range rules {
+			s = append(s, r.String())
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		name    string
+		current []string
+		want    []string
+		reset   bool
+		allow   string
+		deny    string
+	}{
+		{
+			name:    "new cgroup allows all devices",
+			current: []string{"a *:* rwm"},
+			want:    []string{"c 1:3 rwm", "c 136:* rwm"},
+			reset:   true,
+			allow:   "c 1:3 rwm,c 136:* rwm",
+		},
+		{
+			name:    "unchanged",
+			current: []string{"c 1:3 rwm", "c 136:* rwm"},
+			want:    []string{"c 136:* rwm", "c 1:3 rwm"},
+		},
+		{
+			name:    "add device",
+			current: []string{"c 1:3 rwm"},
+			want:    []string{"c 1:3 rwm", "b 8:0 rw"},
+			allow:   "b 8:0 rw",
+		},
+		{
+			name:    "remove device",
+			current: []string{"c 1:3 rwm", "b 8:0 rw"},
+			want:    []string{"c 1:3 rwm"},
+			deny:    "b 8:0 rw",
+		},
+		{
+			name:    "change access",
+			current: []string{"c 1:3 rwm", "b 8:0 r"},
+			want:    []string{"c 1:3 rw", "b 8:0 rw"},
+			allow:   "b 8:0 w",
+			deny:    "c 1:3 m",
+		},
+		{
+			// 同一个设备的多条规则合并后比较
+			name:    "merge rules of the same device",
+			current: []string{"c 1:3 rw"},
+			want:    []string{"c 1:3 r", "c 1:3 w"},
+		},
+		{
+			name:    "allow all",
+			current: []string{"c 1:3 rwm"},
+			want:    []string{"c 1:3 rwm", "a *:* rwm"},
+			allow:   "a *:* rwm",
+		},
+		{
+			name:    "already allow all",
+			current: []string{"a *:* rwm"},
+			want:    []string{"a *:* rwm"},
+		},
+	}
+	for _, tt := range tests {
+		reset, allow, deny := diffDeviceRules(parse(tt.current...), parse(tt.want...))
+		if reset != tt.reset || join(allow) != tt.allow || join(deny) != tt.deny {
+			t.Fatalf("%s: diffDeviceRules = %v, allow %q, deny %q, want %v, allow %q, deny %q",
+				tt.name, reset, join(allow), join(deny), tt.reset, tt.allow, tt.deny)
+		}
+	}
+}
+
+func TestDevicesSetUnchanged(t *testing.T) {
+	f := newFakeRoot(t, false)
+	d := &DevicesSubSystem{}
+	res := &ResourceConfig{DeviceRules: []string{"b 8:0 rw"}}
+	if err := d.Set("test", res); err != nil {
+		t.Fatal(err)
+	}
+
+	// update 时 devices.list 已经是白名单，规则没有变化时不写入任何文件
+	f.Write(t, subDevices, "test", "devices.list", strings.Join(append(DefaultDeviceRules, "b 8:0 rw"), "\n"))
+	f.Write(t, subDevices, "test", "devices.allow", "")
+	f.Write(t, subDevices, "test", "devices.deny", "")
+	if err := d.Set("test", res); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"devices.allow", "devices.deny"} {
+		if got := f.Read(t, subDevices, "test", file); got != "" {
+			t.Fatalf("%s = %q, want empty", file, got)
+		}
+	}
+
+	// 去掉 --device-cgroup-rule 时只收回该设备的权限，不会先禁止所有设备
+	if err := d.Set("test", &ResourceConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Read(t, subDevices, "test", "devices.deny"); got != "b 8:0 rw" {
+		t.Fatalf("devices.deny = %q, want b 8:0 rw", got)
+	}
+}
@@ -0,0 +1,23 @@
+package subsystems
+
+import (
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/cgrouptest"
+)
+
+// newFakeRoot 创建一个 cgrouptest.FakeRoot 并通过 SetRoot 替换当前的 cgroup 文件系统，测试结束时恢复
+func newFakeRoot(t *testing.T, unified bool) *cgrouptest.FakeRoot {
+	f := cgrouptest.New(t, unified)
+	t.Cleanup(SetRoot(&Root{
+		MountInfo:         f.MountInfo,
+		Unified:           unified,
+		UnifiedMountPoint: f.Dir,
+		ProcDir:           f.ProcDir,
+		Mkdir:             f.Mkdir,
+		Rmdir:             f.Rmdir,
+		Kill:              f.Kill,
+		EnableController:  f.EnableController,
+	}))
+	return f
+}
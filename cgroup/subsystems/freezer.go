@@ -0,0 +1,121 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// freezer 的状态
+const (
+	Frozen = "FROZEN"
+	Thawed = "THAWED"
+)
+
+// FreezerSubSystem 用于挂起和恢复 cgroup 中的所有进程，本身没有资源限制
+type FreezerSubSystem struct{}
+
+func (f *FreezerSubSystem) Name() string {
+	return subFreezer
+}
+
+// Set freezer 没有可以设置的限制，只需要创建 cgroup
+func (f *FreezerSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	_, err := GetCgroupPath(f.Name(), cgroupPath, true)
+	return err
+}
+
+// Apply 将进程添加到 cgroup 中
+func (f *FreezerSubSystem) Apply(cgroupPath string, pid int64) error {
+	return apply(f.Name(), cgroupPath, int(pid))
+}
+
+// Remove 删除 cgroup
+func (f *FreezerSubSystem) Remove(cgroupPath string) error {
+	return remove(f.Name(), cgroupPath)
+}
+
+// Freeze 挂起 cgroup 中的所有进程，直到状态变为 FROZEN 才返回
+func (f *FreezerSubSystem) Freeze(cgroupPath string) error {
+	return f.setState(cgroupPath, Frozen)
+}
+
+// Thaw 恢复 cgroup 中的所有进程，直到状态变为 THAWED 才返回
+func (f *FreezerSubSystem) Thaw(cgroupPath string) error {
+	return f.setState(cgroupPath, Thawed)
+}
+
+// State 返回 cgroup 当前的 freezer 状态
+func (f *FreezerSubSystem) State(cgroupPath string) (string, error) {
+	subPath, err := GetCgroupPath(f.Name(), cgroupPath, false)
+	if err != nil {
+		return "", err
+	}
+	return readFreezerState(subPath)
+}
+
+func (f *FreezerSubSystem) setState(cgroupPath, state string) error {
+	subPath, err := GetCgroupPath(f.Name(), cgroupPath, false)
+	if err != nil {
+		return err
+	}
+
+	// v1 写入 FROZEN 后状态可能会先变为 FREEZING，需要等待所有进程都被挂起，
+	// 期间有新进程 fork 出来时可能会一直停在 FREEZING，所以在等待的过程中重复写入
+	timeout := time.After(5 * time.Second)
+	for {
+		if err := writeFreezerState(subPath, state); err != nil {
+			return err
+		}
+		current, err := readFreezerState(subPath)
+		if err != nil {
+			return err
+		}
+		if current == state {
+			return nil
+		}
+
+		select {
+		case <-timeout:
+			return fmt.Errorf("wait cgroup freezer state to be %s timeout, current state is %s", state, current)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// writeFreezerState v1 写入 freezer.state，v2 写入 cgroup.freeze（1 为挂起，0 为恢复）
+func writeFreezerState(subPath, state string) error {
+	file, value := "freezer.state", state
+	if IsCgroup2UnifiedMode() {
+		file, value = "cgroup.freeze", "0"
+		if state == Frozen {
+			value = "1"
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(subPath, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("set cgroup freezer state error: %v", err)
+	}
+	return nil
+}
+
+// readFreezerState v1 读取 freezer.state，v2 读取 cgroup.events 中的 frozen 字段
+func readFreezerState(subPath string) (string, error) {
+	if IsCgroup2UnifiedMode() {
+		frozen, err := readKeyValue(path.Join(subPath, "cgroup.events"), "frozen")
+		if err != nil {
+			return "", err
+		}
+		if frozen == 1 {
+			return Frozen, nil
+		}
+		return Thawed, nil
+	}
+
+	b, err := ioutil.ReadFile(path.Join(subPath, "freezer.state"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
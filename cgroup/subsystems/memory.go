@@ -3,7 +3,9 @@ package subsystems
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"strconv"
 
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
 	"go.uber.org/zap"
@@ -22,24 +24,126 @@ func (m *MemorySubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 		return err
 	}
 
-	if res.MemoryLimit == "" {
-		return nil
+	if IsCgroup2UnifiedMode() {
+		return m.setV2(subPath, res)
+	}
+	return m.setV1(subPath, res)
+}
+
+func (m *MemorySubSystem) setV1(subPath string, res *ResourceConfig) error {
+	// 通过将值写入到 memory.limit_in_bytes 文件中来达到限制的效果，
+	// memsw 的值必须始终大于等于 limit_in_bytes，所以调大限制时（比如 update）
+	// 要先写 memsw，调小时要先写 limit_in_bytes
+	swapFirst := false
+	if res.MemoryLimit != 0 && res.MemorySwap != 0 {
+		current, err := readUint(path.Join(subPath, "memory.limit_in_bytes"))
+		if err != nil {
+			return err
+		}
+		swapFirst = uint64(res.MemoryLimit) > current
+	}
+	if swapFirst {
+		if err := writeMemoryFile(subPath, "memory.memsw.limit_in_bytes", res.MemorySwap); err != nil {
+			return err
+		}
+	}
+	if res.MemoryLimit != 0 {
+		if err := writeMemoryFile(subPath, "memory.limit_in_bytes", res.MemoryLimit); err != nil {
+			return err
+		}
+	}
+	if res.MemorySwap != 0 && !swapFirst {
+		if err := writeMemoryFile(subPath, "memory.memsw.limit_in_bytes", res.MemorySwap); err != nil {
+			return err
+		}
+	}
+	if res.MemoryReservation != 0 {
+		if err := writeMemoryFile(subPath, "memory.soft_limit_in_bytes", res.MemoryReservation); err != nil {
+			return err
+		}
+	}
+	if res.KernelMemory != 0 {
+		// 较新的内核（5.16 之后）已经移除了 kmem 限制
+		if _, err := os.Stat(path.Join(subPath, "memory.kmem.limit_in_bytes")); os.IsNotExist(err) {
+			zlog.New().Warn("kernel memory limit is not supported by the kernel, ignore it")
+		} else if err := writeMemoryFile(subPath, "memory.kmem.limit_in_bytes", res.KernelMemory); err != nil {
+			return err
+		}
+	}
+	if res.OOMKillDisable {
+		if err := ioutil.WriteFile(path.Join(subPath, "memory.oom_control"), []byte("1"), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory oom_control error: %v", err)
+		}
+	}
+	return nil
+}
+
+func (m *MemorySubSystem) setV2(subPath string, res *ResourceConfig) error {
+	if res.MemoryLimit != 0 {
+		if err := writeMemoryFile(subPath, "memory.max", res.MemoryLimit); err != nil {
+			return err
+		}
+	}
+	// v2 中 memory.swap.max 只限制 swap 的使用量，需要减去内存限制
+	if res.MemorySwap != 0 {
+		swap := res.MemorySwap
+		if swap != -1 {
+			swap -= res.MemoryLimit
+		}
+		if err := writeMemoryFile(subPath, "memory.swap.max", swap); err != nil {
+			return err
+		}
+	}
+	if res.MemoryReservation != 0 {
+		if err := writeMemoryFile(subPath, "memory.low", res.MemoryReservation); err != nil {
+			return err
+		}
+	}
+	if res.KernelMemory != 0 {
+		zlog.New().Warn("kernel memory limit is not supported by cgroup v2, ignore it")
+	}
+	if res.OOMKillDisable {
+		zlog.New().Warn("disable oom kill is not supported by cgroup v2, ignore it")
+	}
+	return nil
+}
+
+// writeMemoryFile 将以字节为单位的限制写入 subPath 下的 file 中，-1 表示不限制
+func writeMemoryFile(subPath, file string, bytes int64) error {
+	value := strconv.FormatInt(bytes, 10)
+	if bytes == -1 && IsCgroup2UnifiedMode() {
+		value = "max"
 	}
 
 	zlog.New().Info(
-		"write limit to file...", 
-		zap.String("path", path.Join(subPath, "memory.limit_in_bytes")),
+		"write limit to file...",
+		zap.String("path", path.Join(subPath, file)),
+		zap.String("value", value),
 	)
 
-	// 通过将值写入到 memory.limit_in_bytes 文件中来达到限制的效果
-	if err := ioutil.WriteFile(
-		path.Join(subPath, "memory.limit_in_bytes"),
-		[]byte(res.MemoryLimit),
-		0644,
-	); err != nil {
-		return fmt.Errorf("set cgroup memory error: %v", err)
+	if err := ioutil.WriteFile(path.Join(subPath, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("set cgroup memory %s error: %v", file, err)
+	}
+	return nil
+}
+
+// GetStats 读取内存使用量和内存限制
+func (m *MemorySubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subPath, err := GetCgroupPath(m.Name(), cgroupPath, false)
+	if err != nil {
+		return err
 	}
 
+	usageFile, limitFile := "memory.usage_in_bytes", "memory.limit_in_bytes"
+	if IsCgroup2UnifiedMode() {
+		usageFile, limitFile = "memory.current", "memory.max"
+	}
+	if stats.MemoryUsage, err = readUint(path.Join(subPath, usageFile)); err != nil {
+		return err
+	}
+	if stats.MemoryLimit, err = readUint(path.Join(subPath, limitFile)); err != nil {
+		return err
+	}
 	return nil
 }
 
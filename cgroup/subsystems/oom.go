@@ -0,0 +1,150 @@
+package subsystems
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// NotifyOOM 监听 cgroup 中的 OOM 事件，每发生一次 OOM 就向返回的 channel 中发送一个信号，
+// cgroup 被删除后 channel 会被关闭
+// v1 通过 eventfd 注册 memory.oom_control 事件，v2 通过 inotify 监听 memory.events 的变化
+func (m *MemorySubSystem) NotifyOOM(cgroupPath string) (<-chan struct{}, error) {
+	subPath, err := GetCgroupPath(m.Name(), cgroupPath, false)
+	if err != nil {
+		return nil, err
+	}
+	if IsCgroup2UnifiedMode() {
+		return notifyOOMV2(subPath)
+	}
+	return notifyOOMV1(subPath)
+}
+
+// OOMKillCount 返回 cgroup 中因为 OOM 被 kill 的进程数量，
+// 对应 v1 memory.oom_control 和 v2 memory.events 中的 oom_kill 字段
+func (m *MemorySubSystem) OOMKillCount(cgroupPath string) (uint64, error) {
+	subPath, err := GetCgroupPath(m.Name(), cgroupPath, false)
+	if err != nil {
+		return 0, err
+	}
+	file := "memory.oom_control"
+	if IsCgroup2UnifiedMode() {
+		file = "memory.events"
+	}
+	return readKeyValue(path.Join(subPath, file), "oom_kill")
+}
+
+func notifyOOMV1(subPath string) (<-chan struct{}, error) {
+	oomControl, err := os.Open(path.Join(subPath, "memory.oom_control"))
+	if err != nil {
+		return nil, fmt.Errorf("open memory.oom_control error: %v", err)
+	}
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		oomControl.Close()
+		return nil, fmt.Errorf("create eventfd error: %v", err)
+	}
+	eventFile := os.NewFile(uintptr(efd), "eventfd")
+
+	// 向 cgroup.event_control 写入 "<eventfd> <memory.oom_control 的 fd>" 注册监听，
+	// 之后每次 OOM 内核都会向 eventfd 中写入数据
+	data := fmt.Sprintf("%d %d", efd, oomControl.Fd())
+	if err := ioutil.WriteFile(path.Join(subPath, "cgroup.event_control"), []byte(data), 0700); err != nil {
+		eventFile.Close()
+		oomControl.Close()
+		return nil, fmt.Errorf("register oom event error: %v", err)
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer func() {
+			close(ch)
+			eventFile.Close()
+			oomControl.Close()
+		}()
+		buf := make([]byte, 8)
+		for {
+			if _, err := eventFile.Read(buf); err != nil {
+				return
+			}
+			// cgroup 被删除时也会触发一次事件，此时需要退出监听
+			if _, err := os.Stat(path.Join(subPath, "cgroup.event_control")); os.IsNotExist(err) {
+				return
+			}
+			sendNonBlocking(ch)
+		}
+	}()
+	return ch, nil
+}
+
+func notifyOOMV2(subPath string) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init error: %v", err)
+	}
+	eventsPath := path.Join(subPath, "memory.events")
+	if _, err := unix.InotifyAddWatch(fd, eventsPath, unix.IN_MODIFY); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("inotify watch %s error: %v", eventsPath, err)
+	}
+	inotifyFile := os.NewFile(uintptr(fd), "inotify")
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer func() {
+			close(ch)
+			inotifyFile.Close()
+		}()
+		var last uint64
+		buf := make([]byte, unix.SizeofInotifyEvent+unix.PathMax+1)
+		for {
+			if _, err := inotifyFile.Read(buf); err != nil {
+				return
+			}
+			// cgroup 被删除后 memory.events 也随之消失
+			n, err := readKeyValue(eventsPath, "oom_kill")
+			if err != nil {
+				return
+			}
+			if n > last {
+				last = n
+				sendNonBlocking(ch)
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func sendNonBlocking(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// readKeyValue 读取 "<key> <value>" 格式文件中 key 对应的值，比如 memory.events 或 memory.stat
+func readKeyValue(file, key string) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("key %s not found in %s", key, file)
+}
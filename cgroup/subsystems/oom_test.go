@@ -0,0 +1,135 @@
+package subsystems
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadKeyValue(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memory.events")
+	content := "low 0\nhigh 12\nmax 3\noom 2\noom_kill 1\noom_group_kill 0\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     string
+		want    uint64
+		wantErr bool
+	}{
+		{"high", 12, false},
+		{"oom", 2, false},
+		// oom 不能匹配到 oom_kill 或 oom_group_kill
+		{"oom_kill", 1, false},
+		{"oom_group_kill", 0, false},
+		{"swap", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := readKeyValue(file, tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("readKeyValue(%s) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Fatalf("readKeyValue(%s) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("oom_kill abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readKeyValue(file, "oom_kill"); err == nil {
+		t.Fatal("invalid value should be rejected")
+	}
+}
+
+func TestOOMKillCount(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		f := newFakeRoot(t, unified)
+		if _, err := GetCgroupPath(subMem, "oom", true); err != nil {
+			t.Fatal(err)
+		}
+		m := &MemorySubSystem{}
+		n, err := m.OOMKillCount("oom")
+		if err != nil || n != 0 {
+			t.Fatalf("unified=%v: OOMKillCount = %d, %v, want 0", unified, n, err)
+		}
+
+		if unified {
+			f.Write(t, subMem, "oom", "memory.events", "low 0\nhigh 0\nmax 4\noom 3\noom_kill 2\n")
+		} else {
+			f.Write(t, subMem, "oom", "memory.oom_control", "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n")
+		}
+		n, err = m.OOMKillCount("oom")
+		if err != nil || n != 2 {
+			t.Fatalf("unified=%v: OOMKillCount = %d, %v, want 2", unified, n, err)
+		}
+	}
+}
+
+func TestNotifyOOMV2(t *testing.T) {
+	f := newFakeRoot(t, true)
+	if _, err := GetCgroupPath(subMem, "oom", true); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := (&MemorySubSystem{}).NotifyOOM("oom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(want bool) {
+		t.Helper()
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				t.Fatal("channel closed unexpectedly")
+			}
+			if !want {
+				t.Fatal("unexpected oom event")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Fatal("oom event not received")
+			}
+		}
+	}
+
+	// 内核会一次性更新 memory.events，这里原地覆盖写入等长的内容，避免读到被截断的文件
+	update := func(content string) {
+		t.Helper()
+		file, err := os.OpenFile(filepath.Join(f.Path(subMem, "oom"), "memory.events"), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 其他字段的变化不算 OOM
+	update("low 0\nhigh 1\nmax 1\noom 0\noom_kill 0\n")
+	wait(false)
+	update("low 0\nhigh 1\nmax 2\noom 1\noom_kill 1\n")
+	wait(true)
+	update("low 0\nhigh 1\nmax 3\noom 2\noom_kill 2\n")
+	wait(true)
+
+	// memory.events 随 cgroup 一起被删除后 channel 被关闭
+	if err := f.Rmdir(f.Path(subMem, "oom")); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel not closed after cgroup removed")
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+type PidsSubSystem struct{}
+
+func (p *PidsSubSystem) Name() string {
+	return subPids
+}
+
+// Set 限制 cgroup 中的进程（线程）数量，防止 fork 炸弹
+func (p *PidsSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	subPath, err := GetCgroupPath(p.Name(), cgroupPath, true)
+	if err != nil {
+		return err
+	}
+
+	if res.PidsLimit == 0 {
+		return nil
+	}
+
+	limit := "max"
+	if res.PidsLimit > 0 {
+		limit = strconv.FormatInt(res.PidsLimit, 10)
+	}
+	if err := ioutil.WriteFile(path.Join(subPath, "pids.max"), []byte(limit), 0644); err != nil {
+		return fmt.Errorf("set cgroup pids error: %v", err)
+	}
+	return nil
+}
+
+// Apply 将进程添加到 cgroup 中
+func (p *PidsSubSystem) Apply(cgroupPath string, pid int64) error {
+	return apply(p.Name(), cgroupPath, int(pid))
+}
+
+// Remove 删除 cgroup
+func (p *PidsSubSystem) Remove(cgroupPath string) error {
+	return remove(p.Name(), cgroupPath)
+}
+
+// GetStats 读取 pids.current 获取当前进程数量
+func (p *PidsSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subPath, err := GetCgroupPath(p.Name(), cgroupPath, false)
+	if err != nil {
+		return err
+	}
+	n, err := readUint(path.Join(subPath, "pids.current"))
+	if err != nil {
+		return err
+	}
+	stats.Pids = n
+	return nil
+}
@@ -0,0 +1,24 @@
+package subsystems
+
+// Stats 记录从 cgroup 文件中读取到的资源使用情况
+type Stats struct {
+	CPUUsage    uint64 `json:"cpu_usage"`    // 累计使用的 CPU 时间，单位为纳秒
+	MemoryUsage uint64 `json:"memory_usage"` // 当前内存使用量，单位为字节
+	MemoryLimit uint64 `json:"memory_limit"` // 内存限制，单位为字节
+	Pids        uint64 `json:"pids"`         // 当前 cgroup 中的进程（线程）数量
+	BlkioRead   uint64 `json:"blkio_read"`   // 块设备累计读取字节数
+	BlkioWrite  uint64 `json:"blkio_write"`  // 块设备累计写入字节数
+}
+
+// StatsGetter 由能够提供资源使用统计的 subsystem 实现
+type StatsGetter interface {
+	// 读取某个 cgroup 在这个 subsystem 中的资源使用情况，并填充到 stats 中
+	GetStats(cgroupPath string, stats *Stats) error
+}
+
+var (
+	_ StatsGetter = &CPUAcctSubSystem{}
+	_ StatsGetter = &MemorySubSystem{}
+	_ StatsGetter = &PidsSubSystem{}
+	_ StatsGetter = &BlkioSubSystem{}
+)
@@ -1,23 +1,120 @@
 package subsystems
 
 import (
-	"io/ioutil"
 	"fmt"
-	"strconv"
+	"io/ioutil"
+	"math"
 	"path"
-	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
-	subMem = "memory"
-	subCPU = "cpu"
+	subMem     = "memory"
+	subCPU     = "cpu"
+	subCPUAcct = "cpuacct"
+	subCpuset  = "cpuset"
+	subPids    = "pids"
+	subBlkio   = "blkio"
+	subFreezer = "freezer"
+	subDevices = "devices"
 )
 
 // ResourceConfig 用于记录资源限制配置
 type ResourceConfig struct {
-	MemoryLimit string // 内存限制
-	CPUShare    string // CPU 时间片权重
-	CPUSet      string // CPU 核心数
+	// 内存相关限制，单位为字节，0 表示不限制
+	MemoryLimit       int64 // 内存限制
+	MemorySwap        int64 // 内存 + swap 的总限制，-1 表示不限制 swap
+	MemoryReservation int64 // 内存软限制，系统内存紧张时会尽量回收到该值以下
+	KernelMemory      int64 // 内核内存限制
+	OOMKillDisable    bool  // 超出内存限制时是否禁止内核 kill 容器进程
+
+	CPUShare  string // CPU 时间片权重
+	CPUPeriod string // CFS 调度周期，单位为微秒
+	CPUQuota  string // 每个调度周期内可以使用的 CPU 时间，单位为微秒，-1 表示不限制
+	CPUSet    string // 可以使用的 CPU 核心，比如 0-3 或 0,1
+
+	PidsLimit int64 // 最大进程数，0 表示不设置，-1 表示不限制
+
+	// 块设备 IO 限制，除 BlkioWeight 外每一项的格式都为 <设备路径>:<值>，比如 /dev/sda:1048576
+	BlkioWeight     string   // IO 权重，范围 10-1000
+	DeviceReadBps   []string // 设备每秒读取字节数限制
+	DeviceWriteBps  []string // 设备每秒写入字节数限制
+	DeviceReadIOps  []string // 设备每秒读操作次数限制
+	DeviceWriteIOps []string // 设备每秒写操作次数限制
+
+	// 在默认规则之外允许访问的设备，格式与 devices.allow 相同，比如 c 1:3 rwm
+	DeviceRules []string
+}
+
+const (
+	minMemoryLimit  = 6 * MiB // 内存限制的最小值，太小会导致容器进程无法启动
+	minKernelMemory = 4 * MiB // 内核内存限制的最小值
+)
+
+// Validate 在容器启动前检查资源限制配置是否合法，避免在设置 cgroup 时才报错
+func (r *ResourceConfig) Validate() error {
+	if r.MemoryLimit != 0 && r.MemoryLimit < minMemoryLimit {
+		return fmt.Errorf("minimum memory limit allowed is 6MB")
+	}
+	if r.MemorySwap != 0 && r.MemorySwap != -1 {
+		if r.MemoryLimit == 0 {
+			return fmt.Errorf("memory swap limit requires memory limit to be set")
+		}
+		if r.MemorySwap < r.MemoryLimit {
+			return fmt.Errorf("memory swap limit should be larger than memory limit")
+		}
+	}
+	if r.MemoryReservation != 0 && r.MemoryLimit != 0 && r.MemoryReservation > r.MemoryLimit {
+		return fmt.Errorf("memory limit should be larger than memory reservation")
+	}
+	if r.KernelMemory != 0 && r.KernelMemory < minKernelMemory {
+		return fmt.Errorf("minimum kernel memory limit allowed is 4MB")
+	}
+
+	if r.CPUShare != "" {
+		if n, err := strconv.ParseUint(r.CPUShare, 10, 64); err != nil || n < 2 || n > 262144 {
+			return fmt.Errorf("invalid cpu shares %q, range is 2-262144", r.CPUShare)
+		}
+	}
+	if r.CPUPeriod != "" {
+		if n, err := strconv.ParseUint(r.CPUPeriod, 10, 64); err != nil || n < 1000 || n > 1000000 {
+			return fmt.Errorf("invalid cpu period %q, range is 1000-1000000", r.CPUPeriod)
+		}
+	}
+	if r.CPUQuota != "" && r.CPUQuota != "-1" {
+		if n, err := strconv.ParseUint(r.CPUQuota, 10, 64); err != nil || n < 1000 {
+			return fmt.Errorf("invalid cpu quota %q, it should be -1 or larger than 1000", r.CPUQuota)
+		}
+	}
+	if r.PidsLimit < -1 {
+		return fmt.Errorf("invalid pids limit %d", r.PidsLimit)
+	}
+
+	if r.BlkioWeight != "" {
+		if _, err := parseBlkioWeight(r.BlkioWeight); err != nil {
+			return err
+		}
+	}
+	for _, d := range append(r.DeviceReadBps, r.DeviceWriteBps...) {
+		if _, _, _, err := parseThrottleDevice(d, true); err != nil {
+			return err
+		}
+	}
+	for _, d := range append(r.DeviceReadIOps, r.DeviceWriteIOps...) {
+		if _, _, _, err := parseThrottleDevice(d, false); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.DeviceRules {
+		if _, err := ParseDeviceRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type Interface interface {
@@ -37,6 +134,12 @@ type Interface interface {
 var (
 	_ Interface = &MemorySubSystem{}
 	_ Interface = &CPUSubSystem{}
+	_ Interface = &CPUAcctSubSystem{}
+	_ Interface = &CpusetSubSystem{}
+	_ Interface = &PidsSubSystem{}
+	_ Interface = &BlkioSubSystem{}
+	_ Interface = &FreezerSubSystem{}
+	_ Interface = &DevicesSubSystem{}
 )
 
 // apply 和 remove 具有通用性，可以复用代码
@@ -48,8 +151,14 @@ func apply(subSysName, cgroupPath string, pid int) error {
 		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
 	}
 
+	// v2 中不再有 tasks 文件，通过 cgroup.procs 添加进程
+	procsFile := "tasks"
+	if IsCgroup2UnifiedMode() {
+		procsFile = "cgroup.procs"
+	}
+
 	if err := ioutil.WriteFile(
-		path.Join(subPath, "tasks"),
+		path.Join(subPath, procsFile),
 		[]byte(strconv.Itoa(pid)),
 		0644,
 	); err != nil {
@@ -60,15 +169,83 @@ func apply(subSysName, cgroupPath string, pid int) error {
 }
 
 func remove(subSysName, cgroupPath string) error {
+	// v2 中所有 subsystem 共用一个目录，v1 中也可能多个 subsystem 挂载在同一个
+	// hierarchy 下（比如 cpu,cpuacct），所以目录可能已经被其他 subsystem 删除了
+	if !CgroupExists(subSysName, cgroupPath) {
+		return nil
+	}
+
 	subPath, err := GetCgroupPath(subSysName, cgroupPath, false)
 	if err != nil {
 		return fmt.Errorf("remove cgroup %s error: %v", cgroupPath, err)
 	}
 
-	if err := os.Remove(subPath); err != nil {
+	// cgroup 中还有进程时 rmdir 会返回 EBUSY
+	if err := killProcs(subPath); err != nil {
+		return fmt.Errorf("remove cgroup %s error: %v", cgroupPath, err)
+	}
+	if err := currentRoot().Rmdir(subPath); err != nil {
 		return err
 	}
+	// 容器的 cgroup 位于 cgroup parent 下，比如 fakedocker/<id>，最后一个容器退出后
+	// 将空的 parent 一并删除
+	removeEmptyParents(FindCgroupMountPoint(subSysName), cgroupPath)
 
 	return nil
 }
 
+// killProcs 杀死 cgroup 中残留的所有进程，并等待它们退出
+func killProcs(subPath string) error {
+	timeout := time.After(5 * time.Second)
+	for {
+		pids, err := readProcs(subPath)
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			if err := currentRoot().Kill(pid); err != nil && err != unix.ESRCH {
+				return fmt.Errorf("kill process %d error: %v", pid, err)
+			}
+		}
+
+		select {
+		case <-timeout:
+			return fmt.Errorf("wait processes %v in cgroup to exit timeout", pids)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// readProcs 读取 cgroup.procs 中所有进程的 pid
+func readProcs(subPath string) ([]int, error) {
+	b, err := ioutil.ReadFile(path.Join(subPath, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, s := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse cgroup.procs error: %v", err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// readUint 读取只包含一个整数的 cgroup 文件，比如 cpuacct.usage、pids.current
+func readUint(file string) (uint64, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(b))
+	// v2 中不限制时值为 max
+	if s == "max" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
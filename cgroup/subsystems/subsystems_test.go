@@ -0,0 +1,247 @@
+package subsystems
+
+import (
+	"testing"
+)
+
+func TestSubsystemsV1(t *testing.T) {
+	res := &ResourceConfig{
+		MemoryLimit:       64 * MiB,
+		MemorySwap:        128 * MiB,
+		MemoryReservation: 32 * MiB,
+		KernelMemory:      16 * MiB,
+		OOMKillDisable:    true,
+		CPUShare:          "512",
+		CPUPeriod:         "50000",
+		CPUQuota:          "25000",
+		CPUSet:            "1",
+		PidsLimit:         100,
+		BlkioWeight:       "300",
+		DeviceRules:       []string{"b 8:0 rw"},
+	}
+	tests := []struct {
+		subsystem Interface
+		files     map[string]string
+	}{
+		{&MemorySubSystem{}, map[string]string{
+			"memory.limit_in_bytes":       "67108864",
+			"memory.memsw.limit_in_bytes": "134217728",
+			"memory.soft_limit_in_bytes":  "33554432",
+			"memory.kmem.limit_in_bytes":  "16777216",
+			"memory.oom_control":          "1",
+		}},
+		{&CPUSubSystem{}, map[string]string{
+			"cpu.shares":        "512",
+			"cpu.cfs_period_us": "50000",
+			"cpu.cfs_quota_us":  "25000",
+		}},
+		{&CPUAcctSubSystem{}, nil},
+		{&CpusetSubSystem{}, map[string]string{
+			"cpuset.cpus": "1",
+			"cpuset.mems": "0",
+		}},
+		{&PidsSubSystem{}, map[string]string{
+			"pids.max": "100",
+		}},
+		{&BlkioSubSystem{}, map[string]string{
+			"blkio.weight": "300",
+		}},
+		{&FreezerSubSystem{}, nil},
+		// fake 中每次写入都会覆盖文件，devices.allow 中只保留最后一条规则
+		{&DevicesSubSystem{}, map[string]string{
+			"devices.deny":  "a",
+			"devices.allow": "b 8:0 rw",
+		}},
+	}
+
+	f := newFakeRoot(t, false)
+	for _, tt := range tests {
+		name := tt.subsystem.Name()
+		t.Run(name, func(t *testing.T) {
+			cgroupPath := "fakedocker/test"
+			if err := tt.subsystem.Set(cgroupPath, res); err != nil {
+				t.Fatal(err)
+			}
+			for file, want := range tt.files {
+				if got := f.Read(t, name, cgroupPath, file); got != want {
+					t.Fatalf("%s = %q, want %q", file, got, want)
+				}
+			}
+
+			if err := tt.subsystem.Apply(cgroupPath, 1234); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Read(t, name, cgroupPath, "tasks"); got != "1234" {
+				t.Fatalf("tasks = %q, want 1234", got)
+			}
+
+			if err := tt.subsystem.Remove(cgroupPath); err != nil {
+				t.Fatal(err)
+			}
+			// 最后一个容器的 cgroup 删除后，空的 cgroup parent 也一并删除
+			if f.Exists(name, cgroupPath) || f.Exists(name, "fakedocker") {
+				t.Fatal("cgroup is not removed")
+			}
+			// 重复删除不会报错
+			if err := tt.subsystem.Remove(cgroupPath); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSubsystemsV2(t *testing.T) {
+	res := &ResourceConfig{
+		MemoryLimit:       64 * MiB,
+		MemorySwap:        128 * MiB,
+		MemoryReservation: 32 * MiB,
+		CPUShare:          "1024",
+		CPUQuota:          "50000",
+		PidsLimit:         -1,
+		BlkioWeight:       "500",
+	}
+	tests := []struct {
+		subsystem Interface
+		files     map[string]string
+	}{
+		{&MemorySubSystem{}, map[string]string{
+			"memory.max":      "67108864",
+			"memory.swap.max": "67108864",
+			"memory.low":      "33554432",
+		}},
+		{&CPUSubSystem{}, map[string]string{
+			"cpu.weight": "39",
+			"cpu.max":    "50000 100000",
+		}},
+		{&PidsSubSystem{}, map[string]string{
+			"pids.max": "max",
+		}},
+		{&BlkioSubSystem{}, map[string]string{
+			"io.weight": "default 4950",
+		}},
+	}
+
+	f := newFakeRoot(t, true)
+	for _, tt := range tests {
+		name := tt.subsystem.Name()
+		t.Run(name, func(t *testing.T) {
+			cgroupPath := "fakedocker/test"
+			if err := tt.subsystem.Set(cgroupPath, res); err != nil {
+				t.Fatal(err)
+			}
+			for file, want := range tt.files {
+				if got := f.Read(t, name, cgroupPath, file); got != want {
+					t.Fatalf("%s = %q, want %q", file, got, want)
+				}
+			}
+
+			if err := tt.subsystem.Apply(cgroupPath, 1234); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Read(t, name, cgroupPath, "cgroup.procs"); got != "1234" {
+				t.Fatalf("cgroup.procs = %q, want 1234", got)
+			}
+
+			// 删除前先 kill cgroup 中残留的进程
+			f.Killed = nil
+			if err := tt.subsystem.Remove(cgroupPath); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.Killed) != 1 || f.Killed[0] != 1234 {
+				t.Fatalf("killed = %v, want [1234]", f.Killed)
+			}
+			if f.Exists(name, cgroupPath) || f.Exists(name, "fakedocker") {
+				t.Fatal("cgroup is not removed")
+			}
+		})
+	}
+}
+
+// TestSubsystemsV2SharedPath 模拟 SetAll，多个 subsystem 依次设置同一个 cgroup，
+// 后设置的 subsystem 看到目录已经存在时依然要在各级父 cgroup 中开启自己的 controller
+func TestSubsystemsV2SharedPath(t *testing.T) {
+	f := newFakeRoot(t, true)
+	res := &ResourceConfig{
+		MemoryLimit: 64 * MiB,
+		CPUShare:    "1024",
+		CPUSet:      "0-1",
+		PidsLimit:   100,
+		BlkioWeight: "500",
+	}
+	cgroupPath := "fakedocker/test"
+	subs := []Interface{
+		&CPUSubSystem{}, &CPUAcctSubSystem{}, &CpusetSubSystem{}, &MemorySubSystem{},
+		&PidsSubSystem{}, &BlkioSubSystem{}, &FreezerSubSystem{},
+	}
+	for _, sub := range subs {
+		if err := sub.Set(cgroupPath, res); err != nil {
+			t.Fatalf("set %s error: %v", sub.Name(), err)
+		}
+	}
+
+	for _, p := range []string{"", "fakedocker"} {
+		if got := f.Read(t, subMem, p, "cgroup.subtree_control"); got != "cpuset cpu io memory pids" {
+			t.Fatalf("%q cgroup.subtree_control = %q", p, got)
+		}
+	}
+	files := map[string]string{
+		"memory.max":  "67108864",
+		"cpu.weight":  "39",
+		"cpuset.cpus": "0-1",
+		"pids.max":    "100",
+		"io.weight":   "default 4950",
+	}
+	for file, want := range files {
+		if got := f.Read(t, subMem, cgroupPath, file); got != want {
+			t.Fatalf("%s = %q, want %q", file, got, want)
+		}
+	}
+
+	for _, sub := range subs {
+		if err := sub.Apply(cgroupPath, 1234); err != nil {
+			t.Fatalf("apply %s error: %v", sub.Name(), err)
+		}
+	}
+	for _, sub := range subs {
+		if err := sub.Remove(cgroupPath); err != nil {
+			t.Fatalf("remove %s error: %v", sub.Name(), err)
+		}
+	}
+	if f.Exists(subMem, "fakedocker") {
+		t.Fatal("cgroup is not removed")
+	}
+}
+
+func TestEnableUnavailableController(t *testing.T) {
+	f := newFakeRoot(t, true)
+	// 根 cgroup 中没有 pids controller 时无法开启
+	f.Write(t, subPids, "", "cgroup.controllers", "cpuset cpu io memory")
+
+	if err := (&MemorySubSystem{}).Set("test", &ResourceConfig{MemoryLimit: 64 * MiB}); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&PidsSubSystem{}).Set("test", &ResourceConfig{PidsLimit: 100}); err == nil {
+		t.Fatal("set pids should fail when the controller is not available")
+	}
+}
+
+func TestFreezer(t *testing.T) {
+	newFakeRoot(t, false)
+	freezer := &FreezerSubSystem{}
+
+	if err := freezer.Set("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := freezer.Freeze("test"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := freezer.State("test"); err != nil || state != Frozen {
+		t.Fatalf("State = %q, %v, want %s", state, err, Frozen)
+	}
+	if err := freezer.Thaw("test"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := freezer.State("test"); err != nil || state != Thawed {
+		t.Fatalf("State = %q, %v, want %s", state, err, Thawed)
+	}
+}
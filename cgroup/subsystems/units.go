@@ -0,0 +1,64 @@
+package subsystems
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+const (
+	KiB int64 = 1 << (10 * (iota + 1))
+	MiB
+	GiB
+)
+
+// sizePattern 大小的格式为 <整数>[.<小数>][<单位>]，单位为 b、k、m、g，k m g 之后可以再跟一个 b
+var sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(b|[kmg]b?)?$`)
+
+// ParseSize 将带单位的大小转换为字节数，单位不区分大小写，支持 b k m g，
+// 单位后可以再跟一个 b，比如 512m 和 512mb 都表示 512 * 1024 * 1024，
+// 不带单位时表示字节数；小数部分换算成字节之后向下取整，超过 int64 范围时返回错误
+func ParseSize(s string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, usage <number>[<unit>], unit is one of b, k, m, g", s)
+	}
+
+	multiplier := int64(1)
+	switch strings.TrimSuffix(m[2], "b") {
+	case "k":
+		multiplier = KiB
+	case "m":
+		multiplier = MiB
+	case "g":
+		multiplier = GiB
+	}
+
+	// 使用有理数计算，避免浮点数的精度问题
+	n, ok := new(big.Rat).SetString(m[1])
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n.Mul(n, new(big.Rat).SetInt64(multiplier))
+	bytes := new(big.Int).Quo(n.Num(), n.Denom())
+	if !bytes.IsInt64() {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return bytes.Int64(), nil
+}
+
+// FormatSize 将字节数转换为便于阅读的格式，比如 1536 -> 1.5KiB
+func FormatSize(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(bytes)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	return fmt.Sprintf("%.2f%s", size, units[i])
+}
@@ -0,0 +1,41 @@
+package subsystems
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"1024", 1024},
+		{"100b", 100},
+		{"4k", 4 * KiB},
+		{"4KB", 4 * KiB},
+		{"512m", 512 * MiB},
+		{"512mb", 512 * MiB},
+		{"1.5g", 3 * GiB / 2},
+		{"2G", 2 * GiB},
+		{" 1.25k ", 1280},
+		{"0.5b", 0},
+		{"8589934591g", 8589934591 * GiB},
+		{"9223372036854775807", 9223372036854775807},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil {
+			t.Fatalf("ParseSize(%q) error: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"", "m", "-1m", "12t", "abc", "1mm", "1bb", "1.m", ".5m", "+1m", "1 m",
+		"inf", "nan", "infinity", "1e3", "0x10", "8589934592g", "9223372036854775808",
+	} {
+		if _, err := ParseSize(in); err == nil {
+			t.Fatalf("ParseSize(%q) should fail", in)
+		}
+	}
+}
@@ -1,71 +1,184 @@
 package subsystems
 
 import (
-	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/mountinfo"
+	"golang.org/x/sys/unix"
 )
 
-// FindCgroupMountPoint 通过 /proc/self/mountinfo 找出挂载了某个 subsystem 的 hierarchy cgroup
+// unifiedMountPoint 是 cgroup v2 (unified 模式) 默认的挂载点
+const unifiedMountPoint = "/sys/fs/cgroup"
+
+// Root 描述 cgroup 文件系统所在的位置以及创建、删除 cgroup 目录的方式，
+// 默认指向宿主机真实的 cgroup 文件系统，测试时可以通过 SetRoot 替换为临时目录
+type Root struct {
+	// MountInfo 用于查找 subsystem 挂载点的 mountinfo 文件
+	MountInfo string
+	// Unified 是否运行在 cgroup v2 (unified) 模式下
+	Unified bool
+	// UnifiedMountPoint v2 中所有 controller 共用的挂载点
+	UnifiedMountPoint string
+	// ProcDir proc 文件系统的挂载点，用于读取 <ProcDir>/<pid>/cgroup
+	ProcDir string
+	// Mkdir 创建一个 cgroup 目录，内核会在新目录中自动生成各个 subsystem 的文件
+	Mkdir func(dir string) error
+	// Rmdir 删除一个 cgroup 目录，cgroup 目录中的文件不需要（也不能）单独删除
+	Rmdir func(dir string) error
+	// Kill 杀死进程 pid，进程退出后内核会将其从所在的 cgroup 中移除
+	Kill func(pid int) error
+	// EnableController 在 v2 中为 dir 的子 cgroup 开启 controller，
+	// 内核会在已经存在的子 cgroup 中生成该 controller 的文件
+	EnableController func(dir, controller string) error
+}
+
+var (
+	rootOnce sync.Once
+	root     *Root
+)
+
+// hostRoot 返回宿主机的 cgroup 文件系统，当 /sys/fs/cgroup 的文件系统类型为 cgroup2 时
+// 运行在 unified 模式下，所有 subsystem 共用同一个 hierarchy
+func hostRoot() *Root {
+	r := &Root{
+		MountInfo:         "/proc/self/mountinfo",
+		UnifiedMountPoint: unifiedMountPoint,
+		ProcDir:           "/proc",
+		Mkdir:             func(dir string) error { return os.Mkdir(dir, 0755) },
+		Rmdir:             os.Remove,
+		Kill:              func(pid int) error { return unix.Kill(pid, unix.SIGKILL) },
+		EnableController: func(dir, controller string) error {
+			return ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+		},
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(unifiedMountPoint, &st); err == nil {
+		r.Unified = st.Type == unix.CGROUP2_SUPER_MAGIC
+	}
+	return r
+}
+
+// currentRoot 返回当前使用的 cgroup 文件系统，未通过 SetRoot 设置时使用宿主机的
+func currentRoot() *Root {
+	rootOnce.Do(func() {
+		if root == nil {
+			root = hostRoot()
+		}
+	})
+	return root
+}
+
+// SetRoot 替换当前使用的 cgroup 文件系统，返回的函数用于恢复原来的设置
+func SetRoot(r *Root) (restore func()) {
+	old := currentRoot()
+	root = r
+	return func() { root = old }
+}
+
+// IsCgroup2UnifiedMode 判断当前系统是否运行在 cgroup v2 (unified) 模式下
+func IsCgroup2UnifiedMode() bool {
+	return currentRoot().Unified
+}
+
+// v2ControllerName 将 v1 的 subsystem 名称转换为 v2 中对应的 controller 名称，
+// devices 和 freezer 在 v2 中由 eBPF 和 cgroup.freeze 实现，没有对应的 controller，返回空字符串
+func v2ControllerName(subsystem string) string {
+	switch subsystem {
+	case subBlkio:
+		return "io"
+	case subCPUAcct:
+		return "cpu"
+	case subDevices, subFreezer:
+		return ""
+	}
+	return subsystem
+}
+
+// FindCgroupMountPoint 通过 mountinfo（默认为 /proc/self/mountinfo）找出挂载了某个 subsystem 的 hierarchy cgroup
 // 根节点所在的目录
 func FindCgroupMountPoint(subsystem string) string {
-	f, err := os.Open("/proc/self/mountinfo")
+	// v2 中所有 controller 都挂载在同一个目录下，mountinfo 中也不会记录 controller 的名字
+	r := currentRoot()
+	if r.Unified {
+		return r.UnifiedMountPoint
+	}
+
+	// v1 的 cgroup 在 mountinfo 中记录示例：
+	// 40 35 0:34 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:649 - cgroup cgroup rw,cpu,cpuacct
+	// 超级块选项 rw,cpu,cpuacct 中记录了 hierarchy 中的 subsystem，挂载点 /sys/fs/cgroup/cpu,cpuacct
+	// 就是该 hierarchy 根节点所在的目录；hybrid 模式下 cgroup2 的挂载不包含 controller，需要排除
+	infos, err := mountinfo.ParseFile(r.MountInfo, mountinfo.FSTypeFilter("cgroup"))
 	if err != nil {
 		return ""
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		// cat /proc/self/mountinfo 后从中任选一条作为示例：
-		// 40 35 0:34 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:649 - cgroup cgroup rw,cpu,cpuacct
-		// 按空格分割后：
-		// [1] -> 40
-		// [2] -> 35
-		// [3] -> 0:34
-		// [4] -> /
-		// [5] -> /sys/fs/cgroup/cpu,cpuacct
-		// [6] -> rw,nosuid,nodev,noexec,relatime
-		// [7] -> shared:649
-		// [8] -> -
-		// [9] -> cgroup
-		// [10] -> cgroup
-		// [11] -> rw,cpu,cpuacct
-		// 其中可以通过最后一条判断 subsystem 的类型，这里先通过 len(s)-1 获取到该字段，再通过 ","
-		// 进行分割，将分割后的字段[rw cpu cpuacct] 与参数 subsystem 逐一进行比较，如果有任意一个匹
-		// 配，则说明该条记录是我们需要的，同时观察发现，第[5]条记录就是该 subsystem 所在的位置，将该
-		// 记录返回即可，在上面的例子中就是 /sys/fs/cgroup/cpu,cpuacct (文件名就是 cpu,cpuacct)
-		txt := scanner.Text()
-		s := strings.Split(txt, " ")
-
-		for _, v := range strings.Split(s[len(s)-1], ",") {
-			if v == subsystem {
-				return s[4]
-			}
+	for _, info := range infos {
+		if info.HasSuperOption(subsystem) {
+			return info.MountPoint
 		}
 	}
+	return ""
+}
 
-	if err := scanner.Err(); err != nil {
-		return ""
+// ProcessCgroupPath 从 /proc/<pid>/cgroup 中读取进程在 subsystem 中所在的 cgroup 路径，
+// v1 中每行的格式为 <hierarchy ID>:<subsystem 列表>:<路径>，比如 4:cpu,cpuacct:/user.slice，
+// v2 中只有一行 0::<路径>
+func ProcessCgroupPath(subsystem string, pid int) (string, error) {
+	file := path.Join(currentRoot().ProcDir, strconv.Itoa(pid), "cgroup")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
 	}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if IsCgroup2UnifiedMode() {
+			if parts[0] == "0" && parts[1] == "" {
+				return parts[2], nil
+			}
+			continue
+		}
+		for _, s := range strings.Split(parts[1], ",") {
+			if s == subsystem {
+				return parts[2], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", subsystem, file)
+}
 
-	return ""
+// CgroupExists 返回 subsystem 中是否已经存在 cgroupPath 对应的 cgroup
+func CgroupExists(subsystem, cgroupPath string) bool {
+	cgroupRoot := FindCgroupMountPoint(subsystem)
+	if cgroupRoot == "" {
+		return false
+	}
+	_, err := os.Stat(path.Join(cgroupRoot, cgroupPath))
+	return err == nil
 }
 
 func GetCgroupPath(subsystem string, cgroupPath string, autoCreate bool) (string, error) {
 	cgroupRoot := FindCgroupMountPoint(subsystem)
+	if cgroupRoot == "" {
+		return "", fmt.Errorf("cgroup subsystem %s is not mounted", subsystem)
+	}
 	p := path.Join(cgroupRoot, cgroupPath)
 	_, err := os.Stat(p)
-	if err != nil {
-		// 如果文件夹不存在且用户指定自动创建
-		if autoCreate && os.IsNotExist(err) {
-			if err := os.Mkdir(p, 0755); err != nil {
-				return "", fmt.Errorf("create cgroup error: %v", err)
-			}
-		} else {
-			return p, fmt.Errorf("cgroup path error: %v", err)
+	if err != nil && !(autoCreate && os.IsNotExist(err)) {
+		return p, fmt.Errorf("cgroup path error: %v", err)
+	}
+	// 如果文件夹不存在且用户指定自动创建；v2 中目录可能已经由其他 subsystem 创建，
+	// 此时也需要确认各级父 cgroup 中开启了当前 subsystem 对应的 controller
+	if autoCreate && (err != nil || IsCgroup2UnifiedMode()) {
+		if err := createCgroupDirs(subsystem, cgroupRoot, cgroupPath); err != nil {
+			return "", fmt.Errorf("create cgroup error: %v", err)
 		}
 	}
 	return p, nil
@@ -76,4 +189,87 @@ func GetCgroupPath(subsystem string, cgroupPath string, autoCreate bool) (string
 	// 	return path.Join(cgroupRoot, cgroupPath), nil
 	// }
 	// return "", fmt.Errorf("cgroup path error: %v", err)
-}
\ No newline at end of file
+}
+
+// createCgroupDirs 逐级创建 cgroupPath 中不存在的目录，比如 cgroupPath 为 fakedocker/<id> 时，
+// 会先创建 fakedocker 再创建 fakedocker/<id>
+// v1 中新创建的 cpuset cgroup 的 cpuset.cpus 和 cpuset.mems 都为空，此时无法将进程加入其中
+// （报错 No space left on device），所以每一级都需要从父 cgroup 中复制；
+// v2 中每一级都需要在父 cgroup 中开启对应的 controller，已经存在的目录也是如此
+func createCgroupDirs(subsystem, cgroupRoot, cgroupPath string) error {
+	current := cgroupRoot
+	for _, dir := range strings.Split(path.Clean(cgroupPath), "/") {
+		if dir == "" || dir == "." {
+			continue
+		}
+		parent := current
+		current = path.Join(current, dir)
+
+		if IsCgroup2UnifiedMode() {
+			if err := enableController(parent, subsystem); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Stat(current); err == nil {
+			continue
+		}
+		if err := currentRoot().Mkdir(current); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if subsystem == subCpuset && !IsCgroup2UnifiedMode() {
+			for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+				if err := copyIfEmpty(current, file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// copyIfEmpty 如果 subPath 中的 file 内容为空，则将父 cgroup 中同名文件的内容复制过来
+func copyIfEmpty(subPath, file string) error {
+	b, err := ioutil.ReadFile(path.Join(subPath, file))
+	if err != nil {
+		return fmt.Errorf("read cgroup %s error: %v", file, err)
+	}
+	if strings.TrimSpace(string(b)) != "" {
+		return nil
+	}
+
+	parent, err := ioutil.ReadFile(path.Join(path.Dir(subPath), file))
+	if err != nil {
+		return fmt.Errorf("read parent cgroup %s error: %v", file, err)
+	}
+	if err := ioutil.WriteFile(path.Join(subPath, file), parent, 0644); err != nil {
+		return fmt.Errorf("copy parent cgroup %s error: %v", file, err)
+	}
+	return nil
+}
+
+// removeEmptyParents 从 cgroupPath 的父目录开始逐级向上删除空的 cgroup，直到 cgroup 根目录，
+// 还有子 cgroup 的目录会删除失败，此时停止；systemd 的 slice 由 systemd 自己管理，不做删除
+func removeEmptyParents(cgroupRoot, cgroupPath string) {
+	for dir := path.Dir(path.Clean(cgroupPath)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if strings.HasSuffix(dir, ".slice") {
+			return
+		}
+		if err := currentRoot().Rmdir(path.Join(cgroupRoot, dir)); err != nil {
+			return
+		}
+	}
+}
+
+// enableController 在 v2 中，子 cgroup 只能使用父 cgroup 的 cgroup.subtree_control
+// 中开启了的 controller，这里将 subsystem 对应的 controller 在父 cgroup 中开启，
+// 重复开启不会报错，controller 不可用时返回错误
+func enableController(parent, subsystem string) error {
+	controller := v2ControllerName(subsystem)
+	if controller == "" {
+		return nil
+	}
+	if err := currentRoot().EnableController(parent, controller); err != nil {
+		return fmt.Errorf("enable controller %s in %s error: %v", controller, parent, err)
+	}
+	return nil
+}
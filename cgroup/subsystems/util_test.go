@@ -1,27 +1,128 @@
 package subsystems
 
 import (
-	"fmt"
+	"path/filepath"
 	"testing"
 )
 
 func TestFindCgroupMountPoint(t *testing.T) {
-	s := FindCgroupMountPoint(subCPU)
-	fmt.Printf("cpu: %v\n", s)
-	// Output: 
-	// cpu: /sys/fs/cgroup/cpu,cpuacct
-
-	memory := FindCgroupMountPoint(subMem)
-	fmt.Printf("memory: %v\n", memory)
-	// Output: 
-	// memory: /sys/fs/cgroup/memory
+	f := newFakeRoot(t, false)
+
+	for _, subsystem := range []string{subCPU, subMem, subFreezer} {
+		if got, want := FindCgroupMountPoint(subsystem), filepath.Join(f.Dir, subsystem); got != want {
+			t.Fatalf("FindCgroupMountPoint(%q) = %q, want %q", subsystem, got, want)
+		}
+	}
+	if got := FindCgroupMountPoint("hugetlb"); got != "" {
+		t.Fatalf("FindCgroupMountPoint(hugetlb) = %q, want empty", got)
+	}
+}
+
+func TestFindCgroupMountPointUnified(t *testing.T) {
+	f := newFakeRoot(t, true)
+
+	for _, subsystem := range []string{subCPU, subMem, subBlkio} {
+		if got := FindCgroupMountPoint(subsystem); got != f.Dir {
+			t.Fatalf("FindCgroupMountPoint(%q) = %q, want %q", subsystem, got, f.Dir)
+		}
+	}
 }
 
 func TestGetCgroupPath(t *testing.T) {
-	s, err := GetCgroupPath(subMem, "cgroup-test", true)
+	f := newFakeRoot(t, false)
+
+	if _, err := GetCgroupPath(subMem, "cgroup-test", false); err == nil {
+		t.Fatal("GetCgroupPath without autoCreate should fail when the cgroup does not exist")
+	}
+
+	s, err := GetCgroupPath(subMem, "fakedocker/cgroup-test", true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	
-	t.Logf("path: %v\n", s)
-}
\ No newline at end of file
+	if want := f.Path(subMem, "fakedocker/cgroup-test"); s != want {
+		t.Fatalf("GetCgroupPath = %q, want %q", s, want)
+	}
+	if !f.Exists(subMem, "fakedocker/cgroup-test") {
+		t.Fatal("cgroup is not created")
+	}
+}
+
+func TestGetCgroupPathCopyCpuset(t *testing.T) {
+	f := newFakeRoot(t, false)
+
+	if _, err := GetCgroupPath(subCpuset, "fakedocker/cgroup-test", true); err != nil {
+		t.Fatal(err)
+	}
+	// 每一级 cgroup 都需要从父 cgroup 复制 cpuset.cpus 和 cpuset.mems
+	for _, p := range []string{"fakedocker", "fakedocker/cgroup-test"} {
+		if got := f.Read(t, subCpuset, p, "cpuset.cpus"); got != "0-3" {
+			t.Fatalf("%s cpuset.cpus = %q, want 0-3", p, got)
+		}
+		if got := f.Read(t, subCpuset, p, "cpuset.mems"); got != "0" {
+			t.Fatalf("%s cpuset.mems = %q, want 0", p, got)
+		}
+	}
+}
+
+func TestGetCgroupPathEnableController(t *testing.T) {
+	f := newFakeRoot(t, true)
+
+	if _, err := GetCgroupPath(subBlkio, "fakedocker/cgroup-test", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"", "fakedocker"} {
+		if got := f.Read(t, subBlkio, p, "cgroup.subtree_control"); got != "io" {
+			t.Fatalf("%q cgroup.subtree_control = %q, want io", p, got)
+		}
+	}
+}
+
+func TestFindCgroupMountPointHybrid(t *testing.T) {
+	restore := SetRoot(&Root{MountInfo: "../../mountinfo/testdata/cgroup_v1"})
+	defer restore()
+
+	tests := map[string]string{
+		subCPU:     "/sys/fs/cgroup/cpu,cpuacct",
+		subCPUAcct: "/sys/fs/cgroup/cpu,cpuacct",
+		subMem:     "/sys/fs/cgroup/memory",
+		subFreezer: "/sys/fs/cgroup/freezer",
+		"devices":  "",
+	}
+	for subsystem, want := range tests {
+		if got := FindCgroupMountPoint(subsystem); got != want {
+			t.Fatalf("FindCgroupMountPoint(%q) = %q, want %q", subsystem, got, want)
+		}
+	}
+}
+
+func TestProcessCgroupPath(t *testing.T) {
+	f := newFakeRoot(t, false)
+	f.SetProcCgroup(t, 1234, "12:pids:/user.slice/user-0.slice\n"+
+		"4:cpu,cpuacct:/user.slice\n"+
+		"1:name=systemd:/user.slice/session-1.scope\n"+
+		"0::/user.slice/session-1.scope\n")
+
+	tests := map[string]string{
+		subPids:    "/user.slice/user-0.slice",
+		subCPU:     "/user.slice",
+		subCPUAcct: "/user.slice",
+	}
+	for subsystem, want := range tests {
+		if got, err := ProcessCgroupPath(subsystem, 1234); err != nil || got != want {
+			t.Fatalf("ProcessCgroupPath(%s) = %q, %v, want %q", subsystem, got, err, want)
+		}
+	}
+	if _, err := ProcessCgroupPath(subMem, 1234); err == nil {
+		t.Fatal("ProcessCgroupPath should fail when the subsystem is not found")
+	}
+	if _, err := ProcessCgroupPath(subMem, 5678); err == nil {
+		t.Fatal("ProcessCgroupPath should fail when the process does not exist")
+	}
+
+	// v2 中只看 0:: 开头的一行
+	f = newFakeRoot(t, true)
+	f.SetProcCgroup(t, 1234, "0::/fakedocker/test\n")
+	if got, err := ProcessCgroupPath(subMem, 1234); err != nil || got != "/fakedocker/test" {
+		t.Fatalf("ProcessCgroupPath = %q, %v, want /fakedocker/test", got, err)
+	}
+}
@@ -0,0 +1,398 @@
+package cgroup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// DefaultSystemdSlice systemd driver 默认将容器的 scope 放在该 slice 下
+const DefaultSystemdSlice = "system.slice"
+
+// systemdTimeout 等待 systemd job 完成的超时时间
+const systemdTimeout = 30 * time.Second
+
+// newSystemdConn 连接到系统总线上的 systemd，测试时可以替换为连接私有总线
+var newSystemdConn = func(ctx context.Context) (*systemdDbus.Conn, error) {
+	return systemdDbus.NewWithContext(ctx)
+}
+
+// SystemdScopePath 返回容器 scope 在 cgroup 中的相对路径，比如 system.slice/fakedocker-<id>.scope
+func SystemdScopePath(slice, id string) (string, error) {
+	slicePath, err := expandSlice(slice)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(slicePath, "fakedocker-"+id+".scope"), nil
+}
+
+// expandSlice 将 slice 名称转换为 cgroup 中的路径，systemd 使用 "-" 表示层级关系，
+// 比如 a-b.slice 对应的路径为 a.slice/a-b.slice
+func expandSlice(slice string) (string, error) {
+	const suffix = ".slice"
+	name := strings.TrimSuffix(slice, suffix)
+	if name == slice || name == "" || strings.Contains(name, "/") ||
+		strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") || strings.Contains(name, "--") {
+		return "", fmt.Errorf("invalid systemd slice %q, such as: fakedocker.slice", slice)
+	}
+	// -.slice 表示根 slice
+	if name == "-" {
+		return "", nil
+	}
+
+	var p, prefix string
+	for _, component := range strings.Split(name, "-") {
+		p = path.Join(p, prefix+component+suffix)
+		prefix += component + "-"
+	}
+	return p, nil
+}
+
+// SystemdManager 由 systemd 创建和管理容器的 cgroup，每个容器对应一个 transient scope unit，
+// memory、cpu、pids 和 io 的限制只通过 unit 的属性（MemoryMax、CPUWeight 等）设置，
+// 避免和 systemd 同时写入同一个文件，没有对应属性的 subsystem（参考 cgroupfsSubSys）
+// 依然直接写入 scope 对应的 cgroup 目录
+type SystemdManager struct {
+	// 读取统计信息、freezer 和 OOM 等操作与 cgroupfs 相同，直接复用
+	*CgroupManager
+}
+
+// NewSystemdManager path 必须是 <slice 路径>/<unit 名称> 的格式，参考 SystemdScopePath
+func NewSystemdManager(path string, resConf *subsystems.ResourceConfig) *SystemdManager {
+	return &SystemdManager{CgroupManager: NewCgroupManager(path, resConf)}
+}
+
+func (m *SystemdManager) unitName() string {
+	return path.Base(m.Path)
+}
+
+// slice 返回 scope 所在的 slice 名称，比如 a.slice/a-b.slice/xxx.scope 所在的 slice 为 a-b.slice
+func (m *SystemdManager) slice() string {
+	dir := path.Dir(m.Path)
+	if dir == "." {
+		return "-.slice"
+	}
+	return path.Base(dir)
+}
+
+// SetAll 修改 scope 的资源限制属性，scope 还未创建时（容器启动前）直接返回，
+// 属性会在 ApplyAll 创建 scope 时一并设置
+func (m *SystemdManager) SetAll() error {
+	if err := m.setUnitProperties(); err != nil {
+		if isNoSuchUnit(err) {
+			return nil
+		}
+		zlog.New().Error("set systemd unit properties error", zap.String("unit", m.unitName()), zap.Error(err))
+		return err
+	}
+	return m.CgroupManager.set(cgroupfsSubSys())
+}
+
+// ApplyAll 创建 transient scope unit，并将进程 pid 加入其中
+func (m *SystemdManager) ApplyAll(pid int64) error {
+	if err := m.startUnit(pid); err != nil {
+		zlog.New().Error("start systemd unit error", zap.String("unit", m.unitName()), zap.Error(err))
+		return err
+	}
+	// systemd 只会在它管理的 subsystem 中创建 scope（比如 v1 中的 freezer、cpuset 就不会），
+	// 所以这里再通过 cgroupfs 补充创建并设置这些 subsystem，失败时停止刚刚创建的 scope
+	err := m.CgroupManager.set(cgroupfsSubSys())
+	if err == nil {
+		err = m.CgroupManager.ApplyAll(pid)
+	}
+	if err != nil {
+		if serr := m.stopUnit(); serr != nil && !isNoSuchUnit(serr) {
+			err = multierr.Append(err, fmt.Errorf("stop systemd unit %s error: %v", m.unitName(), serr))
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveAll 停止 scope unit，并删除 systemd 没有管理的 cgroup 目录，
+// 停止 scope 失败时仍然继续删除 cgroup 目录
+func (m *SystemdManager) RemoveAll() (err error) {
+	if serr := m.stopUnit(); serr != nil && !isNoSuchUnit(serr) {
+		zlog.New().Error("stop systemd unit error", zap.String("unit", m.unitName()), zap.Error(serr))
+		err = fmt.Errorf("stop systemd unit %s error: %v", m.unitName(), serr)
+	}
+	return multierr.Append(err, m.CgroupManager.RemoveAll())
+}
+
+// cgroupfsSubSys 返回 systemd 没有对应的 unit 属性、需要直接写入 cgroupfs 的 subsystem：
+// v1 中 systemd 不会在 cpuset 和 freezer 中创建 scope，AllowedCPUs 也只在 v2 中生效；
+// devices 在 v1 中通过 devices.allow/deny 设置，在 v2 中需要挂载 eBPF 程序，都不经过 systemd
+func cgroupfsSubSys() []subsystems.Interface {
+	devices := &subsystems.DevicesSubSystem{}
+	if subsystems.IsCgroup2UnifiedMode() {
+		return []subsystems.Interface{devices}
+	}
+	return []subsystems.Interface{&subsystems.CpusetSubSystem{}, freezerSubSys, devices}
+}
+
+func (m *SystemdManager) startUnit(pid int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), systemdTimeout)
+	defer cancel()
+
+	conn, err := newSystemdConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to systemd error: %v", err)
+	}
+	defer conn.Close()
+
+	ioAccounting := "BlockIOAccounting"
+	if subsystems.IsCgroup2UnifiedMode() {
+		ioAccounting = "IOAccounting"
+	}
+	props := []systemdDbus.Property{
+		systemdDbus.PropDescription("fakedocker container " + strings.TrimSuffix(m.unitName(), ".scope")),
+		systemdDbus.PropSlice(m.slice()),
+		systemdDbus.PropPids(uint32(pid)),
+		newProp("Delegate", true),
+		newProp("DefaultDependencies", false),
+		newProp("MemoryAccounting", true),
+		newProp("CPUAccounting", true),
+		newProp("TasksAccounting", true),
+		newProp(ioAccounting, true),
+	}
+	resProps, err := resourceProperties(m.ResourceConfig)
+	if err != nil {
+		return err
+	}
+	props = append(props, resProps...)
+
+	ch := make(chan string, 1)
+	if _, err := conn.StartTransientUnitContext(ctx, m.unitName(), "replace", props, ch); err != nil {
+		return err
+	}
+	return waitJob(ctx, ch)
+}
+
+func (m *SystemdManager) stopUnit() error {
+	ctx, cancel := context.WithTimeout(context.Background(), systemdTimeout)
+	defer cancel()
+
+	conn, err := newSystemdConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to systemd error: %v", err)
+	}
+	defer conn.Close()
+
+	ch := make(chan string, 1)
+	if _, err := conn.StopUnitContext(ctx, m.unitName(), "replace", ch); err != nil {
+		return err
+	}
+	return waitJob(ctx, ch)
+}
+
+func (m *SystemdManager) setUnitProperties() error {
+	props, err := resourceProperties(m.ResourceConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), systemdTimeout)
+	defer cancel()
+
+	conn, err := newSystemdConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to systemd error: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.SetUnitPropertiesContext(ctx, m.unitName(), true, props...)
+}
+
+// waitJob 等待 systemd job 执行完成，result 为 done 表示成功
+func waitJob(ctx context.Context, ch <-chan string) error {
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("systemd job failed, result: %s", result)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait systemd job timeout: %v", ctx.Err())
+	}
+}
+
+// ioDeviceLimit 对应 IOReadBandwidthMax 等属性中的一项，D-Bus 类型为 (st)
+type ioDeviceLimit struct {
+	Path  string
+	Limit uint64
+}
+
+// resourceProperties 将 ResourceConfig 转换为 systemd unit 的资源限制属性，
+// v1 中 systemd 没有对应属性的限制会返回错误，而不是绕过 systemd 直接写 cgroupfs
+func resourceProperties(r *subsystems.ResourceConfig) ([]systemdDbus.Property, error) {
+	v2 := subsystems.IsCgroup2UnifiedMode()
+	var props []systemdDbus.Property
+
+	if !v2 {
+		unsupported := []struct {
+			set  bool
+			flag string
+		}{
+			{r.MemorySwap != 0, "memory-swap"},
+			{r.MemoryReservation != 0, "memory-reservation"},
+			{r.KernelMemory != 0, "kernel-memory"},
+			{r.OOMKillDisable, "oom-kill-disable"},
+			{len(r.DeviceReadIOps) != 0, "device-read-iops"},
+			{len(r.DeviceWriteIOps) != 0, "device-write-iops"},
+		}
+		for _, u := range unsupported {
+			if u.set {
+				return nil, fmt.Errorf("--%s is not supported by the systemd cgroup driver on cgroup v1", u.flag)
+			}
+		}
+	}
+
+	if r.MemoryLimit != 0 {
+		if v2 {
+			props = append(props, newProp("MemoryMax", uint64(r.MemoryLimit)))
+		} else {
+			props = append(props, newProp("MemoryLimit", uint64(r.MemoryLimit)))
+		}
+	}
+	if v2 && r.MemoryReservation != 0 {
+		props = append(props, newProp("MemoryLow", uint64(r.MemoryReservation)))
+	}
+	if v2 && r.MemorySwap != 0 {
+		swap := uint64(math.MaxUint64)
+		if r.MemorySwap != -1 {
+			swap = uint64(r.MemorySwap - r.MemoryLimit)
+		}
+		props = append(props, newProp("MemorySwapMax", swap))
+	}
+
+	if r.CPUShare != "" {
+		shares, err := strconv.ParseUint(r.CPUShare, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu shares %q", r.CPUShare)
+		}
+		if v2 {
+			props = append(props, newProp("CPUWeight", subsystems.ConvertCPUSharesToWeight(shares)))
+		} else {
+			props = append(props, newProp("CPUShares", shares))
+		}
+	}
+	if r.CPUQuota != "" {
+		// systemd 使用每秒可以使用的 CPU 时间表示带宽限制
+		quota := uint64(math.MaxUint64)
+		if r.CPUQuota != "-1" {
+			q, _ := strconv.ParseUint(r.CPUQuota, 10, 64)
+			period := uint64(100000)
+			if r.CPUPeriod != "" {
+				period, _ = strconv.ParseUint(r.CPUPeriod, 10, 64)
+			}
+			quota = q * 1000000 / period
+		}
+		props = append(props, newProp("CPUQuotaPerSecUSec", quota))
+	}
+	if v2 && r.CPUSet != "" {
+		bits, err := cpusetToBits(r.CPUSet)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, newProp("AllowedCPUs", bits))
+	}
+
+	if r.PidsLimit != 0 {
+		tasks := uint64(math.MaxUint64)
+		if r.PidsLimit > 0 {
+			tasks = uint64(r.PidsLimit)
+		}
+		props = append(props, newProp("TasksMax", tasks))
+	}
+
+	if r.BlkioWeight != "" {
+		w, err := strconv.ParseUint(r.BlkioWeight, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blkio weight %q", r.BlkioWeight)
+		}
+		if v2 {
+			props = append(props, newProp("IOWeight", subsystems.ConvertBlkioWeightToIOWeight(w)))
+		} else {
+			props = append(props, newProp("BlockIOWeight", w))
+		}
+	}
+
+	throttles := []struct {
+		limits []string
+		bps    bool
+		v1Name string
+		v2Name string
+	}{
+		{r.DeviceReadBps, true, "BlockIOReadBandwidth", "IOReadBandwidthMax"},
+		{r.DeviceWriteBps, true, "BlockIOWriteBandwidth", "IOWriteBandwidthMax"},
+		{r.DeviceReadIOps, false, "", "IOReadIOPSMax"},
+		{r.DeviceWriteIOps, false, "", "IOWriteIOPSMax"},
+	}
+	for _, t := range throttles {
+		if len(t.limits) == 0 {
+			continue
+		}
+		var limits []ioDeviceLimit
+		for _, d := range t.limits {
+			devicePath, rate, err := subsystems.SplitThrottleDevice(d, t.bps)
+			if err != nil {
+				return nil, err
+			}
+			limits = append(limits, ioDeviceLimit{Path: devicePath, Limit: rate})
+		}
+		name := t.v1Name
+		if v2 {
+			name = t.v2Name
+		}
+		props = append(props, newProp(name, limits))
+	}
+	return props, nil
+}
+
+// cpusetToBits 将 cpuset 格式（比如 0-3,5）转换为 systemd AllowedCPUs 需要的位图，
+// 第 n 个字节的第 m 位表示第 n*8+m 个 CPU
+func cpusetToBits(cpuset string) ([]byte, error) {
+	var bits []byte
+	for _, r := range strings.Split(cpuset, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset %q", cpuset)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpuset %q", cpuset)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			for len(bits) <= cpu/8 {
+				bits = append(bits, 0)
+			}
+			bits[cpu/8] |= 1 << uint(cpu%8)
+		}
+	}
+	return bits, nil
+}
+
+func newProp(name string, value interface{}) systemdDbus.Property {
+	return systemdDbus.Property{Name: name, Value: dbus.MakeVariant(value)}
+}
+
+func isNoSuchUnit(err error) bool {
+	if e, ok := err.(dbus.Error); ok {
+		return e.Name == "org.freedesktop.systemd1.NoSuchUnit"
+	}
+	return false
+}
@@ -0,0 +1,391 @@
+package cgroup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+)
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// fakeSystemd 在私有总线上模拟 systemd 的 org.freedesktop.systemd1.Manager 接口，
+// 记录收到的 unit 和属性
+type fakeSystemd struct {
+	conn  *dbus.Conn
+	mu    sync.Mutex
+	jobID uint32
+	units map[string]map[string]interface{}
+}
+
+func (f *fakeSystemd) finishJob(unit string) dbus.ObjectPath {
+	f.jobID++
+	job := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/systemd1/job/%d", f.jobID))
+	id := f.jobID
+	go f.conn.Emit("/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager.JobRemoved", id, job, unit, "done")
+	return job
+}
+
+func (f *fakeSystemd) StartTransientUnit(name, mode string, props []systemdDbus.Property, aux []systemdDbus.PropertyCollection) (dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.units[name] = map[string]interface{}{}
+	for _, p := range props {
+		f.units[name][p.Name] = p.Value.Value()
+	}
+	return f.finishJob(name), nil
+}
+
+func (f *fakeSystemd) SetUnitProperties(name string, runtime bool, props []systemdDbus.Property) *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unit, ok := f.units[name]
+	if !ok {
+		return &dbus.Error{Name: "org.freedesktop.systemd1.NoSuchUnit", Body: []interface{}{"unit " + name + " not loaded"}}
+	}
+	for _, p := range props {
+		unit[p.Name] = p.Value.Value()
+	}
+	return nil
+}
+
+func (f *fakeSystemd) StopUnit(name, mode string) (dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.units[name]; !ok {
+		return "", &dbus.Error{Name: "org.freedesktop.systemd1.NoSuchUnit", Body: []interface{}{"unit " + name + " not loaded"}}
+	}
+	delete(f.units, name)
+	return f.finishJob(name), nil
+}
+
+func (f *fakeSystemd) unit(name string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.units[name]
+}
+
+// startFakeSystemd 启动一个私有的 dbus-daemon，并在上面注册 fakeSystemd，
+// 同时将 newSystemdConn 替换为连接该总线
+func startFakeSystemd(t *testing.T) *fakeSystemd {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	dir, err := ioutil.TempDir("", "fakedocker-dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := filepath.Join(dir, "bus.conf")
+	if err := ioutil.WriteFile(config, []byte(fmt.Sprintf(busConfig, filepath.Join(dir, "bus"))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	address = strings.TrimSpace(address)
+
+	dial := func() (*dbus.Conn, error) {
+		conn, err := dbus.Dial(address)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Auth(nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.Hello(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fake := &fakeSystemd{conn: conn, units: map[string]map[string]interface{}{}}
+	if err := conn.Export(fake, "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager"); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := conn.RequestName("org.freedesktop.systemd1", dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("request name error: %v, reply: %v", err, reply)
+	}
+
+	old := newSystemdConn
+	newSystemdConn = func(ctx context.Context) (*systemdDbus.Conn, error) {
+		return systemdDbus.NewConnection(dial)
+	}
+	t.Cleanup(func() { newSystemdConn = old })
+	return fake
+}
+
+func TestSystemdManagerUnit(t *testing.T) {
+	fake := startFakeSystemd(t)
+	// AllowedCPUs 只在 v2 中设置
+	t.Cleanup(subsystems.SetRoot(&subsystems.Root{Unified: true}))
+
+	scopePath, err := SystemdScopePath(DefaultSystemdSlice, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewSystemdManager(scopePath, &subsystems.ResourceConfig{
+		MemoryLimit: 64 * subsystems.MiB,
+		CPUShare:    "1024",
+		CPUSet:      "0-1,3",
+		PidsLimit:   100,
+	})
+	unit := "fakedocker-test.scope"
+
+	// scope 还不存在时设置属性会返回 NoSuchUnit
+	if err := m.setUnitProperties(); !isNoSuchUnit(err) {
+		t.Fatalf("set properties before start should return NoSuchUnit, got: %v", err)
+	}
+
+	if err := m.startUnit(12345); err != nil {
+		t.Fatal(err)
+	}
+	props := fake.unit(unit)
+	if props == nil {
+		t.Fatalf("unit %s is not started", unit)
+	}
+	if props["Slice"] != DefaultSystemdSlice {
+		t.Fatalf("Slice = %v, want %s", props["Slice"], DefaultSystemdSlice)
+	}
+	if pids, ok := props["PIDs"].([]uint32); !ok || len(pids) != 1 || pids[0] != 12345 {
+		t.Fatalf("PIDs = %v, want [12345]", props["PIDs"])
+	}
+	if props["TasksMax"] != uint64(100) {
+		t.Fatalf("TasksMax = %v, want 100", props["TasksMax"])
+	}
+	if bits, ok := props["AllowedCPUs"].([]byte); !ok || len(bits) != 1 || bits[0] != 0x0b {
+		t.Fatalf("AllowedCPUs = %v, want [0x0b]", props["AllowedCPUs"])
+	}
+
+	m.ResourceConfig.PidsLimit = 200
+	if err := m.setUnitProperties(); err != nil {
+		t.Fatal(err)
+	}
+	if props := fake.unit(unit); props["TasksMax"] != uint64(200) {
+		t.Fatalf("TasksMax = %v after update, want 200", props["TasksMax"])
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- m.stopUnit() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stop unit timeout")
+	}
+	if fake.unit(unit) != nil {
+		t.Fatalf("unit %s is not stopped", unit)
+	}
+}
+
+func TestSystemdSetAllCgroupfs(t *testing.T) {
+	fake := startFakeSystemd(t)
+	f := setUpV1Root(t, "cpu", "cpuacct", "cpuset", "memory", "pids", "blkio", "freezer", "devices")
+
+	m := NewSystemdManager("system.slice/fakedocker-test.scope", &subsystems.ResourceConfig{
+		MemoryLimit: 64 * subsystems.MiB,
+		CPUSet:      "0",
+		PidsLimit:   100,
+	})
+	if err := m.startUnit(12345); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAll(); err != nil {
+		t.Fatal(err)
+	}
+	if props := fake.unit("fakedocker-test.scope"); props["MemoryLimit"] != uint64(64*subsystems.MiB) {
+		t.Fatalf("MemoryLimit = %v, want %d", props["MemoryLimit"], 64*subsystems.MiB)
+	}
+
+	// 有对应 unit 属性的 subsystem 由 systemd 负责，不能直接写入 cgroupfs
+	for _, subsystem := range []string{"cpuset", "freezer", "devices"} {
+		if !f.Exists(subsystem, "system.slice/fakedocker-test.scope") {
+			t.Fatalf("%s cgroup should be created through cgroupfs", subsystem)
+		}
+	}
+	for _, subsystem := range []string{"cpu", "cpuacct", "memory", "pids", "blkio"} {
+		if f.Exists(subsystem, "system.slice") {
+			t.Fatalf("%s cgroup should be left to systemd", subsystem)
+		}
+	}
+}
+
+func TestResourceProperties(t *testing.T) {
+	restore := subsystems.SetRoot(&subsystems.Root{})
+	defer restore()
+
+	// v1 中 systemd 没有对应属性的限制会被拒绝
+	for _, r := range []*subsystems.ResourceConfig{
+		{MemoryLimit: 64 * subsystems.MiB, MemorySwap: 128 * subsystems.MiB},
+		{MemoryReservation: 32 * subsystems.MiB},
+		{OOMKillDisable: true},
+		{DeviceReadIOps: []string{"/dev/sda:100"}},
+	} {
+		if _, err := resourceProperties(r); err == nil {
+			t.Fatalf("resourceProperties(%+v) should fail on cgroup v1", r)
+		}
+	}
+
+	r := &subsystems.ResourceConfig{
+		CPUSet:          "0-1",
+		DeviceReadBps:   []string{"/dev/sda:1mb"},
+		DeviceWriteBps:  []string{"/dev/sda:2mb", "/dev/sdb:512kb"},
+		DeviceWriteIOps: []string{"/dev/sda:100"},
+	}
+	if _, err := resourceProperties(r); err == nil {
+		t.Fatal("device iops limit should fail on cgroup v1")
+	}
+	r.DeviceWriteIOps = nil
+	props, err := resourceProperties(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	for _, p := range props {
+		got[p.Name] = p.Value.Value()
+	}
+	if _, ok := got["AllowedCPUs"]; ok {
+		t.Fatal("AllowedCPUs should not be set on cgroup v1")
+	}
+	want := []ioDeviceLimit{{"/dev/sda", 2 << 20}, {"/dev/sdb", 512 << 10}}
+	if limits, ok := got["BlockIOWriteBandwidth"].([]ioDeviceLimit); !ok || len(limits) != 2 || limits[0] != want[0] || limits[1] != want[1] {
+		t.Fatalf("BlockIOWriteBandwidth = %v, want %v", got["BlockIOWriteBandwidth"], want)
+	}
+
+	subsystems.SetRoot(&subsystems.Root{Unified: true})
+	r.DeviceWriteIOps = []string{"/dev/sda:100"}
+	props, err = resourceProperties(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = map[string]interface{}{}
+	for _, p := range props {
+		got[p.Name] = p.Value
+	}
+	for name, value := range map[string]ioDeviceLimit{
+		"IOReadBandwidthMax": {"/dev/sda", 1 << 20},
+		"IOWriteIOPSMax":     {"/dev/sda", 100},
+	} {
+		v, ok := got[name].(dbus.Variant)
+		if !ok {
+			t.Fatalf("%s is not set", name)
+		}
+		if v.Signature().String() != "a(st)" {
+			t.Fatalf("%s signature = %s, want a(st)", name, v.Signature())
+		}
+		if limits := v.Value().([]ioDeviceLimit); len(limits) != 1 || limits[0] != value {
+			t.Fatalf("%s = %v, want %v", name, limits, value)
+		}
+	}
+	if _, ok := got["AllowedCPUs"]; !ok {
+		t.Fatal("AllowedCPUs should be set on cgroup v2")
+	}
+}
+
+func TestContainerCgroupPath(t *testing.T) {
+	tests := []struct {
+		driver, parent, want string
+	}{
+		{DriverCgroupfs, "", "fakedocker/abc"},
+		{DriverCgroupfs, "/ci/", "ci/abc"},
+		{DriverCgroupfs, "ci/build", "ci/build/abc"},
+		{DriverSystemd, "", "system.slice/fakedocker-abc.scope"},
+		{DriverSystemd, "fakedocker.slice", "fakedocker.slice/fakedocker-abc.scope"},
+		{DriverSystemd, "fakedocker-ci.slice", "fakedocker.slice/fakedocker-ci.slice/fakedocker-abc.scope"},
+	}
+	for _, tt := range tests {
+		got, err := ContainerCgroupPath(tt.driver, tt.parent, "abc")
+		if err != nil {
+			t.Fatalf("ContainerCgroupPath(%q, %q) error: %v", tt.driver, tt.parent, err)
+		}
+		if got != tt.want {
+			t.Fatalf("ContainerCgroupPath(%q, %q) = %q, want %q", tt.driver, tt.parent, got, tt.want)
+		}
+	}
+
+	for _, parent := range []string{"../escape", "fakedocker", "a--b.slice", "a/b.slice"} {
+		driver := DriverSystemd
+		if parent == "../escape" {
+			driver = DriverCgroupfs
+		}
+		if _, err := ContainerCgroupPath(driver, parent, "abc"); err == nil {
+			t.Fatalf("ContainerCgroupPath(%q, %q) should fail", driver, parent)
+		}
+	}
+}
+
+func TestCpusetToBits(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []byte
+	}{
+		{"0", []byte{0x01}},
+		{"0-3", []byte{0x0f}},
+		{"1,8", []byte{0x02, 0x01}},
+		{"0-1, 10-11", []byte{0x03, 0x0c}},
+	}
+	for _, tt := range tests {
+		got, err := cpusetToBits(tt.in)
+		if err != nil {
+			t.Fatalf("cpusetToBits(%q) error: %v", tt.in, err)
+		}
+		if string(got) != string(tt.want) {
+			t.Fatalf("cpusetToBits(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"", "a", "3-1"} {
+		if _, err := cpusetToBits(in); err == nil {
+			t.Fatalf("cpusetToBits(%q) should fail", in)
+		}
+	}
+}
@@ -1,40 +1,192 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
 	"github.com/YOUSEEBIGGIRL/fakedocke/container"
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
 	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
 )
 
+// resourceFlags 是 run 和 update 共用的资源限制参数
+var resourceFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "mem",
+		Usage: "memory limit, such as: 512m",
+	},
+	&cli.StringFlag{
+		Name:  "memory-swap",
+		Usage: "total memory limit (memory + swap), -1 means unlimited swap",
+	},
+	&cli.StringFlag{
+		Name:  "memory-reservation",
+		Usage: "memory soft limit",
+	},
+	&cli.StringFlag{
+		Name:  "kernel-memory",
+		Usage: "kernel memory limit",
+	},
+	&cli.BoolFlag{
+		Name:  "oom-kill-disable",
+		Usage: "disable oom killer",
+	},
+	&cli.StringFlag{
+		Name:  "cpushare",
+		Usage: "CPU shares (relative weight)",
+	},
+	&cli.StringFlag{
+		Name:  "cpu-period",
+		Usage: "limit CPU CFS (Completely Fair Scheduler) period, in microseconds",
+	},
+	&cli.StringFlag{
+		Name:  "cpu-quota",
+		Usage: "limit CPU CFS (Completely Fair Scheduler) quota, in microseconds, -1 means unlimited",
+	},
+	&cli.StringFlag{
+		Name:  "cpuset",
+		Usage: "CPUs in which to allow execution, such as: 0-3 or 0,1",
+	},
+	&cli.Int64Flag{
+		Name:  "pids-limit",
+		Usage: "tune container pids limit, -1 means unlimited",
+	},
+	&cli.StringFlag{
+		Name:  "blkio-weight",
+		Usage: "block IO weight, between 10 and 1000",
+	},
+	&cli.StringSliceFlag{
+		Name:  "device-read-bps",
+		Usage: "limit read rate (bytes per second) from a device, such as: /dev/sda:1mb",
+	},
+	&cli.StringSliceFlag{
+		Name:  "device-write-bps",
+		Usage: "limit write rate (bytes per second) to a device, such as: /dev/sda:1mb",
+	},
+	&cli.StringSliceFlag{
+		Name:  "device-read-iops",
+		Usage: "limit read rate (IO per second) from a device, such as: /dev/sda:1000",
+	},
+	&cli.StringSliceFlag{
+		Name:  "device-write-iops",
+		Usage: "limit write rate (IO per second) to a device, such as: /dev/sda:1000",
+	},
+}
+
 var run = &cli.Command{
 	Name: "run",
 	Usage: `Create a container with namespace and cgroups limit
 			fakedocker run -it [process name], such as: fakedocker run -it /bin/bash`,
-	Flags: []cli.Flag{
+	// 允许将 -i -t 合并写成 -it
+	UseShortOptionHandling: true,
+	Flags: append([]cli.Flag{
 		&cli.BoolFlag{
-			Name:  "it", // 该命令会分配一个伪终端，将本机的 stdio 与容器的 stdio 相关联
-			Usage: "enable tty",
+			Name:    "interactive", // 将本机的标准输入传递给容器
+			Aliases: []string{"i"},
+			Usage:   "keep STDIN open and attach it to the container",
+		},
+		&cli.BoolFlag{
+			Name:    "tty", // 在容器中分配一个伪终端作为容器进程的控制终端
+			Aliases: []string{"t"},
+			Usage:   "allocate a pseudo-TTY",
+		},
+		&cli.StringFlag{
+			Name:  "detach-keys",
+			Value: container.DefaultDetachKeys,
+			Usage: "key sequence for detaching a container, such as: ctrl-a,d",
 		},
 		&cli.StringFlag{
-			Name:  "mem",
-			Usage: "memory limit",
+			Name:  "cgroup-parent",
+			Usage: "optional parent cgroup for the container, a slice such as fakedocker.slice when using systemd driver",
+		},
+		&cli.IntFlag{
+			Name:  "oom-score-adj",
+			Usage: "tune host's oom preferences (-1000 to 1000)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device",
+			Usage: "add a host device to the container, such as: /dev/sda:/dev/xvda:rwm",
 		},
 		&cli.StringFlag{
-			Name:  "cpushare",
-			Usage: "cpushare limit",
+			Name:  "shm-size",
+			Usage: "size of /dev/shm, such as: 128m, default is 64m",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device-cgroup-rule",
+			Usage: "add a rule to the cgroup allowed devices list, such as: 'c 1:3 rwm'",
+		},
+		&cli.BoolFlag{
+			Name:  "privileged",
+			Usage: "give extended privileges to the container: all devices, writable /sys and no masked paths",
+		},
+		&cli.StringSliceFlag{
+			Name:  "security-opt",
+			Usage: "security options: systempaths=unconfined, mask=<path>, unmask=<path>, readonly=<path>",
 		},
 		&cli.StringFlag{
-			Name:  "cpuset",
-			Usage: "cpuset limit",
+			Name:  "network",
+			Value: network.DefaultNetworkName,
+			Usage: "connect the container to a network, or use network mode host, none or container:<id>",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "assign a name to the container, other containers on the same user-defined network can reach it by the name",
+		},
+		&cli.StringSliceFlag{
+			Name:  "network-alias",
+			Usage: "add a network-scoped alias for the container, only for user-defined networks",
+		},
+		&cli.StringFlag{
+			Name:  "hostname",
+			Usage: "container host name, default is the short container ID",
+		},
+		&cli.StringFlag{
+			Name:  "domainname",
+			Usage: "container NIS domain name",
+		},
+		&cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "add a custom host-to-IP mapping to /etc/hosts, such as: db:10.0.0.2",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "set custom DNS servers",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "set custom DNS search domains, '.' means no search domain",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-option",
+			Usage: "set DNS options, such as: ndots:2",
+		},
+		&cli.StringSliceFlag{
+			Name:    "publish",
+			Aliases: []string{"p"},
+			Usage:   "publish a container's port to the host, such as: 8080:80, 127.0.0.1:8080:80/udp or 80",
+		},
+		&cli.BoolFlag{
+			Name:    "publish-all",
+			Aliases: []string{"P"},
+			Usage:   "publish all exposed ports to random host ports",
+		},
+		&cli.StringSliceFlag{
+			Name:  "expose",
+			Usage: "expose a port of the container, such as: 80/tcp, published to a random host port with -P",
 		},
 		//&cli.StringFlag{
 		//	Name:  "v",
 		//	Usage: "volume",
 		//},
-	},
+	}, resourceFlags...),
 	Action: func(c *cli.Context) error {
 		// 判断参数是否包含 command
 		if c.Args().Len() < 1 {
@@ -49,16 +201,161 @@ var run = &cli.Command{
 			cmds = append(cmds, v)
 		}
 
-		tty := c.Bool("it")
-		resConf := &subsystems.ResourceConfig{
-			MemoryLimit: c.String("mem"),
-			CPUShare:    c.String("cpushare"),
-			CPUSet:      c.String("cpuset"),
+		tty, interactive := c.Bool("tty"), c.Bool("interactive")
+		detachKeys, err := container.ParseDetachKeys(c.String("detach-keys"))
+		if err != nil {
+			return err
+		}
+		resConf, err := parseResourceConfig(c, &subsystems.ResourceConfig{})
+		if err != nil {
+			return err
+		}
+		oomScoreAdj := c.Int("oom-score-adj")
+		if oomScoreAdj < -1000 || oomScoreAdj > 1000 {
+			return fmt.Errorf("invalid --oom-score-adj %d, range is -1000 to 1000", oomScoreAdj)
+		}
+		devices, err := parseDevices(c, resConf)
+		if err != nil {
+			return err
+		}
+		security, err := container.ParseSecurityOpts(c.StringSlice("security-opt"), c.Bool("privileged"))
+		if err != nil {
+			return err
+		}
+		if security.Privileged {
+			resConf.DeviceRules = append(resConf.DeviceRules, "a *:* rwm")
+		}
+		ports, err := parsePorts(c)
+		if err != nil {
+			return err
+		}
+		networkMode := c.String("network")
+		if len(ports) > 0 && !network.IsBridgeMode(networkMode) {
+			// 与 docker 相同，host 模式下容器直接监听宿主机的端口，映射没有意义
+			if networkMode != network.ModeHost {
+				return fmt.Errorf("conflicting options: port publishing and network mode %s", networkMode)
+			}
+			fmt.Fprintln(os.Stderr, "WARNING: published ports are discarded when using host network mode")
+			ports = nil
+		}
+		aliases := c.StringSlice("network-alias")
+		if len(aliases) > 0 && (!network.IsBridgeMode(networkMode) || networkMode == network.DefaultNetworkName) {
+			return fmt.Errorf("network-scoped aliases are only supported for user-defined networks")
+		}
+		extraHosts := c.StringSlice("add-host")
+		for _, h := range extraHosts {
+			if _, _, err := container.ParseExtraHost(h); err != nil {
+				return err
+			}
+		}
+		dns, err := container.ParseDNSConfig(c.StringSlice("dns"), c.StringSlice("dns-search"), c.StringSlice("dns-option"))
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"hostname", "domainname"} {
+			if c.IsSet(name) {
+				if err := container.ValidateHostname(c.String(name)); err != nil {
+					return err
+				}
+			}
+		}
+		// container 模式与目标容器共用主机名、/etc/hosts 和 /etc/resolv.conf
+		if strings.HasPrefix(networkMode, network.ModeContainerPrefix) {
+			for _, name := range []string{"hostname", "domainname", "add-host", "dns", "dns-search", "dns-option"} {
+				if c.IsSet(name) {
+					return fmt.Errorf("conflicting options: --%s and network mode %s", name, networkMode)
+				}
+			}
+		}
+		var shmSize int64
+		if c.IsSet("shm-size") {
+			if shmSize, err = subsystems.ParseSize(c.String("shm-size")); err != nil || shmSize <= 0 {
+				return fmt.Errorf("invalid --shm-size %q", c.String("shm-size"))
+			}
 		}
 		volume := c.String("v")
 		// 调用 RunProcess 启动容器进程
-		container.RunProcess(tty, cmds, volume, resConf)
-		return nil
+		// 没有指定 --cgroup-parent 时使用全局的默认值
+		cgroupParent := c.String("cgroup-parent")
+		if cgroupParent == "" {
+			cgroupParent = c.String("default-cgroup-parent")
+		}
+		return container.RunProcess(&container.RunOptions{
+			TTY:          tty,
+			Interactive:  interactive,
+			Cmds:         cmds,
+			Volume:       volume,
+			Resources:    resConf,
+			OOMScoreAdj:  oomScoreAdj,
+			CgroupDriver: c.String("cgroup-driver"),
+			CgroupParent: cgroupParent,
+			Devices:      devices,
+			ShmSize:      shmSize,
+			Security:     security,
+			DetachKeys:   detachKeys,
+			Ports:        ports,
+			Network:      networkMode,
+			Aliases:      aliases,
+			Name:         c.String("name"),
+			Hostname:     c.String("hostname"),
+			Domainname:   c.String("domainname"),
+			ExtraHosts:   extraHosts,
+			DNS:          dns,
+		})
+	},
+}
+
+var supervise = &cli.Command{
+	Name: "supervise",
+	Usage: `supervise a container started with a tty, keep it running after detach.
+				Do not call it outside`,
+	Action: func(c *cli.Context) error {
+		return container.Supervise()
+	},
+}
+
+var attach = &cli.Command{
+	Name:      "attach",
+	Usage:     "Attach local standard input and output to a running container started with -t",
+	ArgsUsage: "CONTAINER",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "detach-keys",
+			Value: container.DefaultDetachKeys,
+			Usage: "key sequence for detaching a container, such as: ctrl-a,d",
+		},
+		&cli.BoolFlag{
+			Name:  "no-stdin",
+			Usage: "do not attach STDIN",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		info, err := container.ReadContainerInfo(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		if info.Status == container.Exited {
+			return fmt.Errorf("container %s is not running", info.ShortID())
+		}
+		if !info.TTY {
+			return fmt.Errorf("container %s was not started with -t, can not attach to it", info.ShortID())
+		}
+		detachKeys, err := container.ParseDetachKeys(c.String("detach-keys"))
+		if err != nil {
+			return err
+		}
+		err = container.Attach(info.ID, info.Interactive && !c.Bool("no-stdin"), detachKeys)
+		if err == container.ErrDetached {
+			fmt.Fprintf(os.Stderr, "\r\ndetached from container %s\r\n", info.ShortID())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return container.ContainerExitError(info.ID)
 	},
 }
 
@@ -71,3 +368,657 @@ var init_ = &cli.Command{
 		return container.InitProcess()
 	},
 }
+
+var inspect = &cli.Command{
+	Name:      "inspect",
+	Usage:     "Display detailed information of a container",
+	ArgsUsage: "CONTAINER",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		info, err := container.ReadContainerInfo(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(info, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var rm = &cli.Command{
+	Name:      "rm",
+	Usage:     "Remove an exited container",
+	ArgsUsage: "CONTAINER",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		info, err := container.ReadContainerInfo(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		if info.Status != container.Exited {
+			return fmt.Errorf("container %s is %s, stop it first", info.ShortID(), info.Status)
+		}
+		// 容器退出时已经删除了端口映射规则，这里再删除一次，防止 supervise 进程异常退出时留下规则
+		if err := container.UnpublishPorts(info); err != nil {
+			zlog.New().Warn("unpublish container ports error", zap.String("id", info.ShortID()), zap.Error(err))
+		}
+		return container.DeleteContainerInfo(info.ID)
+	},
+}
+
+var ps = &cli.Command{
+	Name:  "ps",
+	Usage: "List containers",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "all",
+			Aliases: []string{"a"},
+			Usage:   "show all containers, default shows just running and paused",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		infos, err := container.ListContainerInfos()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprintln(w, "CONTAINER ID\tCOMMAND\tCREATED\tSTATUS\tPORTS\tNAMES")
+		for _, info := range infos {
+			if info.Status == container.Exited && !c.Bool("all") {
+				continue
+			}
+			status := info.Status
+			if info.Status == container.Exited {
+				status = fmt.Sprintf("%s (%d)", info.Status, info.ExitCode)
+			}
+			var ports []string
+			if info.Status != container.Exited {
+				for _, p := range info.Ports {
+					ports = append(ports, p.String())
+				}
+			}
+			fmt.Fprintf(
+				w, "%s\t%q\t%s\t%s\t%s\t%s\n",
+				info.ShortID(), strings.Join(info.Command, " "), info.CreatedTime, status, strings.Join(ports, ", "), info.Name,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var port = &cli.Command{
+	Name:      "port",
+	Usage:     "List port mappings of a container, or look up the public-facing port of PRIVATE_PORT",
+	ArgsUsage: "CONTAINER [PRIVATE_PORT[/PROTO]]",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		info, err := container.ReadContainerInfo(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		if info.Status == container.Exited {
+			return fmt.Errorf("container %s is not running", info.ShortID())
+		}
+
+		var filter *network.PortMapping
+		if c.Args().Len() > 1 {
+			if filter, err = network.ParseExposedPort(c.Args().Get(1)); err != nil {
+				return err
+			}
+		}
+		found := false
+		for _, p := range info.Ports {
+			if filter != nil && (p.ContainerPort != filter.ContainerPort || p.Protocol != filter.Protocol) {
+				continue
+			}
+			found = true
+			if filter != nil {
+				fmt.Println(p.HostAddress())
+				continue
+			}
+			fmt.Printf("%d/%s -> %s\n", p.ContainerPort, p.Protocol, p.HostAddress())
+		}
+		if filter != nil && !found {
+			return fmt.Errorf("no public port '%d/%s' published for %s", filter.ContainerPort, filter.Protocol, info.ShortID())
+		}
+		return nil
+	},
+}
+
+var networkCommand = &cli.Command{
+	Name:  "network",
+	Usage: "Manage networks",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Create a network",
+			ArgsUsage: "NETWORK",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "driver",
+					Aliases: []string{"d"},
+					Value:   network.DriverBridge,
+					Usage:   "driver to manage the network, only bridge is supported",
+				},
+				&cli.StringSliceFlag{
+					Name:  "subnet",
+					Usage: "subnet in CIDR format, such as: 10.10.0.0/24, allocated from the default pool if not set; set twice with an IPv6 subnet for dual-stack",
+				},
+				&cli.StringSliceFlag{
+					Name:  "gateway",
+					Usage: "gateway for the subnet of the same family, default is the first address of the subnet",
+				},
+				&cli.BoolFlag{
+					Name:  "ipv6",
+					Usage: "enable IPv6, a random ULA /64 subnet is used if no IPv6 subnet is set",
+				},
+				&cli.StringFlag{
+					Name:  "ipv6-mode",
+					Value: network.IPv6ModeNAT,
+					Usage: "how IPv6 traffic leaves the host: nat or routed (no NAT, the upstream router must route the subnet to this host)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				subnet, subnet6, err := splitAddressFamily("--subnet", c.StringSlice("subnet"), func(s string) (net.IP, error) {
+					ip, _, err := net.ParseCIDR(s)
+					return ip, err
+				})
+				if err != nil {
+					return err
+				}
+				gateway, gateway6, err := splitAddressFamily("--gateway", c.StringSlice("gateway"), func(s string) (net.IP, error) {
+					if ip := net.ParseIP(s); ip != nil {
+						return ip, nil
+					}
+					return nil, fmt.Errorf("invalid IP address %q", s)
+				})
+				if err != nil {
+					return err
+				}
+				var ipv6 *network.IPv6Config
+				if c.Bool("ipv6") {
+					ipv6 = &network.IPv6Config{Subnet: subnet6, Gateway: gateway6, Mode: c.String("ipv6-mode")}
+				} else if subnet6 != "" || gateway6 != "" || c.IsSet("ipv6-mode") {
+					return fmt.Errorf("IPv6 subnet, gateway and mode require --ipv6")
+				}
+				n, err := network.CreateNetwork(c.Args().Get(0), c.String("driver"), subnet, gateway, ipv6)
+				if err != nil {
+					return err
+				}
+				fmt.Println(n.ID)
+				return nil
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "List networks",
+			Action: func(c *cli.Context) error {
+				networks, err := network.ListNetworks()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+				fmt.Fprintln(w, "NETWORK ID\tNAME\tDRIVER\tSUBNET\tGATEWAY")
+				for _, n := range networks {
+					subnet, gateway := n.Subnet, n.Gateway
+					if n.IPv6 != nil {
+						subnet += ", " + n.IPv6.Subnet
+						gateway += ", " + n.IPv6.Gateway
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", n.ID[:12], n.Name, n.Driver, subnet, gateway)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "Display detailed information of a network and the containers connected to it",
+			ArgsUsage: "NETWORK",
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				n, err := network.LoadNetwork(c.Args().Get(0))
+				if err != nil {
+					return err
+				}
+				infos, err := container.ListContainerInfos()
+				if err != nil {
+					return err
+				}
+				result := struct {
+					*network.Network
+					Containers map[string]*network.Endpoint `json:"containers"`
+				}{n, make(map[string]*network.Endpoint)}
+				for _, info := range infos {
+					if ep := info.Endpoint(n.Name); ep != nil && info.Status != container.Exited {
+						result.Containers[info.ID] = ep
+					}
+				}
+				b, err := json.MarshalIndent(result, "", "    ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(b))
+				return nil
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "Remove networks without running containers",
+			ArgsUsage: "NETWORK [NETWORK...]",
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				for _, name := range c.Args().Slice() {
+					if err := network.RemoveNetwork(name, container.NetworkInUse); err != nil {
+						return err
+					}
+					fmt.Println(name)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "connect",
+			Usage:     "Connect a running container to a network",
+			ArgsUsage: "NETWORK CONTAINER",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "alias",
+					Usage: "add a network-scoped alias for the container",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() < 2 {
+					return fmt.Errorf("missing network name or container id")
+				}
+				return container.ConnectNetwork(c.Args().Get(1), c.Args().Get(0), c.StringSlice("alias"))
+			},
+		},
+		{
+			Name:      "disconnect",
+			Usage:     "Disconnect a running container from a network",
+			ArgsUsage: "NETWORK CONTAINER",
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() < 2 {
+					return fmt.Errorf("missing network name or container id")
+				}
+				return container.DisconnectNetwork(c.Args().Get(1), c.Args().Get(0))
+			},
+		},
+	},
+}
+
+// splitAddressFamily 将 flag 的值按照地址族分开，每个地址族最多只能指定一个，parse 解析出值中的地址
+func splitAddressFamily(flag string, values []string, parse func(s string) (net.IP, error)) (v4, v6 string, err error) {
+	for _, v := range values {
+		ip, err := parse(v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid %s %q: %v", flag, v, err)
+		}
+		p := &v4
+		if ip.To4() == nil {
+			p = &v6
+		}
+		if *p != "" {
+			return "", "", fmt.Errorf("%s can only be set once for each address family", flag)
+		}
+		*p = v
+	}
+	return v4, v6, nil
+}
+
+var update = &cli.Command{
+	Name:      "update",
+	Usage:     "Update resource limits of running or paused containers without restarting them",
+	ArgsUsage: "CONTAINER [CONTAINER...]",
+	Flags:     resourceFlags,
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		for _, id := range c.Args().Slice() {
+			info, err := container.UpdateResources(id, func(base *subsystems.ResourceConfig) (*subsystems.ResourceConfig, error) {
+				return parseResourceConfig(c, base)
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Println(info.ShortID())
+		}
+		return nil
+	},
+}
+
+var pause = &cli.Command{
+	Name:      "pause",
+	Usage:     "Pause all processes within one or more containers",
+	ArgsUsage: "CONTAINER [CONTAINER...]",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		for _, id := range c.Args().Slice() {
+			info, err := container.Pause(id)
+			if err != nil {
+				return err
+			}
+			fmt.Println(info.ShortID())
+		}
+		return nil
+	},
+}
+
+var unpause = &cli.Command{
+	Name:      "unpause",
+	Usage:     "Unpause all processes within one or more containers",
+	ArgsUsage: "CONTAINER [CONTAINER...]",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		for _, id := range c.Args().Slice() {
+			info, err := container.Unpause(id)
+			if err != nil {
+				return err
+			}
+			fmt.Println(info.ShortID())
+		}
+		return nil
+	},
+}
+
+var stats = &cli.Command{
+	Name:      "stats",
+	Usage:     "Display a live stream of container(s) resource usage statistics",
+	ArgsUsage: "[CONTAINER...]",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "no-stream",
+			Usage: "disable streaming stats and only pull the first result",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, only json is supported, default is table",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		format := c.String("format")
+		if format != "" && format != "json" {
+			return fmt.Errorf("unsupported format %q", format)
+		}
+
+		// 指定了容器时只在开始时检查它们是否在运行，之后退出的容器会被标记为 exited 并继续统计其他容器
+		ids := c.Args().Slice()
+		targets, err := statsTargets(ids)
+		if err != nil {
+			return err
+		}
+
+		// 计算 CPU 使用率需要两次采样，每个周期用上一次的采样结果作为基准
+		prev := map[string]*container.ContainerStats{}
+		for first := true; ; first = false {
+			// 没有指定容器时每个周期都重新获取运行中的容器
+			if len(ids) == 0 && !first {
+				if targets, err = statsTargets(nil); err != nil {
+					return err
+				}
+			}
+
+			var all []*container.ContainerStats
+			current := map[string]*container.ContainerStats{}
+			for _, target := range targets {
+				s, err := containerStats(target.ID, prev[target.ID])
+				if err != nil {
+					// 容器可能在采样过程中退出了
+					zlog.New().Warn("get container stats error", zap.String("id", target.ShortID()), zap.Error(err))
+					s = &container.ContainerStats{ID: target.ShortID(), Exited: true}
+				}
+				if !s.Exited {
+					current[target.ID] = s
+				}
+				// 没有指定容器时不展示已经退出的容器
+				if len(ids) == 0 && s.Exited {
+					continue
+				}
+				all = append(all, s)
+			}
+			prev = current
+
+			if !first {
+				if format == "json" {
+					printStatsJSON(all)
+				} else {
+					printStatsTable(all, !c.Bool("no-stream"))
+				}
+				if c.Bool("no-stream") {
+					return nil
+				}
+			}
+			time.Sleep(time.Second)
+		}
+	},
+}
+
+// statsTargets 返回需要统计的容器，没有指定容器时返回所有运行中的容器
+func statsTargets(ids []string) ([]*container.ContainerInfo, error) {
+	if len(ids) == 0 {
+		infos, err := container.ListContainerInfos()
+		if err != nil {
+			return nil, err
+		}
+		var running []*container.ContainerInfo
+		for _, info := range infos {
+			if info.Status == container.Running {
+				running = append(running, info)
+			}
+		}
+		return running, nil
+	}
+
+	var infos []*container.ContainerInfo
+	for _, id := range ids {
+		info, err := container.ReadContainerInfo(id)
+		if err != nil {
+			return nil, err
+		}
+		if info.Status != container.Running {
+			return nil, fmt.Errorf("container %s is not running", info.ShortID())
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// containerStats 重新读取容器信息并采样，容器已经退出时返回 Exited 为 true 的结果
+func containerStats(id string, prev *container.ContainerStats) (*container.ContainerStats, error) {
+	info, err := container.ReadContainerInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	if info.Status == container.Exited {
+		return &container.ContainerStats{ID: info.ShortID(), Exited: true}, nil
+	}
+	return container.GetContainerStats(info, prev)
+}
+
+func printStatsJSON(all []*container.ContainerStats) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, s := range all {
+		enc.Encode(s)
+	}
+}
+
+func printStatsTable(all []*container.ContainerStats, clear bool) {
+	if clear {
+		// 清屏并将光标移动到左上角
+		fmt.Print("\033[2J\033[H")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\tPIDS")
+	for _, s := range all {
+		if s.Exited {
+			fmt.Fprintf(w, "%s\t--\t-- / --\t--\t-- / --\t-- / --\t--\n", s.ID)
+			continue
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%.2f%%\t%s / %s\t%.2f%%\t%s / %s\t%s / %s\t%d\n",
+			s.ID,
+			s.CPUPercent,
+			subsystems.FormatSize(s.MemoryUsage), subsystems.FormatSize(s.MemoryLimit),
+			s.MemoryPercent,
+			subsystems.FormatSize(s.NetRx), subsystems.FormatSize(s.NetTx),
+			subsystems.FormatSize(s.BlockRead), subsystems.FormatSize(s.BlockWrite),
+			s.Pids,
+		)
+	}
+	w.Flush()
+}
+
+// parseResourceConfig 从命令行参数中解析资源限制配置，只覆盖 base 中用户指定了的项，
+// 并在设置 cgroup 之前进行校验
+func parseResourceConfig(c *cli.Context, base *subsystems.ResourceConfig) (*subsystems.ResourceConfig, error) {
+	resConf := *base
+
+	strs := []struct {
+		flag  string
+		value *string
+	}{
+		{"cpushare", &resConf.CPUShare},
+		{"cpu-period", &resConf.CPUPeriod},
+		{"cpu-quota", &resConf.CPUQuota},
+		{"cpuset", &resConf.CPUSet},
+		{"blkio-weight", &resConf.BlkioWeight},
+	}
+	for _, s := range strs {
+		if c.IsSet(s.flag) {
+			*s.value = c.String(s.flag)
+		}
+	}
+
+	slices := []struct {
+		flag  string
+		value *[]string
+	}{
+		{"device-read-bps", &resConf.DeviceReadBps},
+		{"device-write-bps", &resConf.DeviceWriteBps},
+		{"device-read-iops", &resConf.DeviceReadIOps},
+		{"device-write-iops", &resConf.DeviceWriteIOps},
+	}
+	for _, s := range slices {
+		if c.IsSet(s.flag) {
+			*s.value = c.StringSlice(s.flag)
+		}
+	}
+
+	if c.IsSet("oom-kill-disable") {
+		resConf.OOMKillDisable = c.Bool("oom-kill-disable")
+	}
+	if c.IsSet("pids-limit") {
+		resConf.PidsLimit = c.Int64("pids-limit")
+	}
+
+	sizes := []struct {
+		flag  string
+		value *int64
+	}{
+		{"mem", &resConf.MemoryLimit},
+		{"memory-swap", &resConf.MemorySwap},
+		{"memory-reservation", &resConf.MemoryReservation},
+		{"kernel-memory", &resConf.KernelMemory},
+	}
+	for _, s := range sizes {
+		if !c.IsSet(s.flag) {
+			continue
+		}
+		v := c.String(s.flag)
+		if s.flag == "memory-swap" && v == "-1" {
+			*s.value = -1
+			continue
+		}
+		n, err := subsystems.ParseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %v", s.flag, err)
+		}
+		*s.value = n
+	}
+
+	if err := resConf.Validate(); err != nil {
+		return nil, err
+	}
+	return &resConf, nil
+}
+
+// parseDevices 解析 --device 和 --device-cgroup-rule，将它们对应的规则加入 resConf 的设备白名单中
+func parseDevices(c *cli.Context, resConf *subsystems.ResourceConfig) ([]*container.DeviceMapping, error) {
+	var devices []*container.DeviceMapping
+	for _, s := range c.StringSlice("device") {
+		d, err := container.ParseDeviceMapping(s)
+		if err != nil {
+			return nil, err
+		}
+		rule, err := subsystems.DeviceRuleFromPath(d.PathOnHost, d.CgroupPermissions)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+		resConf.DeviceRules = append(resConf.DeviceRules, rule.String())
+	}
+
+	for _, s := range c.StringSlice("device-cgroup-rule") {
+		if _, err := subsystems.ParseDeviceRule(s); err != nil {
+			return nil, err
+		}
+		resConf.DeviceRules = append(resConf.DeviceRules, s)
+	}
+	return devices, nil
+}
+
+// parsePorts 解析 -p 参数，-P 时将 --expose 指定的端口映射到随机的宿主机端口
+func parsePorts(c *cli.Context) ([]*network.PortMapping, error) {
+	var ports []*network.PortMapping
+	for _, s := range c.StringSlice("publish") {
+		p, err := network.ParsePortMapping(s)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+
+	for _, s := range c.StringSlice("expose") {
+		p, err := network.ParseExposedPort(s)
+		if err != nil {
+			return nil, err
+		}
+		if !c.Bool("publish-all") {
+			continue
+		}
+		// 已经通过 -p 映射的端口不再重复映射
+		published := false
+		for _, q := range ports {
+			if q.ContainerPort == p.ContainerPort && q.Protocol == p.Protocol {
+				published = true
+				break
+			}
+		}
+		if !published {
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
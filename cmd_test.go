@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseResourceConfigMerge(t *testing.T) {
+	base := &subsystems.ResourceConfig{
+		MemoryLimit:    64 << 20,
+		MemorySwap:     128 << 20,
+		CPUShare:       "512",
+		CPUSet:         "0",
+		PidsLimit:      100,
+		BlkioWeight:    "300",
+		OOMKillDisable: true,
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    subsystems.ResourceConfig
+		wantErr bool
+	}{
+		{"no flags", nil, *base, false},
+		{
+			"override some",
+			[]string{"--mem", "256m", "--memory-swap", "-1", "--cpu-quota", "50000"},
+			subsystems.ResourceConfig{
+				MemoryLimit: 256 << 20, MemorySwap: -1, CPUShare: "512", CPUSet: "0", CPUQuota: "50000",
+				PidsLimit: 100, BlkioWeight: "300", OOMKillDisable: true,
+			},
+			false,
+		},
+		{
+			"reset values",
+			[]string{"--blkio-weight", "500", "--pids-limit", "-1", "--oom-kill-disable=false"},
+			subsystems.ResourceConfig{
+				MemoryLimit: 64 << 20, MemorySwap: 128 << 20, CPUShare: "512", CPUSet: "0",
+				PidsLimit: -1, BlkioWeight: "500",
+			},
+			false,
+		},
+		// 合并后的配置需要重新校验，内存限制不能超过原来的 swap 限制
+		{"invalid merged config", []string{"--mem", "256m"}, subsystems.ResourceConfig{}, true},
+		{"invalid size", []string{"--mem", "abc"}, subsystems.ResourceConfig{}, true},
+	}
+	for _, tt := range tests {
+		var got *subsystems.ResourceConfig
+		var parseErr error
+		app := &cli.App{
+			Flags: resourceFlags,
+			Action: func(c *cli.Context) error {
+				got, parseErr = parseResourceConfig(c, base)
+				return nil
+			},
+		}
+		if err := app.Run(append([]string{"update"}, tt.args...)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if (parseErr != nil) != tt.wantErr {
+			t.Fatalf("%s: parseResourceConfig error = %v, wantErr %v", tt.name, parseErr, tt.wantErr)
+		}
+		if parseErr == nil && !reflect.DeepEqual(*got, tt.want) {
+			t.Fatalf("%s: parseResourceConfig = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+	if base.MemoryLimit != 64<<20 || base.BlkioWeight != "300" {
+		t.Fatalf("base config should not be modified: %+v", base)
+	}
+}
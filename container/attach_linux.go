@@ -0,0 +1,275 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const attachSocketName = "attach.sock"
+
+// attach socket 中客户端发送给服务端的消息类型，消息格式为 <类型 1 字节><长度 4 字节><内容>，
+// 服务端发送给客户端的是容器伪终端的原始输出
+const (
+	attachFrameStdin  = 0 // 标准输入
+	attachFrameResize = 1 // 窗口大小变化，内容为 2 字节的行数和 2 字节的列数
+)
+
+// 客户端接收输出太慢时断开它，避免阻塞容器的输出
+const attachWriteTimeout = 5 * time.Second
+
+// attachWaitTimeout 容器启动时等待第一个客户端连接的时间，run 命令在容器可以 attach 之后
+// 立即连接，超时说明它已经退出了，容器不再等待，直接运行
+const attachWaitTimeout = 10 * time.Second
+
+// AttachSocketPath 返回容器 attach socket 的路径
+func AttachSocketPath(id string) string {
+	return filepath.Join(InfoLocation, id, attachSocketName)
+}
+
+// attachServer 持有容器伪终端的 master，通过 unix socket 供 attach 客户端连接，
+// 容器的输出广播给所有客户端，没有客户端时直接丢弃，客户端的输入写入伪终端
+type attachServer struct {
+	master   *os.File
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[net.Conn]struct{}
+	done     chan struct{}
+
+	attached     chan struct{} // 第一个客户端连接之后关闭
+	attachedOnce sync.Once
+}
+
+// newAttachServer 在 path 上监听 attach 客户端的连接
+func newAttachServer(path string, master *os.File) (*attachServer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		zlog.New().Error("listen attach socket error", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+	// 只有 root 可以 attach
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := &attachServer{
+		master:   master,
+		listener: l,
+		clients:  make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+		attached: make(chan struct{}),
+	}
+	go s.serve()
+	go s.broadcast()
+	return s, nil
+}
+
+func (s *attachServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+		s.attachedOnce.Do(func() { close(s.attached) })
+		go s.handle(conn)
+	}
+}
+
+// waitAttached 等待第一个客户端连接，超时返回 false
+func (s *attachServer) waitAttached(timeout time.Duration) bool {
+	select {
+	case <-s.attached:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// handle 读取客户端发送的消息，连接断开时客户端就 detach 了，容器继续运行
+func (s *attachServer) handle(conn net.Conn) {
+	defer s.drop(conn)
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		switch header[0] {
+		case attachFrameStdin:
+			if _, err := s.master.Write(payload); err != nil {
+				return
+			}
+		case attachFrameResize:
+			if len(payload) != 4 {
+				return
+			}
+			ws := &unix.Winsize{
+				Row: binary.BigEndian.Uint16(payload),
+				Col: binary.BigEndian.Uint16(payload[2:]),
+			}
+			if err := unix.IoctlSetWinsize(int(s.master.Fd()), unix.TIOCSWINSZ, ws); err != nil {
+				zlog.New().Warn("set pty window size error", zap.Error(err))
+			}
+		default:
+			return
+		}
+	}
+}
+
+// broadcast 将容器的输出发送给所有客户端，容器中所有进程都关闭 slave 之后读取 master 会返回 EIO
+func (s *attachServer) broadcast() {
+	defer close(s.done)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.master.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			for conn := range s.clients {
+				conn.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+				if _, err := conn.Write(buf[:n]); err != nil {
+					conn.Close()
+					delete(s.clients, conn)
+				}
+			}
+			s.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *attachServer) drop(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.clients, conn)
+}
+
+// Close 等待容器的输出转发完成，然后断开所有客户端，客户端读到 EOF 表示容器已经退出
+func (s *attachServer) Close() {
+	<-s.done
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.clients {
+		conn.Close()
+		delete(s.clients, conn)
+	}
+	s.mu.Unlock()
+	s.master.Close()
+}
+
+// Attach 将当前终端连接到容器 id 的伪终端上，interactive 时转发标准输入，并将终端设置为 raw 模式，
+// 输入 detachKeys 时断开连接并返回 ErrDetached，容器继续运行；容器退出时返回 nil
+func Attach(id string, interactive bool, detachKeys []byte) error {
+	conn, err := net.Dial("unix", AttachSocketPath(id))
+	if err != nil {
+		return fmt.Errorf("connect to container %s error: %v", id, err)
+	}
+	defer conn.Close()
+
+	stdinIsTerminal := isTerminal(os.Stdin)
+	if interactive && stdinIsTerminal {
+		restore, err := setRawTerminal(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	var writeMu sync.Mutex
+	send := func(frameType byte, payload []byte) error {
+		frame := make([]byte, 5, 5+len(payload))
+		frame[0] = frameType
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := conn.Write(append(frame, payload...))
+		return err
+	}
+
+	// 窗口大小从宿主机的终端获取，标准输入被重定向时尝试标准输出
+	term := os.Stdin
+	if !stdinIsTerminal {
+		term = os.Stdout
+	}
+	if isTerminal(term) {
+		resize := func() {
+			ws, err := unix.IoctlGetWinsize(int(term.Fd()), unix.TIOCGWINSZ)
+			if err != nil {
+				zlog.New().Warn("get terminal window size error", zap.Error(err))
+				return
+			}
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint16(payload, ws.Row)
+			binary.BigEndian.PutUint16(payload[2:], ws.Col)
+			send(attachFrameResize, payload)
+		}
+		resize()
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, unix.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				resize()
+			}
+		}()
+	}
+
+	detached := make(chan struct{})
+	if interactive {
+		go func() {
+			r := newEscapeProxy(os.Stdin, detachKeys)
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					if send(attachFrameStdin, buf[:n]) != nil {
+						return
+					}
+				}
+				if err == ErrDetached {
+					close(detached)
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(exited)
+	}()
+
+	select {
+	case <-detached:
+		return ErrDetached
+	case <-exited:
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+package container
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAttachServer(t *testing.T) {
+	master, slave := openTestPty(t)
+	// slave 在测试结束前关闭，不需要恢复终端设置
+	if _, err := setRawTerminal(int(slave.Fd())); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), attachSocketName)
+	srv, err := newAttachServer(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.waitAttached(10 * time.Millisecond) {
+		t.Fatal("no client attached yet")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 第一个客户端连接之后才会通知容器开始运行，此时它已经可以收到所有输出
+	if !srv.waitAttached(time.Second) {
+		t.Fatal("client attached but waitAttached timed out")
+	}
+	if _, err := slave.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("hello\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello\n" {
+		t.Fatalf("read output = %q, %v", buf, err)
+	}
+
+	// 客户端的输入写入伪终端
+	frame := []byte{attachFrameStdin, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], 3)
+	if _, err := conn.Write(append(frame, "ls\n"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 3)
+	if _, err := io.ReadFull(slave, buf); err != nil || string(buf) != "ls\n" {
+		t.Fatalf("read input = %q, %v", buf, err)
+	}
+
+	// 容器中的进程都关闭 slave 之后，客户端读到 EOF
+	slave.Close()
+	srv.Close()
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("read after close error = %v, want EOF", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/YOUSEEBIGGIRL/fakedocke/mountinfo"
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
 	"go.uber.org/zap"
 )
@@ -156,9 +157,7 @@ func DeleteWorkSpace(rootPath, mntPath, volume string) error {
 // DeleteMountPoint 卸载并删除挂载点 mnt
 func DeleteMountPoint(mntPath string) error {
 	// 卸载
-	cmd := exec.Command("umount", mntPath)
-	_, err := cmd.CombinedOutput()
-	if err != nil {
+	if err := unmountIfMounted(mntPath); err != nil {
 		zlog.New().Error(
 			"unmount mnt error",
 			zap.String("path", mntPath),
@@ -186,9 +185,7 @@ func DeleteMountPointWithVolume(mntPath string, volumePath []string) error {
 	}
 
 	p := filepath.Join(mntPath, volumePath[1])
-	cmd := exec.Command("umount", p)
-	_, err := cmd.CombinedOutput()
-	if err != nil {
+	if err := unmountIfMounted(p); err != nil {
 		zlog.New().Error(
 			"unmount volume path error",
 			zap.String("path", p),
@@ -197,9 +194,7 @@ func DeleteMountPointWithVolume(mntPath string, volumePath []string) error {
 		return err
 	}
 
-	cmd1 := exec.Command("umount", mntPath)
-	_, err = cmd1.CombinedOutput()
-	if err != nil {
+	if err := unmountIfMounted(mntPath); err != nil {
 		zlog.New().Error(
 			"unmount mnt error",
 			zap.String("path", mntPath),
@@ -219,6 +214,23 @@ func DeleteMountPointWithVolume(mntPath string, volumePath []string) error {
 	return nil
 }
 
+// unmountIfMounted 如果 p 是挂载点则将其卸载，容器启动失败时挂载可能还没有建立，
+// 此时直接跳过，避免 umount 报错导致后续的清理无法进行
+func unmountIfMounted(p string) error {
+	mounted, err := mountinfo.Mounted(p)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		zlog.New().Info("path is not mounted, skip unmount", zap.String("path", p))
+		return nil
+	}
+	if out, err := exec.Command("umount", p).CombinedOutput(); err != nil {
+		return fmt.Errorf("umount %s error: %v, output: %s", p, err, out)
+	}
+	return nil
+}
+
 func DeleteWriteLayer(rootPath string) error {
 	p := filepath.Join(rootPath, "write_layer")
 	if err := os.RemoveAll(p); err != nil {
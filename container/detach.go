@@ -0,0 +1,94 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultDetachKeys 默认的 detach 按键序列
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// ErrDetached 在输入中读到 detach 按键序列时返回
+var ErrDetached = errors.New("read escape sequence")
+
+// ParseDetachKeys 解析逗号分隔的按键序列，每个按键可以是单个字符，或者 ctrl-<key>，
+// key 为 a-z、@、[、\、]、^、_ 中的一个，比如 ctrl-p,ctrl-q、ctrl-a,d
+func ParseDetachKeys(s string) ([]byte, error) {
+	var keys []byte
+	for _, key := range strings.Split(s, ",") {
+		if len(key) == 1 {
+			keys = append(keys, key[0])
+			continue
+		}
+		k := strings.ToLower(key)
+		if !strings.HasPrefix(k, "ctrl-") || len(k) != len("ctrl-")+1 {
+			return nil, fmt.Errorf("invalid detach key %q in %q", key, s)
+		}
+		c := k[len(k)-1]
+		switch {
+		case c >= 'a' && c <= 'z':
+			keys = append(keys, c-'a'+1)
+		case c == '@':
+			keys = append(keys, 0)
+		case c >= '[' && c <= '_':
+			// ctrl-[ 到 ctrl-_ 对应 27 到 31
+			keys = append(keys, c-'['+27)
+		default:
+			return nil, fmt.Errorf("invalid detach key %q in %q", key, s)
+		}
+	}
+	return keys, nil
+}
+
+// escapeProxy 转发 r 中的数据，读到 keys 时返回 ErrDetached，keys 本身不会被转发；
+// 部分匹配的按键先暂存起来，后续的输入不匹配时再原样转发
+type escapeProxy struct {
+	r       io.Reader
+	keys    []byte
+	matched int    // 已经匹配的按键数量
+	pending []byte // 待返回给调用者的数据
+	err     error
+}
+
+func newEscapeProxy(r io.Reader, keys []byte) io.Reader {
+	if len(keys) == 0 {
+		return r
+	}
+	return &escapeProxy{r: r, keys: keys}
+}
+
+func (p *escapeProxy) Read(buf []byte) (int, error) {
+	for len(p.pending) == 0 && p.err == nil {
+		n, err := p.r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != p.keys[p.matched] && p.matched > 0 {
+				p.pending = append(p.pending, p.keys[:p.matched]...)
+				p.matched = 0
+			}
+			if b != p.keys[p.matched] {
+				p.pending = append(p.pending, b)
+				continue
+			}
+			p.matched++
+			if p.matched == len(p.keys) {
+				// 按键序列之前的数据仍然需要转发，下次调用 Read 时再返回 ErrDetached
+				err = ErrDetached
+				break
+			}
+		}
+		if err != nil && err != ErrDetached {
+			// 输入结束时暂存的按键不再构成 detach 序列
+			p.pending = append(p.pending, p.keys[:p.matched]...)
+			p.matched = 0
+		}
+		p.err = err
+	}
+	if len(p.pending) == 0 {
+		return 0, p.err
+	}
+	n := copy(buf, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
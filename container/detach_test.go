@@ -0,0 +1,67 @@
+package container
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseDetachKeys(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []byte
+	}{
+		{DefaultDetachKeys, []byte{16, 17}},
+		{"ctrl-a,d", []byte{1, 'd'}},
+		{"ctrl-@,ctrl-[,ctrl-_,CTRL-Z", []byte{0, 27, 31, 26}},
+	}
+	for _, tt := range tests {
+		got, err := ParseDetachKeys(tt.in)
+		if err != nil {
+			t.Fatalf("ParseDetachKeys(%q) error: %v", tt.in, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("ParseDetachKeys(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "ctrl-", "ctrl-1", "ctrl-pq", "ab", "ctrl-p,"} {
+		if _, err := ParseDetachKeys(in); err == nil {
+			t.Fatalf("ParseDetachKeys(%q) should fail", in)
+		}
+	}
+}
+
+func TestEscapeProxy(t *testing.T) {
+	keys := []byte{16, 17}
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		detached bool
+	}{
+		{"no keys", "ls -l\r", "ls -l\r", false},
+		{"detach", "ls\x10\x11echo", "ls", true},
+		{"partial match is forwarded", "a\x10b\x10", "a\x10b\x10", false},
+		{"repeated prefix", "\x10\x10\x11", "\x10", true},
+	}
+	for _, tt := range tests {
+		// OneByteReader 保证按键序列被拆到多次 Read 中时也能识别
+		for _, r := range []io.Reader{bytes.NewBufferString(tt.in), iotest.OneByteReader(bytes.NewBufferString(tt.in))} {
+			got, err := ioutil.ReadAll(newEscapeProxy(r, keys))
+			if string(got) != tt.want {
+				t.Fatalf("%s: got %q, want %q", tt.name, got, tt.want)
+			}
+			if (err == ErrDetached) != tt.detached {
+				t.Fatalf("%s: err = %v, detached = %v", tt.name, err, tt.detached)
+			}
+		}
+	}
+
+	got, _ := ioutil.ReadAll(newEscapeProxy(bytes.NewBufferString("\x10\x11"), nil))
+	if string(got) != "\x10\x11" {
+		t.Fatalf("empty detach keys should forward everything, got %q", got)
+	}
+}
@@ -0,0 +1,212 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultShmSize 没有指定 --shm-size 时 /dev/shm 的大小
+const DefaultShmSize = 64 * subsystems.MiB
+
+// DevTmpfsSize 容器 /dev 上 tmpfs 的大小，/dev 中只有设备文件、目录和符号链接，
+// 不占用数据页，这里只是限制容器向 /dev 中写入普通文件
+const DevTmpfsSize = 64 * subsystems.MiB
+
+// defaultDevices 容器中默认创建的设备，与 devices cgroup 的默认白名单对应
+var defaultDevices = []string{
+	"/dev/null",
+	"/dev/zero",
+	"/dev/full",
+	"/dev/random",
+	"/dev/urandom",
+	"/dev/tty",
+}
+
+// devSymlinks 容器 /dev 中的符号链接，/dev/ptmx 指向新 devpts 实例中的 ptmx，
+// 这样容器中分配的伪终端不会出现在宿主机的 /dev/pts 中
+var devSymlinks = [][2]string{
+	{"/proc/self/fd", "/dev/fd"},
+	{"/proc/self/fd/0", "/dev/stdin"},
+	{"/proc/self/fd/1", "/dev/stdout"},
+	{"/proc/self/fd/2", "/dev/stderr"},
+	{"pts/ptmx", "/dev/ptmx"},
+}
+
+// setUpDev 在 pivot_root 之前为容器准备一个最小的 /dev，此时还可以访问宿主机的设备：
+// 1. 在 rootfs/dev 上挂载 tmpfs
+// 2. 创建默认设备和 --device 指定的设备，在 user namespace 中没有权限 mknod，改为 bind mount 宿主机的设备
+// 3. 挂载新的 devpts 实例、/dev/shm 和 /dev/mqueue，创建符号链接
+func setUpDev(rootfs string, config *initConfig) error {
+	// 镜像中的 /dev 可能是一个符号链接，需要在 rootfs 中解析，不能跟随到宿主机上
+	dev, err := secureJoin(rootfs, "/dev")
+	if err != nil {
+		return fmt.Errorf("resolve /dev in rootfs error: %v", err)
+	}
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return fmt.Errorf("mkdir %s error: %v", dev, err)
+	}
+	data := fmt.Sprintf("mode=755,size=%d", DevTmpfsSize)
+	if err := unix.Mount("tmpfs", dev, "tmpfs", unix.MS_NOSUID|unix.MS_STRICTATIME, data); err != nil {
+		zlog.New().Error("mount tmpfs error", zap.Error(err))
+		return fmt.Errorf("mount tmpfs on /dev error: %v", err)
+	}
+
+	userns := inUserNamespace()
+	devices := []*DeviceMapping{}
+	for _, d := range defaultDevices {
+		devices = append(devices, &DeviceMapping{PathOnHost: d, PathInContainer: d})
+	}
+	devices = append(devices, config.Devices...)
+	if config.Security != nil && config.Security.Privileged {
+		devices = append(devices, hostDevices()...)
+	}
+	for _, d := range devices {
+		if err := createDevice(rootfs, dev, d, userns); err != nil {
+			return err
+		}
+	}
+
+	ptsOptions := "newinstance,ptmxmode=0666,mode=0620"
+	// user namespace 中宿主机的 tty 组（gid 5）可能没有映射
+	if !userns {
+		ptsOptions += ",gid=5"
+	}
+	shmSize := config.ShmSize
+	if shmSize == 0 {
+		shmSize = DefaultShmSize
+	}
+	mounts := []struct {
+		source, target, fstype string
+		flags                  uintptr
+		data                   string
+	}{
+		{"devpts", "pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, ptsOptions},
+		{"shm", "shm", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, fmt.Sprintf("mode=1777,size=%d", shmSize)},
+		// mqueue 挂载的是当前 IPC namespace 中的 POSIX 消息队列
+		{"mqueue", "mqueue", "mqueue", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	}
+	for _, m := range mounts {
+		target := filepath.Join(dev, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("mkdir %s error: %v", target, err)
+		}
+		if err := unix.Mount(m.source, target, m.fstype, m.flags, m.data); err != nil {
+			zlog.New().Error("mount error", zap.String("target", "/dev/"+m.target), zap.Error(err))
+			return fmt.Errorf("mount %s on /dev/%s error: %v", m.fstype, m.target, err)
+		}
+	}
+
+	for _, l := range devSymlinks {
+		link, err := secureJoinParent(rootfs, l[1])
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(l[0], link); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("create symlink %s error: %v", l[1], err)
+		}
+	}
+	return nil
+}
+
+// hostDevices 返回宿主机 /dev 中的所有设备，特权模式下全部传递给容器，
+// /dev/pts、/dev/shm 和 /dev/mqueue 在容器中是单独挂载的，跳过它们
+func hostDevices() []*DeviceMapping {
+	var devices []*DeviceMapping
+	filepath.Walk("/dev", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			switch p {
+			case "/dev/pts", "/dev/shm", "/dev/mqueue":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode()&os.ModeDevice == 0 {
+			return nil
+		}
+		for _, d := range defaultDevices {
+			if d == p {
+				return nil
+			}
+		}
+		if p == "/dev/console" || p == "/dev/ptmx" {
+			return nil
+		}
+		devices = append(devices, &DeviceMapping{PathOnHost: p, PathInContainer: p, CgroupPermissions: "rwm"})
+		return nil
+	})
+	return devices
+}
+
+// createDevice 在容器中创建设备 d，设备类型、设备号和权限与宿主机上的设备相同，
+// 设备所在的目录通过 secureJoin 在 rootfs 中解析，解析之后必须仍然在容器的 /dev（即 dev）下
+func createDevice(rootfs, dev string, d *DeviceMapping, userns bool) error {
+	var st unix.Stat_t
+	if err := unix.Stat(d.PathOnHost, &st); err != nil {
+		// 宿主机上不存在的默认设备直接跳过，--device 指定的设备在启动前已经检查过
+		zlog.New().Warn("stat device error, skip it", zap.String("path", d.PathOnHost), zap.Error(err))
+		return nil
+	}
+	fileType := st.Mode & unix.S_IFMT
+	if fileType != unix.S_IFCHR && fileType != unix.S_IFBLK {
+		return fmt.Errorf("%s is not a device", d.PathOnHost)
+	}
+
+	target, err := secureJoinParent(rootfs, d.PathInContainer)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(target, dev+"/") {
+		return fmt.Errorf("device %s should be under /dev in container", d.PathInContainer)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("mkdir %s error: %v", filepath.Dir(target), err)
+	}
+
+	if userns {
+		// user namespace 中没有 CAP_MKNOD，创建一个空文件作为挂载点，再 bind mount 宿主机的设备，
+		// O_NOFOLLOW 保证挂载点不是符号链接
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|unix.O_NOFOLLOW, 0644)
+		if err != nil {
+			return fmt.Errorf("create device mount point %s error: %v", target, err)
+		}
+		f.Close()
+		if err := unix.Mount(d.PathOnHost, target, "bind", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mount device %s error: %v", d.PathOnHost, err)
+		}
+		return nil
+	}
+
+	// mknod 受 umask 影响，创建之后再 chmod 成与宿主机相同的权限
+	if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+		return fmt.Errorf("mknod %s error: %v", target, err)
+	}
+	if err := unix.Chmod(target, st.Mode&07777); err != nil {
+		return fmt.Errorf("chmod %s error: %v", target, err)
+	}
+	if err := unix.Chown(target, int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("chown %s error: %v", target, err)
+	}
+	return nil
+}
+
+// inUserNamespace 通过 uid_map 判断当前进程是否运行在 user namespace 中，
+// 初始 user namespace 中 uid_map 的内容为 "0 0 4294967295"
+func inUserNamespace() bool {
+	b, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(b))
+	return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295")
+}
@@ -0,0 +1,59 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCreateDevice(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mknod requires root")
+	}
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 镜像中的 /dev 是指向 /etc 的符号链接，设备应该创建在 rootfs/etc 下而不是宿主机的 /etc 下
+	if err := os.Symlink("/etc", filepath.Join(rootfs, "dev")); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := secureJoin(rootfs, "/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev != filepath.Join(rootfs, "etc") {
+		t.Fatalf("dev = %s", dev)
+	}
+
+	d := &DeviceMapping{PathOnHost: "/dev/null", PathInContainer: "/dev/null", CgroupPermissions: "rwm"}
+	if err := createDevice(rootfs, dev, d, false); err != nil {
+		t.Fatal(err)
+	}
+	var st, host unix.Stat_t
+	if err := unix.Stat(filepath.Join(rootfs, "etc/null"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Stat("/dev/null", &host); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != host.Mode || st.Rdev != host.Rdev {
+		t.Fatalf("device mode %o rdev %d, want %o %d", st.Mode, st.Rdev, host.Mode, host.Rdev)
+	}
+
+	// 解析之后不在 /dev 下的设备被拒绝
+	if err := os.Symlink("/var", filepath.Join(rootfs, "etc/sub")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/dev/sub/null", "/dev/../null", "/etc2/null"} {
+		d := &DeviceMapping{PathOnHost: "/dev/null", PathInContainer: p, CgroupPermissions: "rwm"}
+		if err := createDevice(rootfs, dev, d, false); err == nil {
+			t.Fatalf("device %s outside /dev should be rejected", p)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "var/null")); !os.IsNotExist(err) {
+		t.Fatalf("device created outside /dev: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DeviceMapping 描述通过 --device 传递给容器的宿主机设备
+type DeviceMapping struct {
+	PathOnHost        string `json:"path_on_host"`
+	PathInContainer   string `json:"path_in_container"`
+	CgroupPermissions string `json:"cgroup_permissions"` // r 读、w 写、m mknod 的组合
+}
+
+// ParseDeviceMapping 解析 --device 参数，格式为 <宿主机路径>[:<容器内路径>][:<权限>]，
+// 比如 /dev/sda、/dev/sda:/dev/xvda、/dev/sda:rw，不指定容器内路径时与宿主机路径相同，
+// 不指定权限时为 rwm
+func ParseDeviceMapping(s string) (*DeviceMapping, error) {
+	d := &DeviceMapping{CgroupPermissions: "rwm"}
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 3:
+		d.CgroupPermissions = parts[2]
+		fallthrough
+	case 2:
+		if len(parts) == 2 && validDevicePermissions(parts[1]) {
+			d.CgroupPermissions = parts[1]
+		} else {
+			d.PathInContainer = parts[1]
+		}
+		fallthrough
+	case 1:
+		d.PathOnHost = parts[0]
+	default:
+		return nil, fmt.Errorf("invalid device specification %q", s)
+	}
+	if d.PathInContainer == "" {
+		d.PathInContainer = d.PathOnHost
+	}
+
+	if !filepath.IsAbs(d.PathOnHost) || !filepath.IsAbs(d.PathInContainer) {
+		return nil, fmt.Errorf("invalid device specification %q, device path must be absolute", s)
+	}
+	if !validDevicePermissions(d.CgroupPermissions) {
+		return nil, fmt.Errorf("invalid device cgroup permissions %q in %q", d.CgroupPermissions, s)
+	}
+	d.PathInContainer = filepath.Clean(d.PathInContainer)
+	return d, nil
+}
+
+func validDevicePermissions(p string) bool {
+	if p == "" {
+		return false
+	}
+	for _, c := range p {
+		if !strings.ContainsRune("rwm", c) || strings.Count(p, string(c)) > 1 {
+			return false
+		}
+	}
+	return true
+}
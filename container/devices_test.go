@@ -0,0 +1,33 @@
+package container
+
+import (
+	"testing"
+)
+
+func TestParseDeviceMapping(t *testing.T) {
+	tests := []struct {
+		in   string
+		want DeviceMapping
+	}{
+		{"/dev/sda", DeviceMapping{"/dev/sda", "/dev/sda", "rwm"}},
+		{"/dev/sda:/dev/xvda", DeviceMapping{"/dev/sda", "/dev/xvda", "rwm"}},
+		{"/dev/sda:r", DeviceMapping{"/dev/sda", "/dev/sda", "r"}},
+		{"/dev/sda:/dev/xvda:rw", DeviceMapping{"/dev/sda", "/dev/xvda", "rw"}},
+		{"/dev/snd/:/dev/sound/", DeviceMapping{"/dev/snd/", "/dev/sound", "rwm"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseDeviceMapping(tt.in)
+		if err != nil {
+			t.Fatalf("ParseDeviceMapping(%q) error: %v", tt.in, err)
+		}
+		if *got != tt.want {
+			t.Fatalf("ParseDeviceMapping(%q) = %+v, want %+v", tt.in, *got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "dev/sda", "/dev/sda:xvda", "/dev/sda:/dev/xvda:rx", "/dev/sda:/dev/xvda:rw:m"} {
+		if _, err := ParseDeviceMapping(in); err == nil {
+			t.Fatalf("ParseDeviceMapping(%q) should fail", in)
+		}
+	}
+}
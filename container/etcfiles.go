@@ -0,0 +1,332 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+	"github.com/YOUSEEBIGGIRL/fakedocke/resolver"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+)
+
+// 容器中由 fakedocker 生成并 bind mount 进去的文件
+const (
+	hostnameFile   = "/etc/hostname"
+	hostsFile      = "/etc/hosts"
+	resolvConfFile = "/etc/resolv.conf"
+)
+
+var (
+	// hostResolvConf 宿主机的 resolv.conf，使用 systemd-resolved 时其中只有 127.0.0.53，
+	// 容器中无法访问，这时使用 systemd-resolved 记录的上游 DNS 服务器
+	hostResolvConf      = "/etc/resolv.conf"
+	systemdResolvConf   = "/run/systemd/resolve/resolv.conf"
+	hostHostsFile       = "/etc/hosts"
+	defaultNameservers  = []string{"8.8.8.8", "8.8.4.4"}
+	defaultHostsEntries = []string{
+		"127.0.0.1\tlocalhost",
+		"::1\tlocalhost ip6-localhost ip6-loopback",
+		"fe00::0\tip6-localnet",
+		"ff00::0\tip6-mcastprefix",
+		"ff02::1\tip6-allnodes",
+		"ff02::2\tip6-allrouters",
+	}
+)
+
+// DNSConfig 容器的 DNS 配置，为空的部分使用宿主机 resolv.conf 中的配置
+type DNSConfig struct {
+	Nameservers []string `json:"nameservers"` // --dns
+	Search      []string `json:"search"`      // --dns-search，"." 表示不使用搜索域
+	Options     []string `json:"options"`     // --dns-option
+}
+
+// ParseExtraHost 解析 --add-host 参数，格式为 host:ip，ip 可以是 IPv6 地址
+func ParseExtraHost(s string) (host, ip string, err error) {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid --add-host %q, format is host:ip", s)
+	}
+	host, ip = s[:i], s[i+1:]
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid IP address %q in --add-host %q", ip, s)
+	}
+	return host, ip, nil
+}
+
+// validHostname 匹配由点分隔的 RFC 1123 标签
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// ValidateHostname 检查 --hostname 和 --domainname 参数，内核限制它们的长度不能超过 64 字节
+func ValidateHostname(name string) error {
+	if len(name) > 64 || !validHostname.MatchString(name) {
+		return fmt.Errorf("invalid hostname or domainname %q", name)
+	}
+	return nil
+}
+
+// ParseDNSConfig 检查 --dns、--dns-search 和 --dns-option 参数
+func ParseDNSConfig(nameservers, search, options []string) (*DNSConfig, error) {
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("invalid --dns %q, must be an IP address", ns)
+		}
+	}
+	for _, s := range search {
+		if s == "" || strings.ContainsAny(s, " \t") {
+			return nil, fmt.Errorf("invalid --dns-search %q", s)
+		}
+	}
+	for _, o := range options {
+		if o == "" || strings.ContainsAny(o, " \t") {
+			return nil, fmt.Errorf("invalid --dns-option %q", o)
+		}
+	}
+	return &DNSConfig{Nameservers: nameservers, Search: search, Options: options}, nil
+}
+
+// hostsContent 生成容器的 /etc/hosts，base 为空时使用默认的 localhost 等条目，
+// ips 为容器自己的地址，双栈网络中同时有 IPv4 和 IPv6 地址，没有网络时为空；
+// 设置了 domainname 时同时添加完整的域名
+func hostsContent(base []byte, hostname, domainname string, ips []string, extraHosts []string) []byte {
+	buf := &bytes.Buffer{}
+	if len(base) == 0 {
+		for _, e := range defaultHostsEntries {
+			fmt.Fprintln(buf, e)
+		}
+	} else {
+		buf.Write(base)
+		if base[len(base)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	for _, h := range extraHosts {
+		if host, hostIP, err := ParseExtraHost(h); err == nil {
+			fmt.Fprintf(buf, "%s\t%s\n", hostIP, host)
+		}
+	}
+	for _, ip := range ips {
+		if domainname != "" {
+			fmt.Fprintf(buf, "%s\t%s.%s %s\n", ip, hostname, domainname, hostname)
+		} else {
+			fmt.Fprintf(buf, "%s\t%s\n", ip, hostname)
+		}
+	}
+	return buf.Bytes()
+}
+
+// resolvConf 是解析之后的 resolv.conf
+type resolvConf struct {
+	nameservers []string
+	search      []string
+	options     []string
+	others      []string // 其他不需要修改的行，比如 sortlist
+}
+
+// parseResolvConf 解析 resolv.conf，filterLoopback 为 true 时去掉回环地址上的 DNS 服务器，
+// 去掉之后没有可用的服务器时使用默认的公共 DNS
+func parseResolvConf(b []byte, filterLoopback bool) *resolvConf {
+	r := &resolvConf{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 {
+				continue
+			}
+			if ip := net.ParseIP(fields[1]); filterLoopback && ip != nil && ip.IsLoopback() {
+				continue
+			}
+			r.nameservers = append(r.nameservers, fields[1])
+		case "search", "domain":
+			// domain 和 search 同时出现时以最后一个为准
+			r.search = fields[1:]
+		case "options":
+			r.options = append(r.options, fields[1:]...)
+		default:
+			r.others = append(r.others, line)
+		}
+	}
+	if len(r.nameservers) == 0 {
+		r.nameservers = defaultNameservers
+	}
+	return r
+}
+
+// apply 用 dns 中指定的部分覆盖原来的配置
+func (r *resolvConf) apply(dns *DNSConfig) {
+	if dns == nil {
+		return
+	}
+	if len(dns.Nameservers) > 0 {
+		r.nameservers = dns.Nameservers
+	}
+	if len(dns.Search) > 0 {
+		r.search = dns.Search
+		if len(r.search) == 1 && r.search[0] == "." {
+			r.search = nil
+		}
+	}
+	if len(dns.Options) > 0 {
+		r.options = dns.Options
+	}
+}
+
+func (r *resolvConf) bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, line := range r.others {
+		fmt.Fprintln(buf, line)
+	}
+	if len(r.search) > 0 {
+		fmt.Fprintf(buf, "search %s\n", strings.Join(r.search, " "))
+	}
+	for _, ns := range r.nameservers {
+		fmt.Fprintf(buf, "nameserver %s\n", ns)
+	}
+	if len(r.options) > 0 {
+		fmt.Fprintf(buf, "options %s\n", strings.Join(r.options, " "))
+	}
+	return buf.Bytes()
+}
+
+// resolvConfContent 根据宿主机的 resolv.conf 生成容器的 resolv.conf，dns 中指定的部分覆盖宿主机的配置；
+// 容器有自己的 network namespace 时无法访问宿主机回环地址上的 DNS 服务器，filterLoopback 为 true 时
+// 将它们去掉
+func resolvConfContent(host []byte, dns *DNSConfig, filterLoopback bool) []byte {
+	r := parseResolvConf(host, filterLoopback)
+	r.apply(dns)
+	return r.bytes()
+}
+
+// readHostResolvConf 读取宿主机的 resolv.conf，其中只有回环地址上的 DNS 服务器并且存在
+// systemd-resolved 的配置时改为读取后者
+func readHostResolvConf(filterLoopback bool) ([]byte, error) {
+	b, err := ioutil.ReadFile(hostResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !filterLoopback || hasRemoteNameserver(b) {
+		return b, nil
+	}
+	if resolved, err := ioutil.ReadFile(systemdResolvConf); err == nil {
+		return resolved, nil
+	}
+	return b, nil
+}
+
+func hasRemoteNameserver(resolvConf []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(resolvConf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setUpEtcFiles 在容器信息目录中生成容器的 /etc/hostname、/etc/hosts 和 /etc/resolv.conf，
+// 记录到 info 中，返回容器中的路径到生成的文件的映射，由容器 init 进程 bind mount 到 rootfs 中。
+// container 网络模式的容器与目标容器共用这些文件。
+// 容器使用内置 DNS 服务器时 resolv.conf 中的服务器为 resolver.Address，同时返回内置 DNS 服务器的上游服务器
+func setUpEtcFiles(info *ContainerInfo, extraHosts []string, dns *DNSConfig) (files map[string]string, upstreams []string, err error) {
+	if strings.HasPrefix(info.NetworkMode, network.ModeContainerPrefix) {
+		target, err := ReadContainerInfo(strings.TrimPrefix(info.NetworkMode, network.ModeContainerPrefix))
+		if err != nil {
+			return nil, nil, err
+		}
+		info.Hostname, info.Domainname = target.Hostname, target.Domainname
+		info.HostnamePath, info.HostsPath, info.ResolvConfPath = target.HostnamePath, target.HostsPath, target.ResolvConfPath
+		if info.HostnamePath == "" {
+			return nil, nil, nil
+		}
+		return map[string]string{
+			hostnameFile:   info.HostnamePath,
+			hostsFile:      info.HostsPath,
+			resolvConfFile: info.ResolvConfPath,
+		}, nil, nil
+	}
+
+	// host 模式直接使用宿主机的 /etc/hosts 和 DNS 服务器
+	hostMode := info.NetworkMode == network.ModeHost
+	var baseHosts []byte
+	if hostMode {
+		b, err := ioutil.ReadFile(hostHostsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		baseHosts = b
+	}
+	var ips []string
+	if len(info.Networks) > 0 {
+		for _, a := range []string{info.Networks[0].IPAddress, info.Networks[0].IPv6Address} {
+			if addr, _, err := net.ParseCIDR(a); err == nil {
+				ips = append(ips, addr.String())
+			}
+		}
+	}
+	hostResolv, err := readHostResolvConf(!hostMode)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolv := parseResolvConf(hostResolv, !hostMode)
+	resolv.apply(dns)
+	if useEmbeddedDNS(info) {
+		// 内置 DNS 服务器在宿主机的 network namespace 中转发查询，可以使用宿主机回环地址上的服务器
+		b, err := readHostResolvConf(false)
+		if err != nil {
+			return nil, nil, err
+		}
+		upstream := parseResolvConf(b, false)
+		upstream.apply(dns)
+		upstreams = upstream.nameservers
+
+		resolv.nameservers = []string{resolver.Address}
+		// 与 docker 相同，容器的名字不包含点，ndots:0 使它们不经过搜索域直接查询
+		hasNdots := false
+		for _, o := range resolv.options {
+			if strings.HasPrefix(o, "ndots:") {
+				hasNdots = true
+			}
+		}
+		if !hasNdots {
+			resolv.options = append(resolv.options, "ndots:0")
+		}
+	}
+
+	dir := filepath.Join(InfoLocation, info.ID)
+	contents := map[string][]byte{
+		"hostname":    []byte(info.Hostname + "\n"),
+		"hosts":       hostsContent(baseHosts, info.Hostname, info.Domainname, ips, extraHosts),
+		"resolv.conf": resolv.bytes(),
+	}
+	for name, content := range contents {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			zlog.New().Error("write container etc file error", zap.String("path", p), zap.Error(err))
+			return nil, nil, err
+		}
+	}
+	info.HostnamePath = filepath.Join(dir, "hostname")
+	info.HostsPath = filepath.Join(dir, "hosts")
+	info.ResolvConfPath = filepath.Join(dir, "resolv.conf")
+	return map[string]string{
+		hostnameFile:   info.HostnamePath,
+		hostsFile:      info.HostsPath,
+		resolvConfFile: info.ResolvConfPath,
+	}, upstreams, nil
+}
@@ -0,0 +1,205 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+)
+
+func TestParseExtraHost(t *testing.T) {
+	tests := []struct {
+		in, host, ip string
+	}{
+		{"db:10.0.0.2", "db", "10.0.0.2"},
+		{"db.local:fd00::2", "db.local", "fd00::2"},
+	}
+	for _, tt := range tests {
+		host, ip, err := ParseExtraHost(tt.in)
+		if err != nil {
+			t.Fatalf("ParseExtraHost(%q) error: %v", tt.in, err)
+		}
+		if host != tt.host || ip != tt.ip {
+			t.Fatalf("ParseExtraHost(%q) = %q, %q", tt.in, host, ip)
+		}
+	}
+	for _, in := range []string{"", "db", ":10.0.0.2", "db:", "db:10.0.0"} {
+		if _, _, err := ParseExtraHost(in); err == nil {
+			t.Fatalf("ParseExtraHost(%q) should fail", in)
+		}
+	}
+
+	if _, err := ParseDNSConfig([]string{"dns.google"}, nil, nil); err == nil {
+		t.Fatal("ParseDNSConfig with invalid nameserver should fail")
+	}
+}
+
+func TestHostsContent(t *testing.T) {
+	got := string(hostsContent(nil, "abc", "", []string{"172.18.0.2"}, []string{"db:10.0.0.2"}))
+	if !strings.HasPrefix(got, "127.0.0.1\tlocalhost\n") {
+		t.Fatalf("hosts does not start with localhost:\n%s", got)
+	}
+	if !strings.HasSuffix(got, "10.0.0.2\tdb\n172.18.0.2\tabc\n") {
+		t.Fatalf("unexpected hosts:\n%s", got)
+	}
+
+	// host 模式在宿主机的 /etc/hosts 之后追加，容器没有自己的地址
+	got = string(hostsContent([]byte("127.0.0.1 localhost myhost"), "myhost", "", nil, []string{"db:10.0.0.2"}))
+	if got != "127.0.0.1 localhost myhost\n10.0.0.2\tdb\n" {
+		t.Fatalf("unexpected hosts:\n%s", got)
+	}
+
+	got = string(hostsContent(nil, "web", "example.com", []string{"172.18.0.2", "fd00::2"}, nil))
+	if !strings.HasSuffix(got, "172.18.0.2\tweb.example.com web\nfd00::2\tweb.example.com web\n") {
+		t.Fatalf("unexpected hosts:\n%s", got)
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	for _, name := range []string{"web", "0123456789ab", "web-1.example.com"} {
+		if err := ValidateHostname(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"", "-web", "web-", "web_1", "web..com", "web.", strings.Repeat("a", 65)} {
+		if err := ValidateHostname(name); err == nil {
+			t.Fatalf("ValidateHostname(%q) should fail", name)
+		}
+	}
+}
+
+func TestResolvConfContent(t *testing.T) {
+	host := []byte(`# generated by NetworkManager
+domain example.com
+search corp.example.com example.com
+nameserver 127.0.0.53
+nameserver 10.0.0.1
+nameserver ::1
+options edns0 trust-ad
+sortlist 10.0.0.0/255.0.0.0
+`)
+	tests := []struct {
+		dns            *DNSConfig
+		filterLoopback bool
+		want           string
+	}{
+		{
+			nil, true,
+			"sortlist 10.0.0.0/255.0.0.0\nsearch corp.example.com example.com\nnameserver 10.0.0.1\noptions edns0 trust-ad\n",
+		},
+		{
+			nil, false,
+			"sortlist 10.0.0.0/255.0.0.0\nsearch corp.example.com example.com\nnameserver 127.0.0.53\nnameserver 10.0.0.1\nnameserver ::1\noptions edns0 trust-ad\n",
+		},
+		{
+			&DNSConfig{Nameservers: []string{"1.1.1.1"}, Search: []string{"."}, Options: []string{"ndots:2"}}, true,
+			"sortlist 10.0.0.0/255.0.0.0\nnameserver 1.1.1.1\noptions ndots:2\n",
+		},
+		{
+			&DNSConfig{Search: []string{"svc.local"}}, true,
+			"sortlist 10.0.0.0/255.0.0.0\nsearch svc.local\nnameserver 10.0.0.1\noptions edns0 trust-ad\n",
+		},
+	}
+	for i, tt := range tests {
+		if got := string(resolvConfContent(host, tt.dns, tt.filterLoopback)); got != tt.want {
+			t.Fatalf("case %d: resolv.conf =\n%s\nwant:\n%s", i, got, tt.want)
+		}
+	}
+
+	// 只有回环地址上的服务器时使用默认的公共 DNS
+	got := string(resolvConfContent([]byte("nameserver 127.0.0.53\n"), nil, true))
+	if got != "nameserver 8.8.8.8\nnameserver 8.8.4.4\n" {
+		t.Fatalf("resolv.conf =\n%s", got)
+	}
+}
+
+func TestSetUpEtcFiles(t *testing.T) {
+	origin, originResolv := InfoLocation, hostResolvConf
+	InfoLocation = t.TempDir()
+	hostResolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+	defer func() { InfoLocation, hostResolvConf = origin, originResolv }()
+	if err := ioutil.WriteFile(hostResolvConf, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &ContainerInfo{
+		ID:          "0123456789abcdef",
+		Status:      Running,
+		NetworkMode: network.DefaultNetworkName,
+		Hostname:    "web",
+		Networks:    []*network.Endpoint{{IPAddress: "172.18.0.2/16"}},
+	}
+	if err := RecordContainerInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	files, upstreams, err := setUpEtcFiles(info, []string{"db:10.0.0.2"}, &DNSConfig{Options: []string{"ndots:2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstreams != nil {
+		t.Fatalf("default network should not use embedded dns, upstreams = %v", upstreams)
+	}
+	want := map[string]string{
+		hostnameFile:   "web\n",
+		hostsFile:      "10.0.0.2\tdb\n172.18.0.2\tweb\n",
+		resolvConfFile: "nameserver 10.0.0.1\noptions ndots:2\n",
+	}
+	for dst, content := range want {
+		b, err := ioutil.ReadFile(files[dst])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(b), content) {
+			t.Fatalf("%s =\n%s\nwant suffix:\n%s", dst, b, content)
+		}
+	}
+	if info.HostsPath != files[hostsFile] {
+		t.Fatalf("hosts path %s is not recorded", files[hostsFile])
+	}
+	if err := RecordContainerInfo(info); err != nil {
+		t.Fatal(err)
+	}
+
+	// container 模式使用目标容器的文件
+	sidecar := &ContainerInfo{ID: "fedcba9876543210", NetworkMode: network.ModeContainerPrefix + info.ID}
+	sidecarFiles, _, err := setUpEtcFiles(sidecar, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sidecar.Hostname != "web" || sidecarFiles[hostsFile] != files[hostsFile] {
+		t.Fatalf("sidecar should share etc files of %s: %v", info.ShortID(), sidecarFiles)
+	}
+}
+
+func TestSetUpEtcFilesEmbeddedDNS(t *testing.T) {
+	origin, originResolv := InfoLocation, hostResolvConf
+	InfoLocation = t.TempDir()
+	hostResolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+	defer func() { InfoLocation, hostResolvConf = origin, originResolv }()
+	if err := ioutil.WriteFile(hostResolvConf, []byte("search example.com\nnameserver 127.0.0.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &ContainerInfo{ID: "0123456789abcdef", NetworkMode: "mynet", Hostname: "web"}
+	if err := os.MkdirAll(filepath.Join(InfoLocation, info.ID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files, upstreams, err := setUpEtcFiles(info, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内置 DNS 服务器在宿主机中转发查询，回环地址上的服务器也可以使用
+	if len(upstreams) != 1 || upstreams[0] != "127.0.0.53" {
+		t.Fatalf("upstreams = %v", upstreams)
+	}
+	b, err := ioutil.ReadFile(files[resolvConfFile])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "search example.com\nnameserver 127.0.0.11\noptions ndots:0\n"; string(b) != want {
+		t.Fatalf("resolv.conf =\n%s\nwant:\n%s", b, want)
+	}
+}
@@ -0,0 +1,262 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup"
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// 容器状态
+const (
+	Running = "running"
+	Paused  = "paused"
+	Exited  = "exited"
+)
+
+var (
+	// InfoLocation 容器信息的存放目录，每个容器对应其中的一个子目录 InfoLocation/<容器 ID>
+	InfoLocation = "/var/run/fakedocker/containers"
+	configName   = "config.json"
+)
+
+// ContainerInfo 记录容器的运行信息，以 json 格式保存在 InfoLocation/<容器 ID>/config.json 中
+type ContainerInfo struct {
+	ID             string                     `json:"id"`
+	Name           string                     `json:"name"`
+	Pid            int                        `json:"pid"`     // 容器 init 进程在宿主机上的 pid
+	Command        []string                   `json:"command"` // 容器中运行的命令
+	CreatedTime    string                     `json:"created_time"`
+	Status         string                     `json:"status"`
+	ExitCode       int                        `json:"exit_code"`
+	OOMKilled      bool                       `json:"oom_killed"`    // 容器进程是否因为超出内存限制被 kill
+	CgroupPath     string                     `json:"cgroup_path"`   // 容器在各个 subsystem 中的 cgroup 路径
+	CgroupDriver   string                     `json:"cgroup_driver"` // 创建容器 cgroup 时使用的 driver
+	ResourceConfig *subsystems.ResourceConfig `json:"resource_config"`
+	OOMScoreAdj    int                        `json:"oom_score_adj"`
+	Devices        []*DeviceMapping           `json:"devices"`      // 通过 --device 传递给容器的宿主机设备
+	ShmSize        int64                      `json:"shm_size"`     // /dev/shm 的大小，单位为字节
+	Security       *SecurityOptions           `json:"security"`     // 特权模式和需要屏蔽、只读的路径
+	TTY            bool                       `json:"tty"`          // 是否分配了伪终端，只有分配了伪终端的容器可以 attach
+	Interactive    bool                       `json:"interactive"`  // attach 时是否转发标准输入
+	NetworkMode    string                     `json:"network_mode"` // 网络名、host、none 或 container:<容器 ID>
+	Networks       []*network.Endpoint        `json:"networks"`     // 容器连接的网络，第一个是 run 时连接的网络，映射的端口在它上面
+	Hostname       string                     `json:"hostname"`
+	Domainname     string                     `json:"domainname"`
+	ExtraHosts     []string                   `json:"extra_hosts"` // --add-host 添加到 /etc/hosts 中的条目，格式为 host:ip
+	DNS            *DNSConfig                 `json:"dns"`
+	HostnamePath   string                     `json:"hostname_path"` // 生成的 /etc/hostname、/etc/hosts 和 /etc/resolv.conf 在宿主机上的路径
+	HostsPath      string                     `json:"hosts_path"`
+	ResolvConfPath string                     `json:"resolv_conf_path"`
+	Ports          []*network.PortMapping     `json:"ports"` // 宿主机到容器的端口映射
+}
+
+// ShortID 返回容器 ID 的前 12 位，用于展示
+func (c *ContainerInfo) ShortID() string {
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// Endpoint 返回容器在网络 name 上的 Endpoint，没有连接该网络时返回 nil
+func (c *ContainerInfo) Endpoint(name string) *network.Endpoint {
+	for _, ep := range c.Networks {
+		if ep.Network == name {
+			return ep
+		}
+	}
+	return nil
+}
+
+// CgroupManager 返回管理该容器 cgroup 的 Manager
+func (c *ContainerInfo) CgroupManager() (cgroup.Manager, error) {
+	return cgroup.NewManager(c.CgroupDriver, c.CgroupPath, c.ResourceConfig)
+}
+
+// NewContainerID 生成一个 64 位的随机十六进制字符串作为容器 ID
+func NewContainerID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		zlog.New().Panic("generate container id error", zap.Error(err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// RecordContainerInfo 将容器信息写入 InfoLocation/<容器 ID>/config.json，已存在则覆盖
+func RecordContainerInfo(info *ContainerInfo) error {
+	dir := filepath.Join(InfoLocation, info.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		zlog.New().Error("mkdir container info dir error", zap.String("path", dir), zap.Error(err))
+		return err
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件再 rename，避免没有加锁的读取者读到写了一半的文件
+	p := filepath.Join(dir, configName)
+	if err := ioutil.WriteFile(p+".tmp", b, 0644); err != nil {
+		zlog.New().Error("write container info error", zap.String("path", p), zap.Error(err))
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// UpdateContainerInfo 加文件锁之后重新读取容器信息并调用 fn，fn 返回 nil 时将修改写回，
+// 避免 update、pause、network connect 和容器退出等同时修改容器信息时互相覆盖
+func UpdateContainerInfo(id string, fn func(info *ContainerInfo) error) (*ContainerInfo, error) {
+	fullID, err := lookupContainerID(id)
+	if err != nil {
+		return nil, err
+	}
+	// config.json 通过 rename 替换，所以锁加在单独的文件上
+	dir := filepath.Join(InfoLocation, fullID)
+	lock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("lock %s error: %v", dir, err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	info, err := readContainerInfo(fullID)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(info); err != nil {
+		return nil, err
+	}
+	if err := RecordContainerInfo(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReadContainerInfo 读取容器信息，id 可以是完整 ID、容器名，也可以是能唯一确定容器的 ID 前缀
+func ReadContainerInfo(id string) (*ContainerInfo, error) {
+	fullID, err := lookupContainerID(id)
+	if err != nil {
+		return nil, err
+	}
+	return readContainerInfo(fullID)
+}
+
+// readContainerInfo 读取完整 ID 为 fullID 的容器的信息
+func readContainerInfo(fullID string) (*ContainerInfo, error) {
+	b, err := ioutil.ReadFile(filepath.Join(InfoLocation, fullID, configName))
+	if err != nil {
+		return nil, err
+	}
+	info := &ContainerInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, fmt.Errorf("decode container %s info error: %v", fullID, err)
+	}
+	return info, nil
+}
+
+// ListContainerInfos 返回所有容器的信息
+func ListContainerInfos() ([]*ContainerInfo, error) {
+	entries, err := ioutil.ReadDir(InfoLocation)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var infos []*ContainerInfo
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := readContainerInfo(e.Name())
+		if err != nil {
+			zlog.New().Error("read container info error", zap.String("id", e.Name()), zap.Error(err))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// DeleteContainerInfo 删除容器信息所在的目录
+func DeleteContainerInfo(id string) error {
+	dir := filepath.Join(InfoLocation, id)
+	if err := os.RemoveAll(dir); err != nil {
+		zlog.New().Error("remove container info dir error", zap.String("path", dir), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// lookupContainerID 找到完整的容器 ID，依次按照完整 ID、容器名和 ID 前缀匹配，
+// 空的 ref 和匹配到多个容器的前缀都返回错误，不会随便选择一个容器
+func lookupContainerID(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("container id or name is empty")
+	}
+	entries, err := ioutil.ReadDir(InfoLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var matched []string
+	for _, e := range entries {
+		if e.Name() == ref {
+			return ref, nil
+		}
+		if strings.HasPrefix(e.Name(), ref) {
+			matched = append(matched, e.Name())
+		}
+	}
+	for _, e := range entries {
+		if info, err := readContainerInfo(e.Name()); err == nil && info.Name != "" && info.Name == ref {
+			return e.Name(), nil
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return "", fmt.Errorf("no such container: %s", ref)
+	case 1:
+		return matched[0], nil
+	}
+	return "", fmt.Errorf("container id prefix %s is ambiguous, it matches %d containers", ref, len(matched))
+}
+
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// checkContainerName 检查容器名是否合法并且没有被其他容器使用，已经退出的容器删除之前也占用它的名字
+func checkContainerName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if !validContainerName.MatchString(name) {
+		return fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	infos, err := ListContainerInfos()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name == name {
+			return fmt.Errorf("container name %s is already in use by container %s", name, info.ShortID())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package container
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+)
+
+func TestContainerInfoStore(t *testing.T) {
+	origin := InfoLocation
+	InfoLocation = t.TempDir()
+	defer func() { InfoLocation = origin }()
+
+	if infos, err := ListContainerInfos(); err != nil || len(infos) != 0 {
+		t.Fatalf("list empty store = %v, %v", infos, err)
+	}
+
+	infos := []*ContainerInfo{
+		{ID: "abc111", Name: "web", Status: Running, Pid: 100, ResourceConfig: &subsystems.ResourceConfig{MemoryLimit: 64 << 20}},
+		{ID: "abc222", Name: "db", Status: Exited, ExitCode: 137, OOMKilled: true},
+		{ID: "def333", Status: Paused},
+	}
+	for _, info := range infos {
+		if err := RecordContainerInfo(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{"abc111", "abc111", false},
+		{"web", "abc111", false},
+		{"db", "abc222", false},
+		{"def", "def333", false},
+		{"abc2", "abc222", false},
+		// 前缀匹配到多个容器
+		{"abc", "", true},
+		{"a", "", true},
+		{"xyz", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		info, err := ReadContainerInfo(tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ReadContainerInfo(%s) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+		}
+		if err == nil && info.ID != tt.want {
+			t.Fatalf("ReadContainerInfo(%s) = %s, want %s", tt.ref, info.ID, tt.want)
+		}
+	}
+
+	info, err := ReadContainerInfo("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ExitCode != 137 || !info.OOMKilled {
+		t.Fatalf("exit state not persisted: %+v", info)
+	}
+	info, err = ReadContainerInfo("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ResourceConfig == nil || info.ResourceConfig.MemoryLimit != 64<<20 {
+		t.Fatalf("resource config not persisted: %+v", info.ResourceConfig)
+	}
+
+	// 再次写入会覆盖原来的信息
+	info.Status = Exited
+	if err := RecordContainerInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ReadContainerInfo("abc111"); err != nil || info.Status != Exited {
+		t.Fatalf("overwrite container info: %v, %v", info, err)
+	}
+
+	if err := DeleteContainerInfo("def333"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ListContainerInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, info := range list {
+		ids = append(ids, info.ID)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "abc111" || ids[1] != "abc222" {
+		t.Fatalf("ListContainerInfos = %v", ids)
+	}
+}
+
+func TestUpdateContainerInfo(t *testing.T) {
+	origin := InfoLocation
+	InfoLocation = t.TempDir()
+	defer func() { InfoLocation = origin }()
+
+	if err := RecordContainerInfo(&ContainerInfo{ID: "abc111", Name: "web", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 并发的读-改-写不会互相覆盖
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := UpdateContainerInfo("web", func(info *ContainerInfo) error {
+				info.ExtraHosts = append(info.ExtraHosts, fmt.Sprintf("host%d:10.0.0.%d", i, i))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	info, err := ReadContainerInfo("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.ExtraHosts) != 20 {
+		t.Fatalf("got %d extra hosts, want 20", len(info.ExtraHosts))
+	}
+
+	// fn 返回错误时不写回
+	_, err = UpdateContainerInfo("abc", func(info *ContainerInfo) error {
+		info.Status = Exited
+		return fmt.Errorf("abort")
+	})
+	if err == nil {
+		t.Fatal("error from fn should be returned")
+	}
+	if info, err := ReadContainerInfo("web"); err != nil || info.Status != Running {
+		t.Fatalf("container info should not be modified: %v, %v", info, err)
+	}
+	if _, err := UpdateContainerInfo("xyz", func(*ContainerInfo) error { return nil }); err == nil {
+		t.Fatal("update non-existent container should fail")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -KILL $$", 137},
+		{"kill -TERM $$", 143},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("sh", "-c", tt.script)
+		cmd.Run()
+		if got := exitCode(cmd.ProcessState); got != tt.want {
+			t.Fatalf("exitCode(%q) = %d, want %d", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestLookupContainerIDSingle(t *testing.T) {
+	origin := InfoLocation
+	InfoLocation = t.TempDir()
+	defer func() { InfoLocation = origin }()
+
+	if err := RecordContainerInfo(&ContainerInfo{ID: "abc111", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	// 只有一个容器时，空的 ref 也不能匹配到它
+	if _, err := UpdateContainerInfo("", func(info *ContainerInfo) error { return nil }); err == nil {
+		t.Fatal("empty ref should be rejected")
+	}
+	if id, err := lookupContainerID("a"); err != nil || id != "abc111" {
+		t.Fatalf("lookupContainerID(a) = %s, %v", id, err)
+	}
+}
@@ -1,31 +1,84 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"runtime"
 	"syscall"
 
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
+// initConfig 父进程通过管道传递给容器 init 进程的配置
+type initConfig struct {
+	Cmds       []string          `json:"cmds"`       // 用户命令
+	TTY        bool              `json:"tty"`        // 是否在容器中分配伪终端
+	Devices    []*DeviceMapping  `json:"devices"`    // 需要在容器 /dev 中创建的宿主机设备
+	ShmSize    int64             `json:"shm_size"`   // /dev/shm 的大小，单位为字节
+	Security   *SecurityOptions  `json:"security"`   // 特权模式和需要屏蔽、只读的路径
+	NetNSPath  string            `json:"netns_path"` // 需要加入的 network namespace，container 网络模式时使用
+	EtcFiles   map[string]string `json:"etc_files"`  // 需要 bind mount 到容器中的文件，容器中的路径 -> 宿主机上的路径
+	Hostname   string            `json:"hostname"`   // 在容器的 UTS namespace 中设置的主机名和域名
+	Domainname string            `json:"domainname"`
+}
+
 // InitProcess 初始化容器进程，为容器进程挂载 /proc 目录
 func InitProcess() error {
+	// unshare 和 setns 只对调用它们的线程生效，之后的挂载和 exec 都必须在同一个线程上执行
+	runtime.LockOSThread()
+
 	// 阻塞等待，直到父进程向管道中写入内容
-	cmds := readUserCommand()
+	config, err := readInitConfig()
+	if err != nil {
+		return err
+	}
+	cmds := config.Cmds
 	if len(cmds) == 0 {
 		zlog.New().Error("user command is nil")
 		return fmt.Errorf("user command is nil")
 	}
 
-	if err := setUpMount(); err != nil {
+	// 需要在挂载 /proc 之前加入，NetNSPath 是宿主机 /proc 中的路径；/sys 中的网络设备也属于这个 namespace
+	if config.NetNSPath != "" {
+		if err := joinNetNS(config.NetNSPath); err != nil {
+			return err
+		}
+	}
+
+	// 父进程在发送配置之前已经将容器进程加入了容器的 cgroup，此时再创建 cgroup namespace，
+	// 它的根才是容器的 cgroup，所以不在 clone 时指定 CLONE_NEWCGROUP。
+	// 4.6 之前的内核不支持 cgroup namespace，此时容器中可以看到宿主机完整的 cgroup 树
+	if cgroupNamespaceSupported() {
+		if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+			zlog.New().Error("unshare cgroup namespace error", zap.Error(err))
+			return fmt.Errorf("unshare cgroup namespace error: %v", err)
+		}
+	} else {
+		zlog.New().Warn("cgroup namespace is not supported by the kernel, skip it")
+	}
+
+	if err := setUpMount(config); err != nil {
 		return err
 	}
 
+	// 容器进程在 clone 时创建了自己的 UTS namespace，修改主机名不会影响宿主机
+	if err := setHostname(config.Hostname, config.Domainname); err != nil {
+		return err
+	}
+
+	// 伪终端需要在容器的 /dev/pts 挂载完成之后分配
+	if config.TTY {
+		if err := setUpConsole(os.NewFile(consoleFd, "console")); err != nil {
+			return err
+		}
+	}
+
 	// 从环境变量中搜索命令所在路径，比如传入的是 ls，返回 /bin/ls
 	// 这样用户就不用输入全路径了
 	p, err := exec.LookPath(cmds[0])
@@ -43,26 +96,72 @@ func InitProcess() error {
 	return nil
 }
 
-// readUserCommand 从管道中读取父进程传递的命令参数
-func readUserCommand() []string {
+// cgroupNamespaceSupported 内核是否支持 cgroup namespace
+func cgroupNamespaceSupported() bool {
+	_, err := os.Stat("/proc/self/ns/cgroup")
+	return err == nil
+}
+
+// setHostname 设置容器的主机名和域名，为空时保持不变
+func setHostname(hostname, domainname string) error {
+	if hostname != "" {
+		if err := unix.Sethostname([]byte(hostname)); err != nil {
+			zlog.New().Error("set hostname error", zap.String("hostname", hostname), zap.Error(err))
+			return fmt.Errorf("set hostname %s error: %v", hostname, err)
+		}
+	}
+	if domainname != "" {
+		if err := unix.Setdomainname([]byte(domainname)); err != nil {
+			zlog.New().Error("set domainname error", zap.String("domainname", domainname), zap.Error(err))
+			return fmt.Errorf("set domainname %s error: %v", domainname, err)
+		}
+	}
+	return nil
+}
+
+// joinNetNS 将当前线程加入 path 对应的 network namespace
+func joinNetNS(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		zlog.New().Error("open network namespace error", zap.String("path", path), zap.Error(err))
+		return err
+	}
+	defer f.Close()
+	if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		zlog.New().Error("join network namespace error", zap.String("path", path), zap.Error(err))
+		return fmt.Errorf("join network namespace %s error: %v", path, err)
+	}
+	return nil
+}
+
+// readInitConfig 从管道中读取父进程传递的配置
+func readInitConfig() (*initConfig, error) {
 	// NewFile 比较迷的一个函数，看注释也看不懂
 	pipe := os.NewFile(uintptr(3), "pipe")
 	b, err := io.ReadAll(pipe)
 	if err != nil {
-		zlog.New().Error("read command from pipe error: ", zap.Error(err))
-		return nil
+		zlog.New().Error("read init config from pipe error: ", zap.Error(err))
+		return nil, err
 	}
-	cmds := string(b)
 
-	// 将多个命令参数用空格分开
-	return strings.Split(cmds, " ")
+	// 以 json 格式传递，命令参数中包含空格时也不会被拆开
+	config := &initConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		zlog.New().Error("decode init config error", zap.Error(err))
+		return nil, err
+	}
+	return config, nil
 }
 
-// sendInitCommand 父进程发送用户命令到管道中
-func sendInitCommand(cmds []string, wp *os.File) {
-	cmd := strings.Join(cmds, " ")
-	wp.WriteString(cmd)
-	wp.Close()
+// sendInitConfig 父进程发送配置到管道中
+func sendInitConfig(config *initConfig, wp *os.File) error {
+	defer wp.Close()
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = wp.Write(b)
+	return err
 }
 
 func pivotRoot(rootPath string) error {
@@ -126,7 +225,7 @@ func pivotRoot(rootPath string) error {
 }
 
 // setUpMount 初始化容器的挂载点
-func setUpMount() error {
+func setUpMount(config *initConfig) error {
 	// 首先设置根目录为私有模式，防止影响 pivot_root
 	cmd := exec.Command("mount", "--make-rprivate", "/")
 	_, err := cmd.CombinedOutput()
@@ -143,6 +242,14 @@ func setUpMount() error {
 	}
 	zlog.New().Info("current localtion is", zap.String("path", pwd))
 
+	// /dev 需要在 pivot_root 之前准备好，之后就无法访问宿主机的设备了
+	if err := setUpDev(pwd, config); err != nil {
+		return err
+	}
+	if err := mountEtcFiles(pwd, config.EtcFiles); err != nil {
+		return err
+	}
+
 	if err := pivotRoot(pwd); err != nil {
 		return err
 	}
@@ -170,14 +277,15 @@ func setUpMount() error {
 		return fmt.Errorf("mount proc error: %v", err)
 	}
 
-	// 使用 df -hl 查看，发现有一个 tmpfs 也在挂载
-	// tmpfs是 Linux/Unix 系统上的一种基于内存的文件系统。
-	// tmpfs 可以使用您的内存或 swap 分区来存储文件。由此可见，
-	// temfs 主要存储暂存的文件。
-	if err := syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
-		zlog.New().Error("mount tmpfs error", zap.Error(err))
-		return fmt.Errorf("mount tmpfs error: %v", err)
+	security := config.Security
+	if security == nil {
+		security = &SecurityOptions{}
 	}
-
-	return nil	
+	if err := setUpSys(security.Privileged); err != nil {
+		return err
+	}
+	if err := maskPaths(security.MaskedPaths); err != nil {
+		return err
+	}
+	return readonlyPaths(security.ReadonlyPaths)
 }
@@ -0,0 +1,182 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+)
+
+// connectNetwork 将容器连接到名为 name 的网络，name 为空时连接到默认网络，
+// 只有自定义网络支持别名
+func connectNetwork(info *ContainerInfo, name string, aliases []string) (*network.Endpoint, error) {
+	if name == "" {
+		name = network.DefaultNetworkName
+	}
+	if len(aliases) > 0 && name == network.DefaultNetworkName {
+		return nil, fmt.Errorf("network-scoped aliases are only supported for user-defined networks")
+	}
+	n, err := network.LoadNetwork(name)
+	if err != nil {
+		return nil, err
+	}
+	// 容器信息在分配地址之前已经记录，正在启动的容器的地址不会被回收
+	if err := network.PruneAddresses(containerExists); err != nil {
+		zlog.New().Warn("prune addresses of removed containers error", zap.Error(err))
+	}
+	ep, err := n.Connect(info.ID, info.Pid)
+	if err != nil {
+		return nil, err
+	}
+	ep.Aliases = aliases
+	return ep, nil
+}
+
+// ConnectNetwork 为运行中的容器 id 增加一块连接到网络 name 的网卡，aliases 为容器在该网络中的别名，
+// 检查、连接和记录都在容器信息的锁中完成，同时连接多个网络时不会互相覆盖
+func ConnectNetwork(id, name string, aliases []string) error {
+	var ep *network.Endpoint
+	var fullID string
+	_, err := UpdateContainerInfo(id, func(info *ContainerInfo) error {
+		fullID = info.ID
+		if info.Status == Exited {
+			return fmt.Errorf("container %s is not running", info.ShortID())
+		}
+		if !network.IsBridgeMode(info.NetworkMode) {
+			return fmt.Errorf("container %s uses network mode %s, can not connect it to other networks", info.ShortID(), info.NetworkMode)
+		}
+		if !network.IsBridgeMode(name) {
+			return fmt.Errorf("can not connect a running container to network mode %s", name)
+		}
+		if info.Endpoint(name) != nil {
+			return fmt.Errorf("container %s is already connected to network %s", info.ShortID(), name)
+		}
+		var err error
+		if ep, err = connectNetwork(info, name, aliases); err != nil {
+			return err
+		}
+		info.Networks = append(info.Networks, ep)
+		return nil
+	})
+	// 连接之后记录容器信息失败，断开新的网卡
+	if err != nil && ep != nil {
+		network.Disconnect(fullID, ep)
+	}
+	return err
+}
+
+// DisconnectNetwork 删除运行中的容器 id 连接到网络 name 的网卡，映射的端口所在的网络不能断开
+func DisconnectNetwork(id, name string) error {
+	_, err := UpdateContainerInfo(id, func(info *ContainerInfo) error {
+		if info.Status == Exited {
+			return fmt.Errorf("container %s is not running", info.ShortID())
+		}
+		ep := info.Endpoint(name)
+		if ep == nil {
+			return fmt.Errorf("container %s is not connected to network %s", info.ShortID(), name)
+		}
+		if ep == info.Networks[0] && len(info.Ports) > 0 {
+			return fmt.Errorf("container %s has published ports on network %s, can not disconnect it", info.ShortID(), name)
+		}
+		if err := network.Disconnect(info.ID, ep); err != nil {
+			return err
+		}
+		var networks []*network.Endpoint
+		for _, e := range info.Networks {
+			if e != ep {
+				networks = append(networks, e)
+			}
+		}
+		info.Networks = networks
+		return nil
+	})
+	return err
+}
+
+// containerExists 容器信息是否还存在，容器退出时已经释放了地址，删除之前仍然认为它存在
+func containerExists(id string) bool {
+	// 无法判断时认为容器存在，不回收它的地址
+	exist, err := PathIsExist(filepath.Join(InfoLocation, id))
+	return exist || err != nil
+}
+
+// NetworkInUse 网络 name 上还有运行中的容器时返回错误，在 network.RemoveNetwork 的锁中调用
+func NetworkInUse(name string) error {
+	infos, err := ListContainerInfos()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Status != Exited && info.Endpoint(name) != nil {
+			return fmt.Errorf("network %s has running container %s connected", name, info.ShortID())
+		}
+	}
+	return nil
+}
+
+// publishPorts 为容器在 ep 上安装端口映射规则，跳过其他运行中的容器已经映射的宿主机端口，
+// 实际生效的映射记录在 info.Ports 中；读取其他容器的映射、安装规则和记录都在端口锁中完成
+func publishPorts(info *ContainerInfo, ep *network.Endpoint, ports []*network.PortMapping) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	return network.WithPortLock(func() error {
+		infos, err := ListContainerInfos()
+		if err != nil {
+			return err
+		}
+		var used []*network.PortMapping
+		for _, c := range infos {
+			if c.ID != info.ID && c.Status != Exited {
+				used = append(used, c.Ports...)
+			}
+		}
+		published, err := network.PublishPorts(info.ID, ep, ports, used)
+		if err != nil {
+			return err
+		}
+		info.Ports = published
+		if err := RecordContainerInfo(info); err != nil {
+			network.UnpublishPorts(info.ID, ep, published)
+			info.Ports = nil
+			return err
+		}
+		return nil
+	})
+}
+
+// UnpublishPorts 删除容器的端口映射规则，容器退出时已经删除过的规则会被跳过，
+// 用于 supervise 进程异常退出没有清理规则的情况
+func UnpublishPorts(info *ContainerInfo) error {
+	if len(info.Networks) == 0 || len(info.Ports) == 0 {
+		return nil
+	}
+	return network.UnpublishPorts(info.ID, info.Networks[0], info.Ports)
+}
+
+// resolveNetworkMode 检查 run --network 指定的网络模式，container 模式时将容器 ID 补全，
+// 并返回需要加入的 network namespace 的路径
+func resolveNetworkMode(mode string) (string, string, error) {
+	if mode == "" {
+		return network.DefaultNetworkName, "", nil
+	}
+	if !strings.HasPrefix(mode, network.ModeContainerPrefix) {
+		return mode, "", nil
+	}
+
+	ref := strings.TrimPrefix(mode, network.ModeContainerPrefix)
+	if ref == "" {
+		return "", "", fmt.Errorf("invalid network mode %q, format is container:<id>", mode)
+	}
+	target, err := ReadContainerInfo(ref)
+	if err != nil {
+		return "", "", err
+	}
+	if target.Status == Exited {
+		return "", "", fmt.Errorf("can not join network of container %s, it is not running", target.ShortID())
+	}
+	return network.ModeContainerPrefix + target.ID, fmt.Sprintf("/proc/%d/ns/net", target.Pid), nil
+}
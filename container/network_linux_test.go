@@ -0,0 +1,105 @@
+package container
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+)
+
+func TestResolveNetworkMode(t *testing.T) {
+	origin := InfoLocation
+	InfoLocation = t.TempDir()
+	defer func() { InfoLocation = origin }()
+
+	running := &ContainerInfo{ID: "0123456789abcdef", Pid: 42, Status: Running}
+	exited := &ContainerInfo{ID: "fedcba9876543210", Pid: 43, Status: Exited}
+	for _, info := range []*ContainerInfo{running, exited} {
+		if err := RecordContainerInfo(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		in, mode, netns string
+	}{
+		{"", "bridge", ""},
+		{"mynet", "mynet", ""},
+		{"host", "host", ""},
+		{"none", "none", ""},
+		{"container:0123", "container:" + running.ID, fmt.Sprintf("/proc/%d/ns/net", running.Pid)},
+	}
+	for _, tt := range tests {
+		mode, netns, err := resolveNetworkMode(tt.in)
+		if err != nil {
+			t.Fatalf("resolveNetworkMode(%q) error: %v", tt.in, err)
+		}
+		if mode != tt.mode || netns != tt.netns {
+			t.Fatalf("resolveNetworkMode(%q) = %q, %q, want %q, %q", tt.in, mode, netns, tt.mode, tt.netns)
+		}
+	}
+
+	for _, in := range []string{"container:", "container:fedc", "container:none"} {
+		if _, _, err := resolveNetworkMode(in); err == nil {
+			t.Fatalf("resolveNetworkMode(%q) should fail", in)
+		}
+	}
+}
+
+func TestConnectNetworkChecks(t *testing.T) {
+	origin := InfoLocation
+	InfoLocation = t.TempDir()
+	defer func() { InfoLocation = origin }()
+
+	web := &ContainerInfo{
+		ID: "0123456789abcdef", Name: "web", Status: Running, NetworkMode: "bridge",
+		Networks: []*network.Endpoint{{Network: "bridge"}, {Network: "backend"}},
+		Ports:    []*network.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: network.ProtocolTCP}},
+	}
+	host := &ContainerInfo{ID: "1111111111111111", Name: "host", Status: Running, NetworkMode: network.ModeHost}
+	old := &ContainerInfo{ID: "2222222222222222", Name: "old", Status: Exited, NetworkMode: "bridge"}
+	for _, info := range []*ContainerInfo{web, host, old} {
+		if err := RecordContainerInfo(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 这些检查在连接网络之前就会失败，容器信息保持不变
+	for _, tt := range []struct{ id, network string }{
+		{"old", "backend"},
+		{"host", "backend"},
+		{"web", network.ModeHost},
+		{"web", "backend"},
+	} {
+		if err := ConnectNetwork(tt.id, tt.network, nil); err == nil {
+			t.Fatalf("connect %s to %s should fail", tt.id, tt.network)
+		}
+	}
+	for _, tt := range []struct{ id, network string }{
+		{"old", "bridge"},
+		{"web", "frontend"},
+		{"web", "bridge"}, // 映射的端口所在的网络
+	} {
+		if err := DisconnectNetwork(tt.id, tt.network); err == nil {
+			t.Fatalf("disconnect %s from %s should fail", tt.id, tt.network)
+		}
+	}
+	info, err := ReadContainerInfo("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Networks) != 2 {
+		t.Fatalf("networks = %+v", info.Networks)
+	}
+
+	if err := NetworkInUse("backend"); err == nil {
+		t.Fatal("network with running container should be in use")
+	}
+	old.Networks = []*network.Endpoint{{Network: "legacy"}}
+	if err := RecordContainerInfo(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := NetworkInUse("legacy"); err != nil {
+		t.Fatalf("network with exited container only should not be in use: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package container
+
+import (
+	"fmt"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+)
+
+// Pause 通过 freezer 挂起容器中的所有进程，并将容器状态记录为 paused
+func Pause(id string) (*ContainerInfo, error) {
+	return UpdateContainerInfo(id, func(info *ContainerInfo) error {
+		if info.Status != Running {
+			return fmt.Errorf("container %s is not running", info.ShortID())
+		}
+
+		cg, err := info.CgroupManager()
+		if err != nil {
+			return err
+		}
+		if err := cg.Freeze(); err != nil {
+			zlog.New().Error("freeze container error", zap.String("id", info.ShortID()), zap.Error(err))
+			return err
+		}
+
+		info.Status = Paused
+		return nil
+	})
+}
+
+// Unpause 恢复容器中被挂起的所有进程，并将容器状态记录为 running
+func Unpause(id string) (*ContainerInfo, error) {
+	return UpdateContainerInfo(id, func(info *ContainerInfo) error {
+		if info.Status != Paused {
+			return fmt.Errorf("container %s is not paused", info.ShortID())
+		}
+
+		cg, err := info.CgroupManager()
+		if err != nil {
+			return err
+		}
+		if err := cg.Thaw(); err != nil {
+			zlog.New().Error("thaw container error", zap.String("id", info.ShortID()), zap.Error(err))
+			return err
+		}
+
+		info.Status = Running
+		return nil
+	})
+}
@@ -1,12 +1,18 @@
 package container
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup"
 	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
 	"go.uber.org/zap"
 )
@@ -29,9 +35,9 @@ func NewPipe() (rPipe, wPipe *os.File, err error) {
 // NewParentProcess 创建一个隔离的容器进程，但并不运行，同时创建一个管道用于
 // 进程通信，返回管道的写端，子进程拥有管道的读端，父进程通过写端向管道写入用户
 // 传入的参数，子进程通过读端来获取参数
-// tty 表示是否开启一个伪终端
+// 开启伪终端时还会返回一个 unix socket，容器进程通过它将伪终端的 master 发送给父进程
 //（疑问：是不是叫 NewChildProcess 更合适？）
-func NewParentProcess(tty bool, volume string) (cmd *exec.Cmd, wp *os.File) {
+func NewParentProcess(opts *RunOptions) (cmd *exec.Cmd, wp, console *os.File) {
 	// 自己调用自己，同时调用 init 命令（init 会调用 InitProcess）进行初始化（挂载 /proc）
 	// cmd 可以理解为一个子进程，但是还没有启动，后续调用 Run 或 Start 启动
 	cmd = exec.Command("/proc/self/exe", "init")
@@ -41,7 +47,7 @@ func NewParentProcess(tty bool, volume string) (cmd *exec.Cmd, wp *os.File) {
 	rp, wp, err := NewPipe()
 	if err != nil {
 		//zlog.New().Error("create pipe error: ", zap.Error(err))
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	// ExtraFiles 用于给新进程继承父进程中打开的文件
@@ -50,7 +56,7 @@ func NewParentProcess(tty bool, volume string) (cmd *exec.Cmd, wp *os.File) {
 	cmd.ExtraFiles = []*os.File{rp}
 
 	// 将只读层和可写层挂载到 mntPath
-	NewWorkSpace(rootPath, mntPath, volume)
+	NewWorkSpace(rootPath, mntPath, opts.Volume)
 	// 给创建出来的子进程指定容器初始化后的工作目录
 	cmd.Dir = mntPath
 
@@ -59,26 +65,74 @@ func NewParentProcess(tty bool, volume string) (cmd *exec.Cmd, wp *os.File) {
 		Cloneflags: syscall.CLONE_NEWUTS |
 			syscall.CLONE_NEWPID |
 			syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWNET |
 			syscall.CLONE_NEWIPC,
 	}
+	// host 模式使用宿主机的 network namespace，container 模式由容器进程通过 setns 加入另一个容器的
+	if opts.Network != network.ModeHost && !strings.HasPrefix(opts.Network, network.ModeContainerPrefix) {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
 
-	// 是否开启伪终端
-	if tty {
+	if opts.TTY {
+		// 伪终端在容器中分配，容器进程需要成为新会话的首进程才能设置控制终端
+		parent, child, err := newConsoleSocket()
+		if err != nil {
+			rp.Close()
+			wp.Close()
+			return nil, nil, nil
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+		cmd.SysProcAttr.Setsid = true
+		return cmd, wp, parent
+	}
+
+	// 没有伪终端时直接使用宿主机的标准输入输出，-i 时才将标准输入传递给容器
+	if opts.Interactive {
 		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 	}
-	return cmd, wp
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, wp, nil
+}
+
+// RunOptions 是 run 命令传递给 RunProcess 的容器配置
+type RunOptions struct {
+	ID           string                     // 容器 ID，为空时生成一个新的 ID
+	Name         string                     // 容器名，同一网络中的其他容器可以通过它访问该容器
+	TTY          bool                       // 是否为容器分配伪终端
+	Interactive  bool                       // 是否将标准输入传递给容器
+	Cmds         []string                   // 容器中运行的命令
+	Volume       string                     // 数据卷，格式为 /host:/container
+	Resources    *subsystems.ResourceConfig // 资源限制
+	OOMScoreAdj  int                        // 容器进程的 oom_score_adj
+	CgroupDriver string                     // 创建 cgroup 使用的 driver
+	CgroupParent string                     // 容器 cgroup 的父 cgroup
+	Devices      []*DeviceMapping           // 通过 --device 传递给容器的宿主机设备
+	ShmSize      int64                      // /dev/shm 的大小，单位为字节
+	Security     *SecurityOptions           // 特权模式和需要屏蔽、只读的路径
+	DetachKeys   []byte                     // 从容器 detach 的按键序列
+	Network      string                     // 容器的网络模式：网络名、host、none 或 container:<容器 ID>
+	Aliases      []string                   // 容器在网络中的别名，只能用于自定义网络
+	Hostname     string                     // 容器的主机名，为空时使用容器 ID 的前 12 位
+	Domainname   string                     // 容器的 NIS 域名
+	ExtraHosts   []string                   // 添加到 /etc/hosts 中的条目，格式为 host:ip
+	DNS          *DNSConfig                 // 容器的 DNS 配置
+	Ports        []*network.PortMapping     // 宿主机到容器的端口映射，HostPort 为 0 时随机分配
+}
+
+// RunProcess 运行容器进程，并等待容器进程退出；开启伪终端时容器由后台的 supervise 进程运行，
+// 当前进程只是 attach 到容器上，detach 之后直接返回，容器继续运行
+func RunProcess(opts *RunOptions) error {
+	if opts.TTY {
+		return runSupervised(opts)
+	}
+	return runContainer(opts, nil)
 }
 
-// RunProcess 运行容器进程
-func RunProcess(
-	tty bool,
-	cmds []string,
-	volume string,
-	resConf *subsystems.ResourceConfig,
-) {
+// runContainer 运行容器进程，并等待容器进程退出，ready 不为 nil 时在容器的 attach socket
+// 可以连接之后调用
+func runContainer(opts *RunOptions, ready func()) error {
+	tty, cmds, volume, resConf := opts.TTY, opts.Cmds, opts.Volume, opts.Resources
+
 	zlog.New().Info(
 		"run process",
 		zap.Strings("all command", cmds),
@@ -87,49 +141,307 @@ func RunProcess(
 
 	zlog.New().Info(
 		"resource config",
-		zap.String("memory limit", resConf.MemoryLimit),
+		zap.Int64("memory limit", resConf.MemoryLimit),
+		zap.Int64("memory swap limit", resConf.MemorySwap),
+		zap.Int64("memory reservation", resConf.MemoryReservation),
+		zap.Int64("kernel memory limit", resConf.KernelMemory),
 		zap.String("cpushare limit", resConf.CPUShare),
 		zap.String("cpuset limit", resConf.CPUSet),
+		zap.Strings("device rules", resConf.DeviceRules),
 	)
 
+	id := opts.ID
+	if id == "" {
+		id = NewContainerID()
+	}
+	if err := checkContainerName(opts.Name); err != nil {
+		return err
+	}
+	networkMode, netNSPath, err := resolveNetworkMode(opts.Network)
+	if err != nil {
+		return err
+	}
+	cgroupPath, err := cgroup.ContainerCgroupPath(opts.CgroupDriver, opts.CgroupParent, id)
+	if err != nil {
+		return err
+	}
+	cg, err := cgroup.NewManager(opts.CgroupDriver, cgroupPath, resConf)
+	if err != nil {
+		return err
+	}
+
 	// 因为 NewParentProcess 里面会调用 NewWorkSpace 进行挂载，所以必须在程序结束时
 	// 执行 DeleteWorkSpace 取消挂载，不然会有一些文件任然处于挂载状态，产生一些错误，
-	// 为了达到目的，使用 defer 进行注册
+	// 为了达到目的，使用 defer 进行注册，所以下面遇到错误时只能 return，不能直接 os.Exit
 	defer func() {
 		// 容器执行完成后，把容器对应的 write layer 删除
 		if err := DeleteWorkSpace(rootPath, mntPath, volume); err != nil {
-			os.Exit(-1)
+			zlog.New().Error("delete workspace error", zap.Error(err))
 		}
 	}()
 
-
-	p, wp := NewParentProcess(tty, volume)
-	// 运行并等待 cmd 执行完成
-	if err := p.Start(); err != nil {
+	p, wp, consoleSocket := NewParentProcess(opts)
+	if p == nil {
+		return fmt.Errorf("create parent process error")
+	}
+	// 启动容器进程，此时容器进程会阻塞在读取管道，直到父进程发送用户命令
+	err = p.Start()
+	// 传递给容器进程的文件在父进程中不再需要，关闭后容器进程退出时父进程才能读到 EOF
+	for _, f := range p.ExtraFiles {
+		f.Close()
+	}
+	if err != nil {
 		zlog.New().Error("run process error", zap.Error(err))
-		os.Exit(-1)
+		return err
+	}
+	if consoleSocket != nil {
+		defer consoleSocket.Close()
 	}
 
-	sendInitCommand(cmds, wp)
+	info := &ContainerInfo{
+		ID:             id,
+		Name:           opts.Name,
+		Pid:            p.Process.Pid,
+		Command:        cmds,
+		CreatedTime:    time.Now().Format("2006-01-02 15:04:05"),
+		Status:         Running,
+		CgroupPath:     cgroupPath,
+		CgroupDriver:   opts.CgroupDriver,
+		ResourceConfig: resConf,
+		OOMScoreAdj:    opts.OOMScoreAdj,
+		Devices:        opts.Devices,
+		ShmSize:        opts.ShmSize,
+		Security:       opts.Security,
+		TTY:            tty,
+		Interactive:    opts.Interactive,
+		NetworkMode:    networkMode,
+		Hostname:       opts.Hostname,
+		Domainname:     opts.Domainname,
+		ExtraHosts:     opts.ExtraHosts,
+		DNS:            opts.DNS,
+	}
+	if info.Hostname == "" {
+		info.Hostname = info.ShortID()
+		// host 模式与宿主机使用相同的主机名
+		if networkMode == network.ModeHost {
+			if hostname, err := os.Hostname(); err == nil {
+				info.Hostname = hostname
+			}
+		}
+	}
+	if err := RecordContainerInfo(info); err != nil {
+		p.Process.Kill()
+		p.Wait()
+		return err
+	}
 
-	cg := cgroup.NewCgroupManager("cgroup-test", resConf)
 	defer func() {
 		if err := cg.RemoveAll(); err != nil {
-			os.Exit(-1)
+			zlog.New().Error("remove cgroup error", zap.Error(err))
 		}
 	}()
 
-	// 忽略错误判断，函数内部会打印日志，如果遇到错误直接 return，那么后面的 DeleteWorkSpace
-	// 会无法执行，会产生各种诡异的问题
+	if err := setUpProcess(p, cg, opts.OOMScoreAdj); err != nil {
+		p.Process.Kill()
+		p.Wait()
+		info.Status = Exited
+		RecordContainerInfo(info)
+		return err
+	}
+
+	// 网络同样需要在用户命令运行之前配置好，host 和 container 模式不需要配置
+	if networkMode == network.ModeNone {
+		if err := network.SetUpLoopback(info.Pid); err != nil {
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+	} else if network.IsBridgeMode(networkMode) {
+		ep, err := connectNetwork(info, networkMode, opts.Aliases)
+		if err != nil {
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+		// 容器运行期间可能通过 network connect 连接了其他网络，退出之后 info 会被更新为磁盘上的信息
+		defer func() {
+			for _, ep := range info.Networks {
+				if err := network.Disconnect(id, ep); err != nil {
+					zlog.New().Error("disconnect container network error", zap.String("network", ep.Network), zap.Error(err))
+				}
+			}
+		}()
+		info.Networks = []*network.Endpoint{ep}
+		if err := publishPorts(info, ep, opts.Ports); err != nil {
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+		// 在 Disconnect 之前执行，删除规则时容器的地址还没有被释放
+		ports := info.Ports
+		defer func() {
+			if err := network.UnpublishPorts(id, ep, ports); err != nil {
+				zlog.New().Error("unpublish container ports error", zap.Error(err))
+			}
+		}()
+		if err := RecordContainerInfo(info); err != nil {
+			p.Process.Kill()
+			p.Wait()
+			return err
+		}
+	}
+
+	etcFiles, upstreams, err := setUpEtcFiles(info, opts.ExtraHosts, opts.DNS)
+	if err == nil {
+		err = RecordContainerInfo(info)
+	}
+	if err != nil {
+		p.Process.Kill()
+		p.Wait()
+		info.Status = Exited
+		RecordContainerInfo(info)
+		return err
+	}
+	if useEmbeddedDNS(info) {
+		dnsServer, err := startResolver(info, upstreams)
+		if err != nil {
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+		defer dnsServer.Close()
+	}
+
+	oomCh, err := cg.NotifyOOM()
+	if err != nil {
+		zlog.New().Warn("watch container oom event error", zap.Error(err))
+	} else {
+		go func() {
+			for range oomCh {
+				zlog.New().Warn("container is out of memory", zap.String("id", info.ShortID()))
+			}
+		}()
+	}
+
+	// cgroup 设置完成后再发送初始化配置，保证用户进程从一开始就受到资源限制
+	config := &initConfig{
+		Cmds:       cmds,
+		TTY:        tty,
+		Devices:    opts.Devices,
+		ShmSize:    opts.ShmSize,
+		Security:   opts.Security,
+		NetNSPath:  netNSPath,
+		EtcFiles:   etcFiles,
+		Hostname:   info.Hostname,
+		Domainname: info.Domainname,
+	}
+	if err := sendInitConfig(config, wp); err != nil {
+		zlog.New().Error("send init config error", zap.Error(err))
+		p.Process.Kill()
+		p.Wait()
+		info.Status = Exited
+		RecordContainerInfo(info)
+		return err
+	}
+
+	if consoleSocket != nil {
+		// 容器进程完成挂载之后才会发送伪终端的 master，初始化失败时对端关闭，这里返回 EOF
+		master, err := recvFd(consoleSocket)
+		if err != nil {
+			zlog.New().Error("receive pty master error", zap.Error(err))
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+		srv, err := newAttachServer(AttachSocketPath(id), master)
+		if err != nil {
+			master.Close()
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+		defer srv.Close()
+		if ready != nil {
+			ready()
+		}
+		// 容器 init 进程在 exec 用户命令之前等待 attach 客户端连接，否则客户端连接之前的输出会丢失
+		if !srv.waitAttached(attachWaitTimeout) {
+			zlog.New().Warn("no client attached to container, start it anyway", zap.String("id", info.ShortID()))
+		}
+		if err := startConsole(consoleSocket); err != nil {
+			zlog.New().Error("start container console error", zap.Error(err))
+			p.Process.Kill()
+			p.Wait()
+			info.Status = Exited
+			RecordContainerInfo(info)
+			return err
+		}
+	} else if ready != nil {
+		ready()
+	}
+
+	waitErr := p.Wait()
+	oomKilled, err := cg.OOMKilled()
+	if err != nil {
+		zlog.New().Warn("get container oom status error", zap.Error(err))
+	}
+	// 容器运行期间资源限制和网络可能被修改过，在锁中以磁盘上的信息为准修改状态
+	latest, err := UpdateContainerInfo(info.ID, func(latest *ContainerInfo) error {
+		latest.Status = Exited
+		latest.ExitCode = exitCode(p.ProcessState)
+		if oomKilled {
+			latest.OOMKilled = true
+			zlog.New().Error(
+				"container was killed because it ran out of memory",
+				zap.String("id", latest.ShortID()),
+				zap.Int64("memory limit", latest.ResourceConfig.MemoryLimit),
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// defer 中以最新的网络断开连接，network connect 增加的网卡也会被删除，已经断开的不会重复释放地址
+	*info = *latest
+	return waitErr
+}
+
+// exitCode 返回进程的退出码，被信号 kill 的进程和 docker 一样返回 128+信号值
+func exitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+// setUpProcess 将容器进程加入 cgroup，并设置 oom_score_adj
+func setUpProcess(p *exec.Cmd, cg cgroup.Manager, oomScoreAdj int) error {
 	if err := cg.SetAll(); err != nil {
-		os.Exit(-1)
+		return err
 	}
 	if err := cg.ApplyAll(int64(p.Process.Pid)); err != nil {
-		os.Exit(-1)
+		return err
 	}
-	if err := p.Wait(); err != nil {
-		os.Exit(-1)
+	// 容器进程通过 exec 运行用户命令，oom_score_adj 会被保留下来
+	if oomScoreAdj != 0 {
+		f := fmt.Sprintf("/proc/%d/oom_score_adj", p.Process.Pid)
+		if err := ioutil.WriteFile(f, []byte(strconv.Itoa(oomScoreAdj)), 0644); err != nil {
+			zlog.New().Error("set oom_score_adj error", zap.Int("pid", p.Process.Pid), zap.Error(err))
+			return err
+		}
 	}
-	// 执行完成后，退出进程
-	os.Exit(-1)
+	return nil
 }
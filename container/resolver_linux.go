@@ -0,0 +1,86 @@
+package container
+
+import (
+	"net"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+	"github.com/YOUSEEBIGGIRL/fakedocke/resolver"
+)
+
+// useEmbeddedDNS 判断容器是否使用内置 DNS 服务器，与 docker 相同，只有连接到自定义网络的容器
+// 可以通过名字访问同一网络中的其他容器，默认网络中的容器直接使用宿主机的 DNS 服务器
+func useEmbeddedDNS(info *ContainerInfo) bool {
+	return network.IsBridgeMode(info.NetworkMode) && info.NetworkMode != network.DefaultNetworkName
+}
+
+// startResolver 在容器的 network namespace 中启动内置 DNS 服务器，监听 resolver.Address 的 53 端口，
+// 查询由当前进程处理，容器中的进程无法影响它
+func startResolver(info *ContainerInfo, upstreams []string) (*resolver.Server, error) {
+	udp, tcp, err := network.ListenInNetNS(info.Pid, net.JoinHostPort(resolver.Address, "53"))
+	if err != nil {
+		return nil, err
+	}
+	id := info.ID
+	s := resolver.New(udp, tcp, upstreams, func(name string) ([]net.IP, bool) {
+		return lookupContainerName(id, name)
+	})
+	s.Serve()
+	return s, nil
+}
+
+// lookupContainerName 在容器 id 连接的自定义网络中查找名字、短 ID 或别名为 name 的运行中的容器，
+// 返回它们在这些网络中的地址；name 也可以带上网络名，比如 web.mynet。
+// 每次查询都读取磁盘上的容器信息，运行期间通过 network connect 连接的网络也能查到
+func lookupContainerName(id, name string) ([]net.IP, bool) {
+	infos, err := ListContainerInfos()
+	if err != nil {
+		return nil, false
+	}
+	networks := make(map[string]bool)
+	for _, info := range infos {
+		if info.ID != id {
+			continue
+		}
+		for _, ep := range info.Networks {
+			if ep.Network != network.DefaultNetworkName {
+				networks[ep.Network] = true
+			}
+		}
+	}
+
+	var ips []net.IP
+	found := false
+	for _, info := range infos {
+		if info.Status == Exited {
+			continue
+		}
+		for _, ep := range info.Networks {
+			if !networks[ep.Network] || !endpointHasName(info, ep, name) {
+				continue
+			}
+			found = true
+			for _, addr := range []string{ep.IPAddress, ep.IPv6Address} {
+				if ip, _, err := net.ParseCIDR(addr); err == nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+	return ips, found
+}
+
+// endpointHasName 判断容器在网络 ep 上是否可以通过 name 访问
+func endpointHasName(info *ContainerInfo, ep *network.Endpoint, name string) bool {
+	names := append([]string{info.Name, info.ShortID()}, ep.Aliases...)
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		n = strings.ToLower(n)
+		if name == n || name == n+"."+strings.ToLower(ep.Network) {
+			return true
+		}
+	}
+	return false
+}
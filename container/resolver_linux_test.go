@@ -0,0 +1,86 @@
+package container
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/network"
+)
+
+func TestLookupContainerName(t *testing.T) {
+	origin := InfoLocation
+	InfoLocation = t.TempDir()
+	defer func() { InfoLocation = origin }()
+
+	infos := []*ContainerInfo{
+		{
+			ID: "aaaaaaaaaaaaaaaa", Name: "client", Status: Running,
+			Networks: []*network.Endpoint{{Network: "frontend", IPAddress: "172.19.0.2/16"}},
+		},
+		{
+			ID: "bbbbbbbbbbbbbbbb", Name: "web", Status: Running,
+			Networks: []*network.Endpoint{
+				{Network: "frontend", IPAddress: "172.19.0.3/16", IPv6Address: "fd00:19::3/64", Aliases: []string{"api"}},
+				{Network: "backend", IPAddress: "172.20.0.2/16"},
+			},
+		},
+		{
+			ID: "cccccccccccccccc", Name: "db", Status: Running,
+			Networks: []*network.Endpoint{{Network: "backend", IPAddress: "172.20.0.3/16"}},
+		},
+		{
+			ID: "dddddddddddddddd", Name: "old", Status: Exited,
+			Networks: []*network.Endpoint{{Network: "frontend", IPAddress: "172.19.0.4/16"}},
+		},
+	}
+	for _, info := range infos {
+		if err := RecordContainerInfo(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+		ok   bool
+	}{
+		{"web", "172.19.0.3 fd00:19::3", true},
+		{"api", "172.19.0.3 fd00:19::3", true},
+		{"web.frontend", "172.19.0.3 fd00:19::3", true},
+		{"bbbbbbbbbbbb", "172.19.0.3 fd00:19::3", true},
+		{"client", "172.19.0.2", true},
+		// 不在同一网络中的容器和已经退出的容器无法解析
+		{"db", "", false},
+		{"old", "", false},
+		{"web.backend", "", false},
+		{"example.com", "", false},
+	}
+	for _, tt := range tests {
+		ips, ok := lookupContainerName("aaaaaaaaaaaaaaaa", tt.name)
+		if ok != tt.ok {
+			t.Fatalf("lookup %s: ok = %v, want %v", tt.name, ok, tt.ok)
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if tt.ok && strings.Join(got, " ") != tt.ip {
+			t.Fatalf("lookup %s = %v, want %s", tt.name, ips, tt.ip)
+		}
+	}
+
+	// 容器名也可以用来引用容器
+	info, err := ReadContainerInfo("db")
+	if err != nil || info.ID != "cccccccccccccccc" {
+		t.Fatalf("read container info by name: %v, %v", info, err)
+	}
+	if err := checkContainerName("web"); err == nil {
+		t.Fatal("duplicate container name should be rejected")
+	}
+	if err := checkContainerName("-bad"); err == nil {
+		t.Fatal("invalid container name should be rejected")
+	}
+	if err := checkContainerName("new_web.1"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,256 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const cgroupfsMountPoint = "/sys/fs/cgroup"
+
+// setUpSys 在 pivot_root 之后挂载 /sys 和 /sys/fs/cgroup，非特权模式下都是只读的，
+// 容器 init 进程已经在自己的 cgroup namespace 中，cgroupfs 中只能看到容器自己的 cgroup
+func setUpSys(privileged bool) error {
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	if !privileged {
+		flags |= unix.MS_RDONLY
+	}
+
+	if err := os.MkdirAll("/sys", 0755); err != nil {
+		return fmt.Errorf("mkdir /sys error: %v", err)
+	}
+	// 只有在容器自己的 network namespace 中才能挂载 sysfs，/sys/class/net 中只有容器的网卡
+	if err := unix.Mount("sysfs", "/sys", "sysfs", flags, ""); err != nil {
+		zlog.New().Error("mount sysfs error", zap.Error(err))
+		return fmt.Errorf("mount sysfs error: %v", err)
+	}
+	return setUpCgroupfs(flags)
+}
+
+// cgroupHierarchy 对应 /proc/self/cgroup 中的一行：<hierarchy ID>:<controllers>:<path>
+type cgroupHierarchy struct {
+	ID          string
+	Controllers string // 比如 cpu,cpuacct、name=systemd，cgroup v2 中为空
+}
+
+// setUpCgroupfs 挂载 cgroupfs，cgroup v2 直接挂载 cgroup2，cgroup v1 与宿主机的布局相同：
+// 在 /sys/fs/cgroup 上挂载 tmpfs，每个 hierarchy 挂载到以它的 controllers 命名的子目录中，
+// 对 cpu,cpuacct 这样合并挂载的 hierarchy 创建 cpu 和 cpuacct 两个符号链接
+func setUpCgroupfs(flags uintptr) error {
+	// pivot_root 之后已经看不到宿主机的挂载点了，通过 /proc/self/cgroup 判断 cgroup 的版本
+	hierarchies, err := readCgroupHierarchies()
+	if err != nil {
+		return err
+	}
+	if len(hierarchies) == 1 && hierarchies[0].ID == "0" {
+		if err := unix.Mount("cgroup2", cgroupfsMountPoint, "cgroup2", flags, ""); err != nil {
+			zlog.New().Error("mount cgroup2 error", zap.Error(err))
+			return fmt.Errorf("mount cgroup2 on %s error: %v", cgroupfsMountPoint, err)
+		}
+		return nil
+	}
+
+	// 先以读写方式挂载 tmpfs，创建好子目录之后再重新挂载为只读
+	tmpfsFlags := flags &^ unix.MS_RDONLY
+	if err := unix.Mount("tmpfs", cgroupfsMountPoint, "tmpfs", tmpfsFlags, "mode=755"); err != nil {
+		zlog.New().Error("mount tmpfs error", zap.String("target", cgroupfsMountPoint), zap.Error(err))
+		return fmt.Errorf("mount tmpfs on %s error: %v", cgroupfsMountPoint, err)
+	}
+	for _, h := range hierarchies {
+		// hybrid 模式下的 cgroup v2 hierarchy，容器不需要
+		if h.Controllers == "" {
+			continue
+		}
+		name := strings.TrimPrefix(h.Controllers, "name=")
+		target := filepath.Join(cgroupfsMountPoint, name)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("mkdir %s error: %v", target, err)
+		}
+		data := h.Controllers
+		if strings.HasPrefix(data, "name=") {
+			// 命名的 hierarchy 没有绑定任何 controller
+			data = "none," + data
+		}
+		if err := unix.Mount("cgroup", target, "cgroup", flags, data); err != nil {
+			zlog.New().Error("mount cgroup error", zap.String("target", target), zap.Error(err))
+			return fmt.Errorf("mount cgroup %s error: %v", h.Controllers, err)
+		}
+		if controllers := strings.Split(name, ","); len(controllers) > 1 {
+			for _, c := range controllers {
+				if err := os.Symlink(name, filepath.Join(cgroupfsMountPoint, c)); err != nil && !os.IsExist(err) {
+					return fmt.Errorf("create symlink %s error: %v", c, err)
+				}
+			}
+		}
+	}
+	if tmpfsFlags != flags {
+		if err := unix.Mount("", cgroupfsMountPoint, "", flags|unix.MS_REMOUNT, "mode=755"); err != nil {
+			return fmt.Errorf("remount %s readonly error: %v", cgroupfsMountPoint, err)
+		}
+	}
+	return nil
+}
+
+// readCgroupHierarchies 读取当前进程所在的 cgroup hierarchy
+func readCgroupHierarchies() ([]*cgroupHierarchy, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCgroupHierarchies(f)
+}
+
+// parseCgroupHierarchies 解析 /proc/<pid>/cgroup 的内容
+func parseCgroupHierarchies(r io.Reader) ([]*cgroupHierarchy, error) {
+	var hierarchies []*cgroupHierarchy
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid line %q in /proc/self/cgroup", scanner.Text())
+		}
+		hierarchies = append(hierarchies, &cgroupHierarchy{ID: parts[0], Controllers: parts[1]})
+	}
+	return hierarchies, scanner.Err()
+}
+
+// maskPaths 屏蔽 paths：文件上 bind mount /dev/null，目录上挂载只读的 tmpfs，不存在的路径直接跳过
+func maskPaths(paths []string) error {
+	for _, p := range paths {
+		err := unix.Mount("/dev/null", p, "", unix.MS_BIND, "")
+		if err == unix.ENOTDIR || err == unix.EISDIR {
+			err = unix.Mount("tmpfs", p, "tmpfs", unix.MS_RDONLY, "")
+		}
+		if err != nil && !os.IsNotExist(err) {
+			zlog.New().Error("mask path error", zap.String("path", p), zap.Error(err))
+			return fmt.Errorf("mask path %s error: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// readonlyPaths 将 paths 重新 bind mount 为只读，不存在的路径直接跳过
+func readonlyPaths(paths []string) error {
+	for _, p := range paths {
+		if err := unix.Mount(p, p, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			zlog.New().Error("bind mount readonly path error", zap.String("path", p), zap.Error(err))
+			return fmt.Errorf("bind mount %s error: %v", p, err)
+		}
+		flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+		if err := unix.Mount("", p, "", flags, ""); err != nil {
+			// user namespace 中不能去掉原挂载点上锁定的 nosuid 等标志，需要带上它们重新挂载
+			var st unix.Statfs_t
+			if err != unix.EPERM || unix.Statfs(p, &st) != nil {
+				return fmt.Errorf("remount %s readonly error: %v", p, err)
+			}
+			flags |= uintptr(st.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+			if err := unix.Mount("", p, "", flags, ""); err != nil {
+				return fmt.Errorf("remount %s readonly error: %v", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mountEtcFiles 在 pivot_root 之前将宿主机上生成的文件 bind mount 到 rootfs 中，
+// 所在目录通过 secureJoin 在 rootfs 中解析，镜像中的文件本身是符号链接时先将它删除，
+// 否则 bind mount 会跟随符号链接挂载到宿主机的路径上
+func mountEtcFiles(rootfs string, files map[string]string) error {
+	for dst, src := range files {
+		target, err := secureJoinParent(rootfs, dst)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return fmt.Errorf("remove symlink %s error: %v", target, err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("mkdir %s error: %v", filepath.Dir(target), err)
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("create %s error: %v", target, err)
+		}
+		f.Close()
+		if err := unix.Mount(src, target, "", unix.MS_BIND, ""); err != nil {
+			zlog.New().Error("bind mount file error", zap.String("source", src), zap.String("target", target), zap.Error(err))
+			return fmt.Errorf("bind mount %s to %s error: %v", src, target, err)
+		}
+	}
+	return nil
+}
+
+// maxSymlinks 解析路径时最多跟随的符号链接数量，与内核的限制相同
+const maxSymlinks = 40
+
+// secureJoin 将容器中的路径 unsafePath 拼接到 root 下，并逐级解析其中已经存在的符号链接：
+// 绝对路径的符号链接相对于 root 解析，.. 最多回到 root，所以返回的路径一定在 root 下，
+// 不存在的部分直接拼接。在 pivot_root 之前操作镜像中的路径时需要先经过它，
+// 防止镜像中的符号链接（比如 /dev -> /etc）让挂载或 mknod 落到宿主机上
+func secureJoin(root, unsafePath string) (string, error) {
+	resolved := "/"
+	remaining := unsafePath
+	links := 0
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			part, remaining = remaining, ""
+		} else {
+			part, remaining = remaining[:i], remaining[i+1:]
+		}
+		if part == "" || part == "." {
+			continue
+		}
+
+		// filepath.Join 会清理 ..，并且不会超出 /
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "securejoin", Path: unsafePath, Err: unix.ELOOP}
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		remaining = dest + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// secureJoinParent 只解析 unsafePath 所在的目录，最后一级原样拼接，用于之后要创建的文件和符号链接
+func secureJoinParent(root, unsafePath string) (string, error) {
+	dir, err := secureJoin(root, filepath.Dir(filepath.Join("/", unsafePath)))
+	if err != nil {
+		return "", fmt.Errorf("resolve %s in rootfs error: %v", unsafePath, err)
+	}
+	return filepath.Join(dir, filepath.Base(unsafePath)), nil
+}
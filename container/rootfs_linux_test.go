@@ -0,0 +1,204 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc", "usr/lib", "var"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"dev":      "/etc",            // 绝对路径的符号链接相对于 rootfs 解析
+		"lib":      "usr/lib",         // 相对路径的符号链接
+		"escape":   "../../../../tmp", // .. 不能超出 rootfs
+		"var/run":  "../run",
+		"loop":     "loop2",
+		"loop2":    "loop",
+		"etc/host": "/../../etc/hostname",
+	}
+	for name, dest := range links {
+		if err := os.Symlink(dest, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/dev/null", "/etc/null"},
+		{"dev/pts/../shm", "/etc/shm"},
+		{"/lib/libc.so", "/usr/lib/libc.so"},
+		{"/escape/passwd", "/tmp/passwd"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/var/run/docker.sock", "/run/docker.sock"},
+		{"/etc/host", "/etc/hostname"},
+		{"/not/exist/../file", "/not/file"},
+	}
+	for _, tt := range tests {
+		got, err := secureJoin(root, tt.path)
+		if err != nil {
+			t.Fatalf("secureJoin(%q) error: %v", tt.path, err)
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Fatalf("secureJoin(%q) = %s, want %s", tt.path, got, want)
+		}
+	}
+
+	if _, err := secureJoin(root, "/loop/file"); err == nil {
+		t.Fatal("symlink loop should fail")
+	}
+
+	// secureJoinParent 不解析最后一级，用于之后要替换的文件
+	got, err := secureJoinParent(root, "/etc/host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "etc/host"); got != want {
+		t.Fatalf("secureJoinParent = %s, want %s", got, want)
+	}
+}
+
+func TestParseCgroupHierarchies(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []cgroupHierarchy
+		wantErr bool
+	}{
+		{
+			name:    "unified",
+			content: "0::/fakedocker/abc\n",
+			want:    []cgroupHierarchy{{ID: "0"}},
+		},
+		{
+			name:    "v1",
+			content: "12:cpu,cpuacct:/fakedocker/abc\n3:memory:/fakedocker/abc\n1:name=systemd:/user.slice\n",
+			want:    []cgroupHierarchy{{"12", "cpu,cpuacct"}, {"3", "memory"}, {"1", "name=systemd"}},
+		},
+		{
+			name:    "hybrid",
+			content: "4:pids:/\n0::/init.scope\n",
+			want:    []cgroupHierarchy{{"4", "pids"}, {"0", ""}},
+		},
+		{
+			// cgroup 路径中也可能包含冒号
+			name:    "colon in path",
+			content: "0::/a:b\n",
+			want:    []cgroupHierarchy{{ID: "0"}},
+		},
+		{name: "empty", content: ""},
+		{name: "invalid", content: "0:/\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCgroupHierarchies(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d hierarchies, want %d", len(got), len(tt.want))
+			}
+			for i, h := range got {
+				if *h != tt.want[i] {
+					t.Fatalf("hierarchy %d = %+v, want %+v", i, *h, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// inMountNamespace 在新的 mount namespace 中执行 fn，挂载不会影响宿主机，需要 root 权限
+func inMountNamespace(t *testing.T, fn func() error) {
+	if os.Getuid() != 0 {
+		t.Skip("mount namespace requires root")
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		// 不调用 UnlockOSThread，goroutine 退出时线程随之退出，新的 mount namespace 不会被其他 goroutine 使用
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+			errCh <- fmt.Errorf("unshare mount namespace error: %v", err)
+			return
+		}
+		if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			errCh <- fmt.Errorf("make / private error: %v", err)
+			return
+		}
+		errCh <- fn()
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaskPaths(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "kcore")
+	sub := filepath.Join(dir, "acpi")
+	if err := ioutil.WriteFile(file, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sub, "tables"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	inMountNamespace(t, func() error {
+		if err := maskPaths([]string{file, sub, filepath.Join(dir, "not-exist")}); err != nil {
+			return err
+		}
+		// 文件上挂载了 /dev/null，读出来是空的
+		if data, err := ioutil.ReadFile(file); err != nil || len(data) != 0 {
+			return fmt.Errorf("masked file content = %q, %v", data, err)
+		}
+		// 目录上挂载了只读的空 tmpfs
+		entries, err := ioutil.ReadDir(sub)
+		if err != nil || len(entries) != 0 {
+			return fmt.Errorf("masked dir entries = %d, %v", len(entries), err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sub, "x"), nil, 0644); err == nil {
+			return fmt.Errorf("masked dir should be readonly")
+		}
+		return nil
+	})
+}
+
+func TestReadonlyPaths(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sys")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inMountNamespace(t, func() error {
+		if err := readonlyPaths([]string{sub, filepath.Join(dir, "not-exist")}); err != nil {
+			return err
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(sub, "file")); err != nil || string(data) != "data" {
+			return fmt.Errorf("readonly file content = %q, %v", data, err)
+		}
+		err := ioutil.WriteFile(filepath.Join(sub, "file"), nil, 0644)
+		if !errors.Is(err, unix.EROFS) {
+			return fmt.Errorf("write to readonly path error = %v, want EROFS", err)
+		}
+		// 只读的只是 sub，它的父目录仍然可写
+		return ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	})
+}
@@ -0,0 +1,106 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMaskedPaths 容器中默认屏蔽的路径，文件上 bind mount /dev/null，目录上挂载只读的 tmpfs，
+// 避免容器读取宿主机内核的敏感信息
+var DefaultMaskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+// DefaultReadonlyPaths 容器中默认只读的路径，避免容器修改宿主机的内核参数
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// SecurityOptions 由 --privileged 和 --security-opt 得到的挂载限制
+type SecurityOptions struct {
+	Privileged    bool     `json:"privileged"`     // 特权模式，不做任何屏蔽，/sys 和 cgroupfs 可写，可以访问所有设备
+	MaskedPaths   []string `json:"masked_paths"`   // 需要屏蔽的路径
+	ReadonlyPaths []string `json:"readonly_paths"` // 需要只读挂载的路径
+}
+
+// ParseSecurityOpts 在默认的屏蔽路径和只读路径的基础上应用 --security-opt，支持：
+//
+//	systempaths=unconfined 不屏蔽任何路径，也不设置只读路径
+//	mask=<path>            额外屏蔽 path
+//	unmask=<path>          不屏蔽 path，也不将其设置为只读
+//	readonly=<path>        额外将 path 设置为只读
+//
+// 特权模式下忽略所有的路径限制
+func ParseSecurityOpts(opts []string, privileged bool) (*SecurityOptions, error) {
+	s := &SecurityOptions{Privileged: privileged}
+	if privileged {
+		return s, nil
+	}
+	s.MaskedPaths = append(s.MaskedPaths, DefaultMaskedPaths...)
+	s.ReadonlyPaths = append(s.ReadonlyPaths, DefaultReadonlyPaths...)
+
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid --security-opt %q, format is key=value", opt)
+		}
+		key, value := kv[0], kv[1]
+		if key == "systempaths" {
+			if value != "unconfined" {
+				return nil, fmt.Errorf("invalid --security-opt %q, only systempaths=unconfined is supported", opt)
+			}
+			s.MaskedPaths, s.ReadonlyPaths = nil, nil
+			continue
+		}
+
+		if !filepath.IsAbs(value) {
+			return nil, fmt.Errorf("invalid --security-opt %q, path must be absolute", opt)
+		}
+		p := filepath.Clean(value)
+		switch key {
+		case "mask":
+			s.MaskedPaths = appendPath(s.MaskedPaths, p)
+		case "unmask":
+			s.MaskedPaths = removePath(s.MaskedPaths, p)
+			s.ReadonlyPaths = removePath(s.ReadonlyPaths, p)
+		case "readonly":
+			s.ReadonlyPaths = appendPath(s.ReadonlyPaths, p)
+		default:
+			return nil, fmt.Errorf("unknown --security-opt %q", opt)
+		}
+	}
+	return s, nil
+}
+
+func appendPath(paths []string, p string) []string {
+	for _, v := range paths {
+		if v == p {
+			return paths
+		}
+	}
+	return append(paths, p)
+}
+
+func removePath(paths []string, p string) []string {
+	var result []string
+	for _, v := range paths {
+		if v != p {
+			result = append(result, v)
+		}
+	}
+	return result
+}
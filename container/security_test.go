@@ -0,0 +1,55 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSecurityOpts(t *testing.T) {
+	s, err := ParseSecurityOpts(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.MaskedPaths, DefaultMaskedPaths) || !reflect.DeepEqual(s.ReadonlyPaths, DefaultReadonlyPaths) {
+		t.Fatalf("default security options = %+v", s)
+	}
+
+	s, err = ParseSecurityOpts([]string{"unmask=/proc/kcore/", "unmask=/proc/sys", "mask=/proc/cpuinfo", "mask=/proc/keys", "readonly=/proc/driver"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(s.MaskedPaths, "/proc/kcore") || contains(s.ReadonlyPaths, "/proc/sys") {
+		t.Fatalf("unmasked paths still restricted: %+v", s)
+	}
+	if !contains(s.MaskedPaths, "/proc/cpuinfo") || !contains(s.ReadonlyPaths, "/proc/driver") {
+		t.Fatalf("extra paths not restricted: %+v", s)
+	}
+	if len(s.MaskedPaths) != len(DefaultMaskedPaths) {
+		t.Fatalf("masked paths = %v, duplicate or missing entries", s.MaskedPaths)
+	}
+
+	s, err = ParseSecurityOpts([]string{"systempaths=unconfined"}, false)
+	if err != nil || len(s.MaskedPaths) != 0 || len(s.ReadonlyPaths) != 0 {
+		t.Fatalf("systempaths=unconfined = %+v, %v", s, err)
+	}
+
+	s, err = ParseSecurityOpts([]string{"mask=/proc/cpuinfo"}, true)
+	if err != nil || !s.Privileged || len(s.MaskedPaths) != 0 || len(s.ReadonlyPaths) != 0 {
+		t.Fatalf("privileged = %+v, %v", s, err)
+	}
+
+	for _, opt := range []string{"mask", "mask=", "mask=proc/kcore", "systempaths=confined", "seccomp=unconfined"} {
+		if _, err := ParseSecurityOpts([]string{opt}, false); err == nil {
+			t.Fatalf("ParseSecurityOpts(%q) should fail", opt)
+		}
+	}
+}
+
+func contains(paths []string, p string) bool {
+	for _, v := range paths {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
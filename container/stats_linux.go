@@ -0,0 +1,125 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ContainerStats 记录某一时刻容器的资源使用情况
+type ContainerStats struct {
+	ID   string    `json:"id"`
+	Read time.Time `json:"read"` // 采样时间
+
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryUsage   uint64  `json:"memory_usage"`
+	MemoryLimit   uint64  `json:"memory_limit"`
+	MemoryPercent float64 `json:"memory_percent"`
+	Pids          uint64  `json:"pids"`
+	BlockRead     uint64  `json:"block_read"`
+	BlockWrite    uint64  `json:"block_write"`
+	NetRx         uint64  `json:"net_rx"`
+	NetTx         uint64  `json:"net_tx"`
+	Exited        bool    `json:"exited"` // 容器已经退出，此时其他字段都为 0
+
+	cpuUsage uint64 // 累计 CPU 使用时间，用于和上一次采样计算 CPU 使用率
+}
+
+// GetContainerStats 读取容器当前的资源使用情况，prev 为上一次的采样结果，
+// 用于计算这段时间内的 CPU 使用率，为 nil 时 CPU 使用率为 0
+func GetContainerStats(info *ContainerInfo, prev *ContainerStats) (*ContainerStats, error) {
+	cg, err := info.CgroupManager()
+	if err != nil {
+		return nil, err
+	}
+	s, err := cg.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	rx, tx, err := readNetDev(info.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ContainerStats{
+		ID:          info.ShortID(),
+		Read:        time.Now(),
+		MemoryUsage: s.MemoryUsage,
+		MemoryLimit: s.MemoryLimit,
+		Pids:        s.Pids,
+		BlockRead:   s.BlkioRead,
+		BlockWrite:  s.BlkioWrite,
+		NetRx:       rx,
+		NetTx:       tx,
+		cpuUsage:    s.CPUUsage,
+	}
+
+	// 没有设置内存限制时，cgroup 中的值是一个非常大的数，此时使用宿主机的总内存作为限制
+	if total := hostMemory(); total != 0 && (stats.MemoryLimit == 0 || stats.MemoryLimit > total) {
+		stats.MemoryLimit = total
+	}
+	if stats.MemoryLimit != 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+
+	// CPU 使用率 = 这段时间内使用的 CPU 时间 / 这段时间的长度，多核时可能超过 100%
+	if prev != nil && s.CPUUsage >= prev.cpuUsage {
+		wall := stats.Read.Sub(prev.Read).Nanoseconds()
+		if wall > 0 {
+			stats.CPUPercent = float64(s.CPUUsage-prev.cpuUsage) / float64(wall) * 100
+		}
+	}
+	return stats, nil
+}
+
+// readNetDev 从 /proc/<pid>/net/dev 中读取容器网络命名空间中除 lo 以外所有网卡的累计收发字节数，
+// 文件格式示例：
+//
+//	eth0: 2247693     227    0    0    0     0          0         0    39770     352 ...
+//
+// 冒号之后第 1 列为接收字节数，第 9 列为发送字节数
+func readNetDev(pid int) (rx, tx uint64, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return parseNetDev(f)
+}
+
+// parseNetDev 解析 /proc/<pid>/net/dev 的内容，前两行表头中没有网卡名和冒号，会被跳过
+func parseNetDev(r io.Reader) (rx, tx uint64, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+		r, _ := strconv.ParseUint(fields[0], 10, 64)
+		t, _ := strconv.ParseUint(fields[8], 10, 64)
+		rx += r
+		tx += t
+	}
+	return rx, tx, scanner.Err()
+}
+
+// hostMemory 返回宿主机的总内存，单位为字节
+func hostMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
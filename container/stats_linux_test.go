@@ -0,0 +1,52 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNetDev(t *testing.T) {
+	header := "Inter-|   Receive                                                |  Transmit\n" +
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n"
+
+	tests := []struct {
+		name   string
+		lines  string
+		wantRx uint64
+		wantTx uint64
+	}{
+		{"no interface", "", 0, 0},
+		{
+			"lo is ignored",
+			"    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0\n",
+			0, 0,
+		},
+		{
+			"single interface",
+			"    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0\n" +
+				"  eth0: 2247693     227    0    0    0     0          0         0    39770     352    0    0    0     0       0          0\n",
+			2247693, 39770,
+		},
+		{
+			"multiple interfaces",
+			"  eth0:     100       1    0    0    0     0          0         0      200       2    0    0    0     0       0          0\n" +
+				"  eth1:      10       1    0    0    0     0          0         0       20       2    0    0    0     0       0          0\n",
+			110, 220,
+		},
+		{
+			"no space after colon",
+			"eth0:123 1 0 0 0 0 0 0 456 2 0 0 0 0 0 0\n",
+			123, 456,
+		},
+		{"truncated line", "  eth0: 100 1 0\n", 0, 0},
+	}
+	for _, tt := range tests {
+		rx, tx, err := parseNetDev(strings.NewReader(header + tt.lines))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if rx != tt.wantRx || tx != tt.wantTx {
+			t.Fatalf("%s: parseNetDev = %d, %d, want %d, %d", tt.name, rx, tx, tt.wantRx, tt.wantTx)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// supervise 进程继承的文件描述符
+const (
+	superviseOptionsFd = 3 // 读取 RunOptions 的管道
+	superviseReadyFd   = 4 // 容器可以 attach 之后写入 superviseReady，失败时写入错误信息
+)
+
+const (
+	superviseReady   = "ok"
+	superviseLogName = "supervise.log"
+)
+
+// runSupervised 在后台启动 supervise 进程运行容器，等容器的 attach socket 准备好之后 attach 上去，
+// supervise 进程是新会话的首进程，当前终端关闭或者 detach 之后容器不受影响
+func runSupervised(opts *RunOptions) error {
+	opts.ID = NewContainerID()
+	dir := filepath.Join(InfoLocation, opts.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	logPath := filepath.Join(dir, superviseLogName)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	optsR, optsW, err := NewPipe()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := NewPipe()
+	if err != nil {
+		optsR.Close()
+		optsW.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command("/proc/self/exe", "supervise")
+	cmd.ExtraFiles = []*os.File{optsR, readyW}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	optsR.Close()
+	readyW.Close()
+	if err != nil {
+		optsW.Close()
+		zlog.New().Error("start supervise process error", zap.Error(err))
+		return err
+	}
+	// supervise 进程在容器退出后才会退出，不等待它
+	cmd.Process.Release()
+
+	err = json.NewEncoder(optsW).Encode(opts)
+	optsW.Close()
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadAll(readyR)
+	if err != nil {
+		return err
+	}
+	if string(b) != superviseReady {
+		if len(b) == 0 {
+			return fmt.Errorf("supervise process exited unexpectedly, see %s", logPath)
+		}
+		// 容器没有创建成功时清理掉容器目录
+		if exist, _ := PathIsExist(filepath.Join(dir, configName)); !exist {
+			os.RemoveAll(dir)
+		}
+		return fmt.Errorf("start container error: %s", b)
+	}
+
+	info := &ContainerInfo{ID: opts.ID}
+	if err := Attach(opts.ID, opts.Interactive, opts.DetachKeys); err != nil {
+		if err == ErrDetached {
+			fmt.Fprintf(os.Stderr, "\r\ndetached from container %s\r\n", info.ShortID())
+			return nil
+		}
+		return err
+	}
+	return ContainerExitError(opts.ID)
+}
+
+// ContainerExitError 在容器以非 0 状态码退出时返回错误
+func ContainerExitError(id string) error {
+	info, err := ReadContainerInfo(id)
+	if err != nil {
+		return err
+	}
+	if info.Status == Exited && info.ExitCode != 0 {
+		return fmt.Errorf("container %s exited with code %d", info.ShortID(), info.ExitCode)
+	}
+	return nil
+}
+
+// Supervise 是 supervise 命令的入口，从管道中读取 RunOptions 运行容器，
+// 持有容器伪终端的 master 并通过 attach socket 提供给客户端，直到容器退出
+func Supervise() error {
+	// 继承的文件描述符没有 close-on-exec，避免泄漏到容器进程中
+	unix.CloseOnExec(superviseOptionsFd)
+	unix.CloseOnExec(superviseReadyFd)
+	readyW := os.NewFile(superviseReadyFd, "ready")
+	notified := false
+	notify := func(msg string) {
+		if !notified {
+			notified = true
+			readyW.Write([]byte(msg))
+			readyW.Close()
+		}
+	}
+
+	opts := &RunOptions{}
+	optsR := os.NewFile(superviseOptionsFd, "options")
+	err := json.NewDecoder(optsR).Decode(opts)
+	optsR.Close()
+	if err != nil {
+		zlog.New().Error("decode run options error", zap.Error(err))
+		notify(err.Error())
+		return err
+	}
+
+	err = runContainer(opts, func() { notify(superviseReady) })
+	if err != nil {
+		notify(err.Error())
+	}
+	return err
+}
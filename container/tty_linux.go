@@ -0,0 +1,162 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// consoleFd 容器 init 进程中用于发送伪终端 master 的 socket，fd 3 是接收初始化配置的管道
+const consoleFd = 4
+
+// consoleStart 父进程准备好转发伪终端的输出之后，通过 console socket 发送给容器 init 进程
+const consoleStart = 1
+
+// newConsoleSocket 创建一对 unix socket，容器 init 进程通过 child 将伪终端的 master 发送给父进程
+func newConsoleSocket() (parent, child *os.File, err error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		zlog.New().Error("create console socket error", zap.Error(err))
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "console-parent"), os.NewFile(uintptr(fds[1]), "console-child"), nil
+}
+
+// openPty 通过 /dev/ptmx 分配一个伪终端，在容器中调用时分配的是容器 devpts 实例中的伪终端
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open /dev/ptmx error: %v", err)
+	}
+	fd := int(master.Fd())
+	// 等同于 unlockpt(3)
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlock pty error: %v", err)
+	}
+	// 等同于 ptsname(3)
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("get pty number error: %v", err)
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err = os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("open %s error: %v", name, err)
+	}
+	return master, slave, nil
+}
+
+// setUpConsole 在容器 init 进程中分配伪终端，将 master 通过 socket 发送给父进程，
+// 再把 slave 设置为控制终端和标准输入输出，容器进程在 clone 时已经通过 setsid 成为了会话首进程。
+// 之后阻塞等待父进程通过 socket 发送 consoleStart，父进程在第一个 attach 客户端连接之后才会发送，
+// 保证用户命令的输出不会在没有客户端时被丢弃
+func setUpConsole(socket *os.File) error {
+	defer socket.Close()
+	master, slave, err := openPty()
+	if err != nil {
+		zlog.New().Error("open pty error", zap.Error(err))
+		return err
+	}
+	defer slave.Close()
+
+	err = sendFd(socket, master)
+	master.Close()
+	if err != nil {
+		return fmt.Errorf("send pty master error: %v", err)
+	}
+
+	if err := unix.IoctlSetInt(int(slave.Fd()), unix.TIOCSCTTY, 0); err != nil {
+		return fmt.Errorf("set controlling terminal error: %v", err)
+	}
+	for fd := 0; fd < 3; fd++ {
+		if err := unix.Dup3(int(slave.Fd()), fd, 0); err != nil {
+			return fmt.Errorf("dup pty slave to fd %d error: %v", fd, err)
+		}
+	}
+
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(socket, buf); err != nil || buf[0] != consoleStart {
+		return fmt.Errorf("wait for console start error: %v", err)
+	}
+	return nil
+}
+
+// startConsole 通知容器 init 进程开始执行用户命令
+func startConsole(socket *os.File) error {
+	_, err := socket.Write([]byte{consoleStart})
+	return err
+}
+
+// sendFd 通过 SCM_RIGHTS 将 f 发送到 unix socket 的另一端
+func sendFd(socket, f *os.File) error {
+	rights := unix.UnixRights(int(f.Fd()))
+	return unix.Sendmsg(int(socket.Fd()), []byte(f.Name()), rights, nil, 0)
+}
+
+// recvFd 从 unix socket 中接收一个文件描述符，对端关闭时返回错误
+func recvFd(socket *os.File) (*os.File, error) {
+	name := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(socket.Fd()), name, oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 && oobn == 0 {
+		return nil, io.EOF
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expect 1 control message, got %d", len(msgs))
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("expect 1 fd, got %d", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), string(name[:n])), nil
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// setRawTerminal 将终端 fd 设置为 raw 模式，等同于 cfmakeraw(3)，返回恢复原设置的函数
+func setRawTerminal(fd int) (restore func(), err error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("get terminal attributes error: %v", err)
+	}
+	old := *termios
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, fmt.Errorf("set terminal raw mode error: %v", err)
+	}
+	return func() {
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &old); err != nil {
+			zlog.New().Warn("restore terminal error", zap.Error(err))
+		}
+	}, nil
+}
@@ -0,0 +1,142 @@
+package container
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTestPty 分配一个伪终端，测试环境中没有 devpts 时跳过
+func openTestPty(t *testing.T) (master, slave *os.File) {
+	master, slave, err := openPty()
+	if err != nil {
+		if _, statErr := os.Stat("/dev/ptmx"); statErr != nil {
+			t.Skipf("pty is not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+	return master, slave
+}
+
+func TestOpenPty(t *testing.T) {
+	master, slave := openTestPty(t)
+	if !isTerminal(master) || !isTerminal(slave) {
+		t.Fatal("pty master and slave should be terminals")
+	}
+	if f, err := os.Open(os.DevNull); err == nil {
+		defer f.Close()
+		if isTerminal(f) {
+			t.Fatal("/dev/null should not be a terminal")
+		}
+	}
+	// slave 的设备号与 master 上的 pty 编号一致
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(slave.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	if int(unix.Minor(uint64(st.Rdev))) != n {
+		t.Fatalf("slave minor = %d, want %d", unix.Minor(uint64(st.Rdev)), n)
+	}
+}
+
+func TestSetRawTerminal(t *testing.T) {
+	_, slave := openTestPty(t)
+	fd := int(slave.Fd())
+	before, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := setRawTerminal(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Lflag&(unix.ECHO|unix.ICANON|unix.ISIG) != 0 || raw.Oflag&unix.OPOST != 0 || raw.Iflag&unix.ICRNL != 0 {
+		t.Fatalf("terminal is not raw: %+v", raw)
+	}
+	if raw.Cflag&unix.CSIZE != unix.CS8 || raw.Cc[unix.VMIN] != 1 || raw.Cc[unix.VTIME] != 0 {
+		t.Fatalf("terminal is not raw: %+v", raw)
+	}
+
+	restore()
+	after, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *after != *before {
+		t.Fatalf("terminal attributes not restored: %+v, want %+v", after, before)
+	}
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if _, err := setRawTerminal(int(null.Fd())); err == nil {
+		t.Fatal("set raw mode on non-terminal should fail")
+	}
+}
+
+func TestSendRecvFd(t *testing.T) {
+	master, slave := openTestPty(t)
+	parent, child, err := newConsoleSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+
+	// 与容器 init 进程相同：发送 master 之后关闭自己持有的 master
+	if err := sendFd(child, master); err != nil {
+		t.Fatal(err)
+	}
+	master.Close()
+	received, err := recvFd(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer received.Close()
+	if received.Name() != "/dev/ptmx" {
+		t.Fatalf("received file name = %q", received.Name())
+	}
+
+	// raw 模式下写入 slave 的内容原样从收到的 master 中读出，反之亦然
+	restore, err := setRawTerminal(int(slave.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restore()
+	if _, err := slave.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("hello\n"))
+	if _, err := io.ReadFull(received, buf); err != nil || string(buf) != "hello\n" {
+		t.Fatalf("read from received master = %q, %v", buf, err)
+	}
+	if _, err := received.Write([]byte("world\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, len("world\n"))
+	if _, err := io.ReadFull(slave, buf); err != nil || string(buf) != "world\n" {
+		t.Fatalf("read from slave = %q, %v", buf, err)
+	}
+
+	// 对端关闭之后 recvFd 返回 EOF
+	child.Close()
+	if _, err := recvFd(parent); err != io.EOF {
+		t.Fatalf("recvFd after close error = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,39 @@
+package container
+
+import (
+	"fmt"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup"
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup/subsystems"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+)
+
+// UpdateResources 修改运行中或暂停的容器的资源限制，merge 根据容器当前保存的配置生成合并后的完整配置，
+// 读取、设置 cgroup 和保存都在容器信息的锁中进行，避免和其他修改互相覆盖
+func UpdateResources(id string, merge func(base *subsystems.ResourceConfig) (*subsystems.ResourceConfig, error)) (*ContainerInfo, error) {
+	return UpdateContainerInfo(id, func(info *ContainerInfo) error {
+		if info.Status != Running && info.Status != Paused {
+			return fmt.Errorf("container %s is not running", info.ShortID())
+		}
+		base := info.ResourceConfig
+		if base == nil {
+			base = &subsystems.ResourceConfig{}
+		}
+		resConf, err := merge(base)
+		if err != nil {
+			return err
+		}
+
+		cg, err := cgroup.NewManager(info.CgroupDriver, info.CgroupPath, resConf)
+		if err != nil {
+			return err
+		}
+		if err := cg.SetAll(); err != nil {
+			zlog.New().Error("update container resources error", zap.String("id", info.ShortID()), zap.Error(err))
+			return err
+		}
+		info.ResourceConfig = resConf
+		return nil
+	})
+}
@@ -2,10 +2,24 @@ module github.com/YOUSEEBIGGIRL/fakedocke
 
 go 1.17
 
-require github.com/urfave/cli/v2 v2.3.0
+require (
+	github.com/coreos/go-systemd/v22 v22.3.2
+	github.com/godbus/dbus/v5 v5.0.4
+	github.com/urfave/cli/v2 v2.3.0
+	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df
+	golang.org/x/net v0.1.0
+	golang.org/x/sys v0.1.0
+)
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+)
 
 require (
 	go.uber.org/atomic v1.9.0 // indirect
-	go.uber.org/multierr v1.7.0 // indirect
+	go.uber.org/multierr v1.7.0
 	go.uber.org/zap v1.20.0
 )
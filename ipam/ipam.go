@@ -0,0 +1,290 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultStorePath 默认的分配记录文件，放在 /var/lib 中持久保存。使用者（容器和网络）的记录
+// 在 /var/run 中，宿主机重启之后就不存在了，它们占用的地址通过 Prune 回收
+var DefaultStorePath = "/var/lib/fakedocker/network/ipam.json"
+
+// IPAM 从子网中分配和释放地址，分配记录以 json 格式保存在文件中，
+// 每次操作都会加文件锁之后重新读取，多个 fakedocker 进程同时运行时不会分配到相同的地址
+type IPAM struct {
+	path string
+}
+
+// New 返回一个将分配记录保存在 path 中的 IPAM
+func New(path string) *IPAM {
+	return &IPAM{path: path}
+}
+
+// subnetState 一个子网的分配情况
+type subnetState struct {
+	Allocated map[string]string `json:"allocated"` // 已分配的地址 -> 使用者，比如容器 ID
+	Last      string            `json:"last"`      // 上一次分配的地址，下次从它之后开始分配，避免刚释放的地址马上被复用
+}
+
+type store struct {
+	Subnets map[string]*subnetState `json:"subnets"` // 子网 -> 分配情况
+}
+
+// Gateway 返回子网默认的网关，即子网中的第一个地址
+func Gateway(subnet *net.IPNet) net.IP {
+	return offsetIP(subnet, big.NewInt(1))
+}
+
+// Allocate 为 owner 从 subnet 中分配一个地址，跳过网络地址、网关和 IPv4 的广播地址，
+// 子网中没有可用的地址时返回错误
+func (m *IPAM) Allocate(subnet *net.IPNet, owner string) (*net.IPNet, error) {
+	subnet = normalize(subnet)
+	size := subnetSize(subnet)
+	if !hasHostAddress(subnet, size) {
+		return nil, fmt.Errorf("subnet %s is too small to allocate IP address", subnet)
+	}
+
+	var result *net.IPNet
+	err := m.update(func(s *store) error {
+		st := s.subnet(subnet)
+		start := big.NewInt(1)
+		if last := net.ParseIP(st.Last); last != nil && subnet.Contains(last) {
+			start = ipOffset(subnet, last)
+		}
+		// 已分配的地址有 len(st.Allocated) 个，保留地址最多 3 个，连续检查这么多个之后一定能找到
+		// 空闲的地址，IPv6 的子网很大，不能遍历整个子网
+		candidates := new(big.Int).SetInt64(int64(len(st.Allocated) + 4))
+		if candidates.Cmp(size) > 0 {
+			candidates = size
+		}
+		offset := new(big.Int).Set(start)
+		one := big.NewInt(1)
+		for i := big.NewInt(0); i.Cmp(candidates) < 0; i.Add(i, one) {
+			offset.Add(offset, one)
+			if offset.Cmp(size) >= 0 {
+				offset.SetInt64(0)
+			}
+			if reserved(subnet, size, offset) {
+				continue
+			}
+			ip := offsetIP(subnet, offset)
+			if _, ok := st.Allocated[ip.String()]; ok {
+				continue
+			}
+			st.Allocated[ip.String()] = owner
+			st.Last = ip.String()
+			result = &net.IPNet{IP: ip, Mask: subnet.Mask}
+			return nil
+		}
+		return fmt.Errorf("no available IP address in subnet %s", subnet)
+	})
+	if err != nil {
+		zlog.New().Error("allocate ip error", zap.String("subnet", subnet.String()), zap.Error(err))
+		return nil, err
+	}
+	return result, nil
+}
+
+// Reserve 为 owner 分配 subnet 中指定的地址 ip，ip 已经被分配，或者是网络地址、默认网关和
+// IPv4 的广播地址时返回错误
+func (m *IPAM) Reserve(subnet *net.IPNet, ip net.IP, owner string) error {
+	subnet = normalize(subnet)
+	ip = normalizeIP(ip)
+	if !subnet.Contains(ip) {
+		return fmt.Errorf("IP address %s is not in subnet %s", ip, subnet)
+	}
+	if reserved(subnet, subnetSize(subnet), ipOffset(subnet, ip)) {
+		return fmt.Errorf("IP address %s is the network, gateway or broadcast address of subnet %s", ip, subnet)
+	}
+
+	return m.update(func(s *store) error {
+		st := s.subnet(subnet)
+		if other, ok := st.Allocated[ip.String()]; ok {
+			return fmt.Errorf("IP address %s is already allocated to %s", ip, other)
+		}
+		st.Allocated[ip.String()] = owner
+		return nil
+	})
+}
+
+// Release 释放 owner 在 subnet 中占用的地址 ip，ip 没有被分配时不返回错误；
+// ip 已经分配给了其他使用者时保持不变，重复释放不会影响复用了这个地址的容器
+func (m *IPAM) Release(subnet *net.IPNet, ip net.IP, owner string) error {
+	subnet = normalize(subnet)
+	return m.update(func(s *store) error {
+		st, ok := s.Subnets[subnet.String()]
+		if !ok {
+			return nil
+		}
+		key := normalizeIP(ip).String()
+		if other, ok := st.Allocated[key]; ok && other != owner {
+			zlog.New().Warn("ip is allocated to another owner, skip releasing it",
+				zap.String("ip", key), zap.String("owner", owner), zap.String("allocated to", other))
+			return nil
+		}
+		delete(st.Allocated, key)
+		return nil
+	})
+}
+
+// Prune 删除 keep 返回 false 的分配记录，用于回收使用者已经不存在的地址，
+// keep 的参数为子网、地址和使用者
+func (m *IPAM) Prune(keep func(subnet, ip, owner string) bool) error {
+	return m.update(func(s *store) error {
+		for subnet, st := range s.Subnets {
+			for ip, owner := range st.Allocated {
+				if !keep(subnet, ip, owner) {
+					zlog.New().Info("release ip of removed owner", zap.String("ip", ip), zap.String("owner", owner))
+					delete(st.Allocated, ip)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Allocated 返回 subnet 中已分配的地址及其使用者
+func (m *IPAM) Allocated(subnet *net.IPNet) (map[string]string, error) {
+	subnet = normalize(subnet)
+	result := make(map[string]string)
+	err := m.view(func(s *store) error {
+		if st, ok := s.Subnets[subnet.String()]; ok {
+			for ip, owner := range st.Allocated {
+				result[ip] = owner
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// update 加文件锁之后读取分配记录，调用 fn 修改后写回文件，fn 返回错误时不写回
+func (m *IPAM) update(fn func(s *store) error) error {
+	return m.withStore(true, fn)
+}
+
+// view 加文件锁之后读取分配记录并调用 fn，不写回文件
+func (m *IPAM) view(fn func(s *store) error) error {
+	return m.withStore(false, fn)
+}
+
+func (m *IPAM) withStore(write bool, fn func(s *store) error) error {
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+	// 数据文件通过 rename 替换，所以锁加在单独的文件上
+	lock, err := os.OpenFile(m.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("lock %s error: %v", m.path, err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	s := &store{}
+	b, err := ioutil.ReadFile(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, s); err != nil {
+			return fmt.Errorf("decode %s error: %v", m.path, err)
+		}
+	}
+	if s.Subnets == nil {
+		s.Subnets = make(map[string]*subnetState)
+	}
+
+	if err := fn(s); err != nil || !write {
+		return err
+	}
+
+	if b, err = json.Marshal(s); err != nil {
+		return err
+	}
+	// 先写入临时文件再 rename，写到一半时进程退出也不会破坏原来的记录
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func (s *store) subnet(subnet *net.IPNet) *subnetState {
+	st, ok := s.Subnets[subnet.String()]
+	if !ok {
+		st = &subnetState{}
+		s.Subnets[subnet.String()] = st
+	}
+	if st.Allocated == nil {
+		st.Allocated = make(map[string]string)
+	}
+	return st
+}
+
+// normalize 去掉子网地址中的主机部分，IPv4 地址统一使用 4 字节表示
+func normalize(subnet *net.IPNet) *net.IPNet {
+	ip := normalizeIP(subnet.IP)
+	mask := subnet.Mask
+	if ip.To4() != nil && len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// subnetSize 返回子网中的地址数量
+func subnetSize(subnet *net.IPNet) *big.Int {
+	ones, bits := subnet.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// hasHostAddress 子网中除了保留地址之外是否还有可以分配的地址
+func hasHostAddress(subnet *net.IPNet, size *big.Int) bool {
+	min := int64(3) // 网络地址和网关
+	if subnet.IP.To4() != nil {
+		min = 4 // 还有广播地址
+	}
+	return size.Cmp(big.NewInt(min)) >= 0
+}
+
+// reserved 判断子网中的第 offset 个地址是否为网络地址、网关或者 IPv4 的广播地址
+func reserved(subnet *net.IPNet, size, offset *big.Int) bool {
+	if offset.Cmp(big.NewInt(1)) <= 0 {
+		return true
+	}
+	return subnet.IP.To4() != nil && offset.Cmp(new(big.Int).Sub(size, big.NewInt(1))) == 0
+}
+
+// offsetIP 返回子网中的第 offset 个地址
+func offsetIP(subnet *net.IPNet, offset *big.Int) net.IP {
+	n := new(big.Int).SetBytes(normalizeIP(subnet.IP))
+	n.Add(n, offset)
+	ip := make(net.IP, len(normalizeIP(subnet.IP)))
+	b := n.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// ipOffset 返回 ip 在子网中的偏移
+func ipOffset(subnet *net.IPNet, ip net.IP) *big.Int {
+	n := new(big.Int).SetBytes(normalizeIP(ip))
+	return n.Sub(n, new(big.Int).SetBytes(normalizeIP(subnet.IP)))
+}
@@ -0,0 +1,198 @@
+package ipam
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subnet
+}
+
+func TestAllocate(t *testing.T) {
+	m := New(filepath.Join(t.TempDir(), "ipam.json"))
+	subnet := mustParseCIDR(t, "10.10.0.0/29")
+
+	// 跳过网络地址 .0、网关 .1 和广播地址 .7
+	var got []string
+	for i := 0; i < 5; i++ {
+		ip, err := m.Allocate(subnet, "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ip.String())
+	}
+	want := []string{"10.10.0.2/29", "10.10.0.3/29", "10.10.0.4/29", "10.10.0.5/29", "10.10.0.6/29"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("allocated %v, want %v", got, want)
+		}
+	}
+	if _, err := m.Allocate(subnet, "c1"); err == nil {
+		t.Fatal("allocate from exhausted subnet should fail")
+	}
+
+	// 释放的地址在子网用完一轮之后才会被复用
+	if err := m.Release(subnet, net.ParseIP("10.10.0.3"), "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Release(subnet, net.ParseIP("10.10.0.5"), "c1"); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := m.Allocate(subnet, "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.IP.String() != "10.10.0.3" {
+		t.Fatalf("allocated %s after wrap around, want 10.10.0.3", ip.IP)
+	}
+	ip, err = m.Allocate(subnet, "c3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.IP.String() != "10.10.0.5" {
+		t.Fatalf("allocated %s, want 10.10.0.5", ip.IP)
+	}
+
+	// 分配记录保存在文件中，新的 IPAM 可以看到之前的分配
+	allocated, err := New(m.path).Allocated(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 5 || allocated["10.10.0.5"] != "c3" {
+		t.Fatalf("allocated = %v", allocated)
+	}
+
+	if _, err := m.Allocate(mustParseCIDR(t, "10.10.0.0/31"), "c1"); err == nil {
+		t.Fatal("allocate from /31 should fail")
+	}
+}
+
+func TestAllocateIPv6(t *testing.T) {
+	m := New(filepath.Join(t.TempDir(), "ipam.json"))
+	subnet := mustParseCIDR(t, "fd00:1::/126")
+
+	// IPv6 没有广播地址，最后一个地址也可以分配
+	for _, want := range []string{"fd00:1::2/126", "fd00:1::3/126"} {
+		ip, err := m.Allocate(subnet, "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != want {
+			t.Fatalf("allocated %s, want %s", ip, want)
+		}
+	}
+	if _, err := m.Allocate(subnet, "c1"); err == nil {
+		t.Fatal("allocate from exhausted subnet should fail")
+	}
+
+	ip, err := m.Allocate(mustParseCIDR(t, "fd00:2::/64"), "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "fd00:2::2/64" {
+		t.Fatalf("allocated %s, want fd00:2::2/64", ip)
+	}
+	if gw := Gateway(mustParseCIDR(t, "fd00:2::/64")); gw.String() != "fd00:2::1" {
+		t.Fatalf("gateway = %s, want fd00:2::1", gw)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	m := New(filepath.Join(t.TempDir(), "ipam.json"))
+	subnet := mustParseCIDR(t, "10.10.0.0/24")
+
+	if err := m.Reserve(subnet, net.ParseIP("10.10.0.2"), "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reserve(subnet, net.ParseIP("10.10.0.2"), "c2"); err == nil {
+		t.Fatal("reserve allocated ip should fail")
+	}
+	// 其他使用者释放地址时不会影响当前的使用者
+	if err := m.Release(subnet, net.ParseIP("10.10.0.2"), "c2"); err != nil {
+		t.Fatal(err)
+	}
+	if allocated, err := m.Allocated(subnet); err != nil || allocated["10.10.0.2"] != "c1" {
+		t.Fatalf("allocated = %v, %v, want 10.10.0.2 owned by c1", allocated, err)
+	}
+	for _, ip := range []string{"10.10.0.0", "10.10.0.1", "10.10.0.255", "10.10.1.2"} {
+		if err := m.Reserve(subnet, net.ParseIP(ip), "c2"); err == nil {
+			t.Fatalf("reserve %s should fail", ip)
+		}
+	}
+
+	ip, err := m.Allocate(subnet, "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.IP.String() != "10.10.0.3" {
+		t.Fatalf("allocated %s, want 10.10.0.3", ip.IP)
+	}
+}
+
+func TestAllocateConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	subnet := mustParseCIDR(t, "10.10.0.0/24")
+
+	// 每个 goroutine 使用独立的 IPAM，模拟同时运行的多个 fakedocker 进程
+	const n = 50
+	var wg sync.WaitGroup
+	results := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := New(path).Allocate(subnet, "c")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results <- ip.IP.String()
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[string]bool)
+	for ip := range results {
+		if seen[ip] {
+			t.Fatalf("ip %s allocated twice", ip)
+		}
+		seen[ip] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("allocated %d ips, want %d", len(seen), n)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	m := New(filepath.Join(t.TempDir(), "ipam.json"))
+	subnet := mustParseCIDR(t, "10.10.0.0/24")
+	for _, owner := range []string{"c1", "c2", "c3"} {
+		if _, err := m.Allocate(subnet, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.Prune(func(s, ip, owner string) bool {
+		if s != "10.10.0.0/24" {
+			t.Fatalf("subnet = %s", s)
+		}
+		return owner != "c2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated, err := m.Allocated(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 2 || allocated["10.10.0.2"] != "c1" || allocated["10.10.0.4"] != "c3" {
+		t.Fatalf("allocated after prune = %v", allocated)
+	}
+}
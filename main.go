@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/YOUSEEBIGGIRL/fakedocke/cgroup"
 	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
@@ -17,6 +18,29 @@ func main() {
 	app.Commands = []*cli.Command{
 		run,
 		init_,
+		inspect,
+		rm,
+		ps,
+		port,
+		stats,
+		update,
+		pause,
+		unpause,
+		supervise,
+		attach,
+		networkCommand,
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "cgroup-driver",
+			Value: cgroup.DriverCgroupfs,
+			Usage: "driver used to manage container cgroups, cgroupfs or systemd",
+		},
+		&cli.StringFlag{
+			Name:  "default-cgroup-parent",
+			Usage: "default parent cgroup for all containers, default is fakedocker for cgroupfs and system.slice for systemd",
+		},
 	}
 
 	app.Before = func(context *cli.Context) error {
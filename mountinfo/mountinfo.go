@@ -0,0 +1,206 @@
+// Package mountinfo 解析 /proc/<pid>/mountinfo，格式参考 proc(5)：
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//	(1)(2)(3)   (4)   (5)      (6)      (7)   (8) (9)   (10)         (11)
+//
+// 其中 (7) 可选字段的个数不固定，以 (8) "-" 结束；路径中的空格、制表符、换行和反斜杠
+// 会被转义为 \040、\011、\012 和 \134
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Info 对应 mountinfo 中的一行
+type Info struct {
+	// ID 挂载的唯一 ID
+	ID int
+	// Parent 父挂载的 ID，挂载树的根节点指向自己
+	Parent int
+	// Major、Minor 挂载的文件系统所在设备的设备号
+	Major, Minor int
+	// Root 挂载的文件系统中作为挂载根的路径，比如 bind mount 时的源目录
+	Root string
+	// MountPoint 挂载点，相对于进程的根目录
+	MountPoint string
+	// Options 挂载点的选项，比如 rw,nosuid,relatime
+	Options string
+	// Optional 可选字段，比如 shared:1、master:2
+	Optional []string
+	// FSType 文件系统类型，比如 ext4、cgroup、cgroup2
+	FSType string
+	// Source 文件系统相关的挂载源，比如 /dev/sda1，没有时为 none 或空
+	Source string
+	// SuperOptions 超级块的选项，v1 的 cgroup 通过它记录 hierarchy 中的 subsystem
+	SuperOptions string
+}
+
+// HasSuperOption 返回 SuperOptions 中是否包含 opt
+func (i *Info) HasSuperOption(opt string) bool {
+	for _, o := range strings.Split(i.SuperOptions, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterFunc 用于筛选挂载，返回 true 表示保留
+type FilterFunc func(*Info) bool
+
+// FSTypeFilter 保留文件系统类型为 fstypes 之一的挂载
+func FSTypeFilter(fstypes ...string) FilterFunc {
+	return func(i *Info) bool {
+		for _, t := range fstypes {
+			if i.FSType == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SingleEntryFilter 保留挂载点为 mountPoint 的挂载
+func SingleEntryFilter(mountPoint string) FilterFunc {
+	return func(i *Info) bool {
+		return i.MountPoint == mountPoint
+	}
+}
+
+// GetMounts 返回当前进程中所有满足 filter 的挂载，filter 为 nil 时返回全部
+func GetMounts(filter FilterFunc) ([]*Info, error) {
+	return ParseFile("/proc/self/mountinfo", filter)
+}
+
+// ParseFile 解析 mountinfo 格式的文件 file
+func ParseFile(file string, filter FilterFunc) ([]*Info, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, filter)
+}
+
+// Parse 从 r 中逐行解析 mountinfo
+func Parse(r io.Reader, filter FilterFunc) ([]*Info, error) {
+	var infos []*Info
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		info, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil && !filter(info) {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Mounted 返回 mountPoint 是否是一个挂载点
+func Mounted(mountPoint string) (bool, error) {
+	p, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return false, err
+	}
+	// 挂载点可能是符号链接，mountinfo 中记录的是解析后的路径
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	infos, err := GetMounts(SingleEntryFilter(p))
+	if err != nil {
+		return false, err
+	}
+	return len(infos) > 0, nil
+}
+
+// parseLine 解析 mountinfo 中的一行，字段之间只有一个空格，Source 为空时会出现连续的空格，
+// 所以不能使用 strings.Fields
+func parseLine(line string) (*Info, error) {
+	fields := strings.Split(line, " ")
+	// 不包含可选字段时一共 10 个字段
+	if len(fields) < 10 {
+		return nil, fmt.Errorf("parse mountinfo line %q error: too few fields", line)
+	}
+
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep == -1 || len(fields)-sep-1 != 3 {
+		return nil, fmt.Errorf("parse mountinfo line %q error: malformed separator", line)
+	}
+
+	info := &Info{}
+	var err error
+	if info.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q mount id error: %v", line, err)
+	}
+	if info.Parent, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q parent id error: %v", line, err)
+	}
+	if _, err := fmt.Sscanf(fields[2], "%d:%d", &info.Major, &info.Minor); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q device number error: %v", line, err)
+	}
+	if info.Root, err = unescape(fields[3]); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q root error: %v", line, err)
+	}
+	if info.MountPoint, err = unescape(fields[4]); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q mount point error: %v", line, err)
+	}
+	info.Options = fields[5]
+	if sep > 6 {
+		info.Optional = fields[6:sep]
+	}
+	if info.FSType, err = unescape(fields[sep+1]); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q fstype error: %v", line, err)
+	}
+	if info.Source, err = unescape(fields[sep+2]); err != nil {
+		return nil, fmt.Errorf("parse mountinfo line %q source error: %v", line, err)
+	}
+	info.SuperOptions = fields[sep+3]
+	return info, nil
+}
+
+// unescape 还原内核使用 \ooo 八进制转义的字符
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+4 > len(s) {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 3
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,109 @@
+package mountinfo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCgroupV1(t *testing.T) {
+	infos, err := ParseFile("testdata/cgroup_v1", FSTypeFilter("cgroup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 7 {
+		t.Fatalf("got %d cgroup mounts, want 7", len(infos))
+	}
+
+	want := &Info{
+		ID:           32,
+		Parent:       27,
+		Major:        0,
+		Minor:        27,
+		Root:         "/",
+		MountPoint:   "/sys/fs/cgroup/cpu,cpuacct",
+		Options:      "rw,nosuid,nodev,noexec,relatime",
+		Optional:     []string{"shared:14"},
+		FSType:       "cgroup",
+		Source:       "cgroup",
+		SuperOptions: "rw,cpu,cpuacct",
+	}
+	if !reflect.DeepEqual(infos[1], want) {
+		t.Fatalf("got %+v, want %+v", infos[1], want)
+	}
+	if !infos[1].HasSuperOption("cpuacct") || infos[1].HasSuperOption("cpuset") {
+		t.Fatalf("HasSuperOption of %q is wrong", infos[1].SuperOptions)
+	}
+}
+
+func TestParseCgroupV2(t *testing.T) {
+	infos, err := ParseFile("testdata/cgroup_v2", FSTypeFilter("cgroup2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("got %d cgroup2 mounts, want 1", len(infos))
+	}
+	if infos[0].MountPoint != "/sys/fs/cgroup" || infos[0].SuperOptions != "rw,nsdelegate,memory_recursiveprot" {
+		t.Fatalf("got %+v", infos[0])
+	}
+}
+
+func TestParseEscaped(t *testing.T) {
+	infos, err := ParseFile("testdata/escaped", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 4 {
+		t.Fatalf("got %d mounts, want 4", len(infos))
+	}
+
+	volume := infos[2]
+	if volume.Root != "/home/user/my data" || volume.MountPoint != "/root/mnt/data\tdir" {
+		t.Fatalf("escaped paths are not decoded: root %q, mount point %q", volume.Root, volume.MountPoint)
+	}
+	if want := []string{"shared:1", "master:3", "propagate_from:2"}; !reflect.DeepEqual(volume.Optional, want) {
+		t.Fatalf("Optional = %v, want %v", volume.Optional, want)
+	}
+	if infos[1].Optional != nil {
+		t.Fatalf("Optional = %v, want nil", infos[1].Optional)
+	}
+
+	// 挂载源为空时会出现连续的空格
+	tmp := infos[3]
+	if tmp.MountPoint != `/mnt/back\slash` || tmp.FSType != "tmpfs" || tmp.Source != "" || tmp.SuperOptions != "rw" {
+		t.Fatalf("got %+v", tmp)
+	}
+
+	infos, err = ParseFile("testdata/escaped", SingleEntryFilter("/root/mnt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].FSType != "aufs" {
+		t.Fatalf("SingleEntryFilter got %+v", infos)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, line := range []string{
+		"25 0 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw",
+		"25 0 8:1 / / rw - ext4",
+		"x 0 8:1 / / rw - ext4 /dev/sda1 rw",
+		"25 0 8-1 / / rw - ext4 /dev/sda1 rw",
+		`25 0 8:1 / /a\04 rw - ext4 /dev/sda1 rw`,
+	} {
+		if _, err := Parse(strings.NewReader(line), nil); err == nil {
+			t.Fatalf("Parse(%q) should fail", line)
+		}
+	}
+}
+
+func TestMounted(t *testing.T) {
+	mounted, err := Mounted("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mounted {
+		t.Fatal("/ should be mounted")
+	}
+}
@@ -0,0 +1,385 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// containerIfPrefix 容器中连接到网络的网卡名前缀，网卡依次命名为 eth0、eth1 ...
+const containerIfPrefix = "eth"
+
+// setUpBridge 创建网络的 bridge 并配置网关地址和 iptables 规则，已经存在时直接使用
+func (n *Network) setUpBridge() (netlink.Link, error) {
+	gateways, err := n.gateways()
+	if err != nil {
+		return nil, err
+	}
+
+	br, err := netlink.LinkByName(n.Bridge)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = n.Bridge
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: attrs}); err != nil {
+			zlog.New().Error("create bridge error", zap.String("bridge", n.Bridge), zap.Error(err))
+			return nil, fmt.Errorf("create bridge %s error: %v", n.Bridge, err)
+		}
+		br, err = netlink.LinkByName(n.Bridge)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get bridge %s error: %v", n.Bridge, err)
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return nil, fmt.Errorf("device %s exists but is not a bridge", n.Bridge)
+	}
+
+	if n.IPv6 != nil {
+		// 宿主机可能通过 default 配置禁用了新网卡的 IPv6
+		p := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", n.Bridge)
+		if err := ioutil.WriteFile(p, []byte("0"), 0644); err != nil {
+			return nil, fmt.Errorf("enable ipv6 on bridge %s error: %v", n.Bridge, err)
+		}
+	}
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("list addresses of bridge %s error: %v", n.Bridge, err)
+	}
+	for _, g := range gateways {
+		gateway := &net.IPNet{IP: g.ip, Mask: g.subnet.Mask}
+		hasGateway := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == gateway.String() {
+				hasGateway = true
+				break
+			}
+		}
+		if hasGateway {
+			continue
+		}
+		if err := netlink.AddrAdd(br, newAddr(gateway)); err != nil {
+			zlog.New().Error("add bridge address error", zap.String("bridge", n.Bridge), zap.Error(err))
+			return nil, fmt.Errorf("add address %s to bridge %s error: %v", gateway, n.Bridge, err)
+		}
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("set bridge %s up error: %v", n.Bridge, err)
+	}
+	if err := n.setUpBridgeRules(); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// Connect 将 pid 所在的 network namespace 连接到网络上：从网络的子网中为容器分配地址，
+// 创建一对 veth，宿主机一端连接到 bridge，另一端移动到容器中并重命名为 ethN，
+// 配置地址，容器中还没有默认路由时添加经过网关的默认路由，同时启用容器的 lo。
+// 双栈网络同时分配 IPv6 地址并添加 IPv6 的默认路由。
+// 容器运行时也可以调用，为容器增加一块网卡
+func (n *Network) Connect(containerID string, pid int) (ep *Endpoint, err error) {
+	br, err := n.setUpBridge()
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := n.gateway()
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := n.subnet()
+	if err != nil {
+		return nil, err
+	}
+	ip, err := ipAllocator.Allocate(subnet, containerID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ipAllocator.Release(subnet, ip.IP, containerID)
+		}
+	}()
+	var ip6, gateway6 *net.IPNet
+	if n.IPv6 != nil {
+		if gateway6, err = n.gateway6(); err != nil {
+			return nil, err
+		}
+		var subnet6 *net.IPNet
+		if subnet6, err = n.subnet6(); err != nil {
+			return nil, err
+		}
+		if ip6, err = ipAllocator.Allocate(subnet6, containerID); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				ipAllocator.Release(subnet6, ip6.IP, containerID)
+			}
+		}()
+	}
+
+	// 网卡名最长 15 个字符，一个容器可以连接多个网络，所以使用随机的后缀
+	suffix := randomHex(4)[:7]
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = "veth" + suffix
+	attrs.MasterIndex = br.Attrs().Index
+	veth := &netlink.Veth{LinkAttrs: attrs, PeerName: "ceth" + suffix}
+	if err := netlink.LinkAdd(veth); err != nil {
+		zlog.New().Error("create veth error", zap.String("name", attrs.Name), zap.Error(err))
+		return nil, fmt.Errorf("create veth pair %s error: %v", attrs.Name, err)
+	}
+	// 删除一端时另一端也会被删除
+	defer func() {
+		if err != nil {
+			netlink.LinkDel(veth)
+		}
+	}()
+
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return nil, fmt.Errorf("set veth %s up error: %v", attrs.Name, err)
+	}
+	// 容器通过宿主机地址访问自己映射的端口时，数据包需要从 bridge 上原来的端口发回去
+	if err := netlink.LinkSetHairpin(veth, true); err != nil {
+		return nil, fmt.Errorf("set hairpin mode of veth %s error: %v", attrs.Name, err)
+	}
+	peer, err := netlink.LinkByName(veth.PeerName)
+	if err != nil {
+		return nil, fmt.Errorf("get veth peer %s error: %v", veth.PeerName, err)
+	}
+	if err := netlink.LinkSetNsPid(peer, pid); err != nil {
+		return nil, fmt.Errorf("move veth peer %s to network namespace of %d error: %v", veth.PeerName, pid, err)
+	}
+
+	mac := macAddress(ip.IP)
+	var ifName string
+	err = inNetNS(pid, func(h *netlink.Handle) error {
+		if err := setUpLoopback(h); err != nil {
+			return err
+		}
+		if ifName, err = nextInterfaceName(h); err != nil {
+			return err
+		}
+		link, err := h.LinkByName(veth.PeerName)
+		if err != nil {
+			return fmt.Errorf("get veth peer %s in container error: %v", veth.PeerName, err)
+		}
+		if err := h.LinkSetName(link, ifName); err != nil {
+			return fmt.Errorf("rename %s to %s error: %v", veth.PeerName, ifName, err)
+		}
+		if err := h.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("set mac address of %s error: %v", ifName, err)
+		}
+		if err := h.AddrAdd(link, &netlink.Addr{IPNet: ip}); err != nil {
+			return fmt.Errorf("add address %s to %s error: %v", ip, ifName, err)
+		}
+		if ip6 != nil {
+			if err := h.AddrAdd(link, newAddr(ip6)); err != nil {
+				return fmt.Errorf("add address %s to %s error: %v", ip6, ifName, err)
+			}
+		}
+		if err := h.LinkSetUp(link); err != nil {
+			return fmt.Errorf("set %s up error: %v", ifName, err)
+		}
+		if err := addDefaultRoute(h, link, netlink.FAMILY_V4, gateway.IP); err != nil {
+			return err
+		}
+		if ip6 != nil {
+			return addDefaultRoute(h, link, netlink.FAMILY_V6, gateway6.IP)
+		}
+		return nil
+	})
+	if err != nil {
+		zlog.New().Error("configure container network error", zap.Int("pid", pid), zap.Error(err))
+		return nil, err
+	}
+
+	ep = &Endpoint{
+		Network:    n.Name,
+		HostVeth:   attrs.Name,
+		Interface:  ifName,
+		IPAddress:  ip.String(),
+		Gateway:    gateway.IP.String(),
+		MacAddress: mac.String(),
+	}
+	if ip6 != nil {
+		ep.IPv6Address = ip6.String()
+		ep.IPv6Gateway = gateway6.IP.String()
+	}
+	return ep, nil
+}
+
+// newAddr 返回网卡地址 ip，IPv6 地址跳过重复地址检测，配置之后马上就可以使用，
+// 地址由 IPAM 分配，不会与网络中的其他地址重复
+func newAddr(ip *net.IPNet) *netlink.Addr {
+	addr := &netlink.Addr{IPNet: ip}
+	if ip.IP.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	return addr
+}
+
+// addDefaultRoute 容器中还没有 family 的默认路由时添加经过 gw 的默认路由，
+// 默认路由由第一个连接的网络提供，Dst 为 nil 表示 0.0.0.0/0 或 ::/0
+func addDefaultRoute(h *netlink.Handle, link netlink.Link, family int, gw net.IP) error {
+	routes, err := h.RouteListFiltered(family, &netlink.Route{}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return fmt.Errorf("list default routes error: %v", err)
+	}
+	if len(routes) > 0 {
+		return nil
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: gw}
+	if err := h.RouteAdd(route); err != nil {
+		return fmt.Errorf("add default route via %s error: %v", gw, err)
+	}
+	return nil
+}
+
+// nextInterfaceName 返回容器中第一个没有被使用的 ethN
+func nextInterfaceName(h *netlink.Handle) (string, error) {
+	links, err := h.LinkList()
+	if err != nil {
+		return "", fmt.Errorf("list links in container error: %v", err)
+	}
+	used := make(map[string]bool)
+	for _, l := range links {
+		used[l.Attrs().Name] = true
+	}
+	for i := 0; ; i++ {
+		if name := fmt.Sprintf("%s%d", containerIfPrefix, i); !used[name] {
+			return name, nil
+		}
+	}
+}
+
+// Disconnect 删除容器 containerID 在宿主机上的 veth 并释放容器的地址，容器的 network namespace 销毁时
+// veth 也会被自动删除，所以找不到 veth 时不返回错误；地址已经分配给其他容器时不会被释放
+func Disconnect(containerID string, ep *Endpoint) error {
+	for _, addr := range []string{ep.IPAddress, ep.IPv6Address} {
+		if addr == "" {
+			continue
+		}
+		ip, subnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("invalid IP address %q of endpoint: %v", addr, err)
+		}
+		if err := ipAllocator.Release(subnet, ip, containerID); err != nil {
+			zlog.New().Error("release ip error", zap.String("ip", addr), zap.Error(err))
+			return err
+		}
+	}
+
+	link, err := netlink.LinkByName(ep.HostVeth)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		zlog.New().Error("delete veth error", zap.String("name", ep.HostVeth), zap.Error(err))
+		return fmt.Errorf("delete veth %s error: %v", ep.HostVeth, err)
+	}
+	return nil
+}
+
+// destroy 删除网络的 bridge 和 iptables 规则，bridge 不存在时不返回错误
+func (n *Network) destroy() error {
+	if err := n.tearDownBridgeRules(); err != nil {
+		return err
+	}
+	br, err := netlink.LinkByName(n.Bridge)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("get bridge %s error: %v", n.Bridge, err)
+	}
+	if err := netlink.LinkDel(br); err != nil {
+		zlog.New().Error("delete bridge error", zap.String("bridge", n.Bridge), zap.Error(err))
+		return fmt.Errorf("delete bridge %s error: %v", n.Bridge, err)
+	}
+	return nil
+}
+
+// SetUpLoopback 启用 pid 所在 network namespace 中的 lo
+func SetUpLoopback(pid int) error {
+	return inNetNS(pid, setUpLoopback)
+}
+
+func setUpLoopback(h *netlink.Handle) error {
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("get lo error: %v", err)
+	}
+	if err := h.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("set lo up error: %v", err)
+	}
+	return nil
+}
+
+// inNetNS 在 pid 所在的 network namespace 中执行 fn，fn 通过 h 操作该 namespace 中的网络设备，
+// 当前线程不需要切换 namespace
+func inNetNS(pid int, fn func(h *netlink.Handle) error) error {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("get network namespace of %d error: %v", pid, err)
+	}
+	defer ns.Close()
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("open netlink socket in network namespace of %d error: %v", pid, err)
+	}
+	defer h.Delete()
+	return fn(h)
+}
+
+// ListenInNetNS 在 pid 所在的 network namespace 中监听 address 的 udp 和 tcp 端口，
+// socket 创建之后就属于该 namespace，在任何线程上都可以使用
+func ListenInNetNS(pid int, address string) (udp net.PacketConn, tcp net.Listener, err error) {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get network namespace of %d error: %v", pid, err)
+	}
+	defer ns.Close()
+
+	// setns 只对当前线程生效，在单独的 goroutine 中锁定线程后切换，切换回原来的 namespace 失败时
+	// 不解锁，goroutine 退出时线程也会退出，不会影响其他 goroutine
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		origin, e := netns.Get()
+		if e != nil {
+			err = fmt.Errorf("get current network namespace error: %v", e)
+			return
+		}
+		defer origin.Close()
+		if e := netns.Set(ns); e != nil {
+			err = fmt.Errorf("enter network namespace of %d error: %v", pid, e)
+			return
+		}
+		udp, err = net.ListenPacket("udp", address)
+		if err == nil {
+			if tcp, err = net.Listen("tcp", address); err != nil {
+				udp.Close()
+				udp = nil
+			}
+		}
+		if e := netns.Set(origin); e != nil {
+			zlog.New().Error("restore network namespace error", zap.Error(e))
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	<-done
+	if err != nil {
+		return nil, nil, err
+	}
+	return udp, tcp, nil
+}
@@ -0,0 +1,329 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/ipam"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// withTestNetNS 在新的 network namespace 中执行 fn，fn 中创建的网络设备不会影响宿主机
+func withTestNetNS(t *testing.T, fn func()) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to create network namespace")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("create network namespace error: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+	fn()
+}
+
+// useTestIPAM 将分配记录保存在临时目录中
+func useTestIPAM(t *testing.T) {
+	origin := ipAllocator
+	ipAllocator = ipam.New(filepath.Join(t.TempDir(), "ipam.json"))
+	t.Cleanup(func() { ipAllocator = origin })
+}
+
+func TestConnect(t *testing.T) {
+	useTestIPAM(t)
+	f := useFakeIptables(t)
+	withTestNetNS(t, func() {
+		// 在测试的 network namespace 中启动一个拥有独立 network namespace 的进程作为容器
+		cmd := exec.Command("sleep", "10")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		n := &Network{Name: "test", Bridge: "br-test", Subnet: "10.10.0.0/24"}
+		ep, err := n.Connect("0123456789abcdef", cmd.Process.Pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ep.HostVeth) != 11 || ep.Interface != "eth0" || ep.IPAddress != "10.10.0.2/24" || ep.Gateway != "10.10.0.1" {
+			t.Fatalf("unexpected endpoint %+v", ep)
+		}
+
+		br, err := netlink.LinkByName("br-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		veth, err := netlink.LinkByName(ep.HostVeth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if veth.Attrs().MasterIndex != br.Attrs().Index {
+			t.Fatalf("veth %s is not attached to bridge", ep.HostVeth)
+		}
+		if protinfo, err := netlink.LinkGetProtinfo(veth); err != nil || !protinfo.Hairpin {
+			t.Fatalf("hairpin mode of veth %s is not enabled: %v", ep.HostVeth, err)
+		}
+
+		// 宿主机通过 127.0.0.1 访问映射的端口
+		if b, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/br-test/route_localnet"); err != nil || strings.TrimSpace(string(b)) != "1" {
+			t.Fatalf("route_localnet of br-test = %q, %v", b, err)
+		}
+		if n := f.count("nat", "OUTPUT", "-m addrtype --dst-type LOCAL -j "+iptablesChain); n != 1 || f.count("nat", "OUTPUT", "127.0.0.0/8") != 0 {
+			t.Fatalf("output rules = %v", f.chains["nat/OUTPUT"])
+		}
+		if n := f.count("nat", "POSTROUTING", "-s 127.0.0.0/8 -o br-test -j MASQUERADE"); n != 1 {
+			t.Fatalf("postrouting rules = %v", f.chains["nat/POSTROUTING"])
+		}
+
+		err = inNetNS(cmd.Process.Pid, func(h *netlink.Handle) error {
+			lo, err := h.LinkByName("lo")
+			if err != nil {
+				return err
+			}
+			if lo.Attrs().Flags&syscall.IFF_UP == 0 {
+				t.Fatal("lo is not up")
+			}
+			eth0, err := h.LinkByName("eth0")
+			if err != nil {
+				return err
+			}
+			if eth0.Attrs().HardwareAddr.String() != ep.MacAddress {
+				t.Fatalf("mac address = %s, want %s", eth0.Attrs().HardwareAddr, ep.MacAddress)
+			}
+			addrs, err := h.AddrList(eth0, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			if len(addrs) != 1 || addrs[0].IPNet.String() != ep.IPAddress {
+				t.Fatalf("addresses of eth0 = %v", addrs)
+			}
+			routes, err := h.RouteList(eth0, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, r := range routes {
+				if r.Dst == nil && r.Gw.String() == ep.Gateway {
+					return nil
+				}
+			}
+			t.Fatalf("default route not found in %v", routes)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 第二个容器复用已经存在的 bridge
+		if _, err := n.setUpBridge(); err != nil {
+			t.Fatal(err)
+		}
+
+		// 连接第二个网络，网卡为 eth1，默认路由仍然经过第一个网络
+		other := &Network{Name: "other", Bridge: "br-other", Subnet: "10.20.0.0/24", Gateway: "10.20.0.254"}
+		ep2, err := other.Connect("0123456789abcdef", cmd.Process.Pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ep2.Interface != "eth1" || ep2.HostVeth == ep.HostVeth || ep2.Gateway != "10.20.0.254" {
+			t.Fatalf("unexpected endpoint %+v", ep2)
+		}
+		err = inNetNS(cmd.Process.Pid, func(h *netlink.Handle) error {
+			routes, err := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{}, netlink.RT_FILTER_DST)
+			if err != nil {
+				return err
+			}
+			if len(routes) != 1 || routes[0].Gw.String() != ep.Gateway {
+				t.Fatalf("default routes = %v", routes)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Disconnect("0123456789abcdef", ep2); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.destroy(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := netlink.LinkByName("br-other"); err == nil {
+			t.Fatal("bridge should be deleted")
+		}
+
+		if err := Disconnect("0123456789abcdef", ep); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := netlink.LinkByName(ep.HostVeth); err == nil {
+			t.Fatal("veth should be deleted")
+		}
+		if err := Disconnect("0123456789abcdef", ep); err != nil {
+			t.Fatalf("disconnect twice should not fail: %v", err)
+		}
+		allocated, err := ipAllocator.Allocated(&net.IPNet{IP: net.IPv4(10, 10, 0, 0), Mask: net.CIDRMask(24, 32)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(allocated) != 0 {
+			t.Fatalf("ip should be released after disconnect, allocated: %v", allocated)
+		}
+	})
+}
+
+func TestConnectDualStack(t *testing.T) {
+	useTestIPAM(t)
+	f := useFakeIptables(t)
+	withTestNetNS(t, func() {
+		cmd := exec.Command("sleep", "10")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		n := &Network{
+			Name: "test", Bridge: "br-test", Subnet: "10.10.0.0/24",
+			IPv6: &IPv6Config{Subnet: "fd00:10::/64", Mode: IPv6ModeNAT},
+		}
+		ep, err := n.Connect("0123456789abcdef", cmd.Process.Pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ep.IPAddress != "10.10.0.2/24" || ep.IPv6Address != "fd00:10::2/64" || ep.IPv6Gateway != "fd00:10::1" {
+			t.Fatalf("unexpected endpoint %+v", ep)
+		}
+		if f.count6("nat", "POSTROUTING", "-s fd00:10::/64 ! -o br-test -j MASQUERADE") != 1 {
+			t.Fatalf("ipv6 masquerade rules = %v", f.chains6["nat/POSTROUTING"])
+		}
+
+		br, err := netlink.LinkByName("br-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := netlink.AddrList(br, netlink.FAMILY_V6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasGateway := false
+		for _, a := range addrs {
+			hasGateway = hasGateway || a.IPNet.String() == "fd00:10::1/64"
+		}
+		if !hasGateway {
+			t.Fatalf("ipv6 gateway is not on bridge: %v", addrs)
+		}
+
+		err = inNetNS(cmd.Process.Pid, func(h *netlink.Handle) error {
+			eth0, err := h.LinkByName("eth0")
+			if err != nil {
+				return err
+			}
+			addrs, err := h.AddrList(eth0, netlink.FAMILY_V6)
+			if err != nil {
+				return err
+			}
+			found := false
+			for _, a := range addrs {
+				found = found || a.IPNet.String() == ep.IPv6Address
+			}
+			if !found {
+				t.Fatalf("ipv6 addresses of eth0 = %v", addrs)
+			}
+			routes, err := h.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{}, netlink.RT_FILTER_DST)
+			if err != nil {
+				return err
+			}
+			if len(routes) != 1 || routes[0].Gw.String() != ep.IPv6Gateway {
+				t.Fatalf("ipv6 default routes = %v", routes)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Disconnect("0123456789abcdef", ep); err != nil {
+			t.Fatal(err)
+		}
+		_, subnet6, _ := net.ParseCIDR("fd00:10::/64")
+		if allocated, _ := ipAllocator.Allocated(subnet6); len(allocated) != 0 {
+			t.Fatalf("ipv6 address should be released after disconnect, allocated: %v", allocated)
+		}
+
+		// 容器进程已经退出，连接失败时两个地址族的地址都会被释放
+		dead := exec.Command("true")
+		if err := dead.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.Connect("fedcba9876543210", dead.Process.Pid); err == nil {
+			t.Fatal("connect exited process should fail")
+		}
+		_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+		for _, s := range []*net.IPNet{subnet, subnet6} {
+			if allocated, _ := ipAllocator.Allocated(s); len(allocated) != 0 {
+				t.Fatalf("address in %s should be released after failed connect, allocated: %v", s, allocated)
+			}
+		}
+	})
+}
+
+func TestListenInNetNS(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to create network namespace")
+	}
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	if err := SetUpLoopback(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	udp, tcp, err := ListenInNetNS(cmd.Process.Pid, "127.0.0.11:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	defer tcp.Close()
+
+	// 127.0.0.11:53 的 socket 只出现在容器的 network namespace 中
+	const local = "0B00007F:0035"
+	for _, f := range []string{"udp", "tcp"} {
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/%s", cmd.Process.Pid, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), local) {
+			t.Fatalf("%s socket is not in the network namespace of %d:\n%s", f, cmd.Process.Pid, b)
+		}
+		if b, err := ioutil.ReadFile("/proc/self/net/" + f); err != nil || strings.Contains(string(b), local) {
+			t.Fatalf("%s socket should not be in the current network namespace: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeIptables 在内存中模拟 iptables 和 ip6tables 的链和规则，只支持用到的 -N、-L、-C、-A、-I、-D
+type fakeIptables struct {
+	chains  map[string][]string // <table>/<chain> -> 规则
+	chains6 map[string][]string // ip6tables 的链和规则
+}
+
+func useFakeIptables(t *testing.T) *fakeIptables {
+	f := &fakeIptables{chains: make(map[string][]string), chains6: make(map[string][]string)}
+	for _, c := range []string{"nat/PREROUTING", "nat/OUTPUT", "nat/POSTROUTING", "filter/INPUT", "filter/FORWARD"} {
+		f.chains[c] = nil
+		f.chains6[c] = nil
+	}
+	origin := iptablesCmd
+	iptablesCmd = f.run
+	t.Cleanup(func() { iptablesCmd = origin })
+	return f
+}
+
+func (f *fakeIptables) run(ipv6 bool, args ...string) ([]byte, error) {
+	if len(args) < 4 || args[0] != "-t" {
+		return nil, fmt.Errorf("unsupported iptables command %v", args)
+	}
+	chains := f.chains
+	if ipv6 {
+		chains = f.chains6
+	}
+	table, op := args[1], args[2]
+	if op == "-n" {
+		op, args = args[3], args[1:]
+	}
+	chain := table + "/" + args[3]
+	rules, ok := chains[chain]
+	if op == "-N" {
+		if ok {
+			return []byte("Chain already exists."), fmt.Errorf("exit status 1")
+		}
+		chains[chain] = nil
+		return nil, nil
+	}
+	if !ok {
+		return []byte("No chain/target/match by that name."), fmt.Errorf("exit status 1")
+	}
+
+	rule := strings.Join(args[4:], " ")
+	index := -1
+	for i, r := range rules {
+		if r == rule {
+			index = i
+		}
+	}
+	switch op {
+	case "-L":
+		return nil, nil
+	case "-C":
+		if index < 0 {
+			return []byte("Bad rule (does a matching rule exist in that chain?)."), fmt.Errorf("exit status 1")
+		}
+	case "-A":
+		chains[chain] = append(rules, rule)
+	case "-I":
+		chains[chain] = append([]string{rule}, rules...)
+	case "-D":
+		if index < 0 {
+			return []byte("Bad rule (does a matching rule exist in that chain?)."), fmt.Errorf("exit status 1")
+		}
+		chains[chain] = append(rules[:index], rules[index+1:]...)
+	default:
+		return nil, fmt.Errorf("unsupported iptables operation %s", op)
+	}
+	return nil, nil
+}
+
+// count 返回 table 表 chain 链上包含 substr 的规则数量
+func (f *fakeIptables) count(table, chain, substr string) int {
+	return countRules(f.chains[table+"/"+chain], substr)
+}
+
+// count6 返回 ip6tables 中 table 表 chain 链上包含 substr 的规则数量
+func (f *fakeIptables) count6(table, chain, substr string) int {
+	return countRules(f.chains6[table+"/"+chain], substr)
+}
+
+func countRules(rules []string, substr string) int {
+	n := 0
+	for _, r := range rules {
+		if strings.Contains(r, substr) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,246 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+const (
+	// iptablesChain fakedocker 在 nat 表和 filter 表中创建的链，端口映射的规则都放在其中
+	iptablesChain = "FAKEDOCKER"
+	// 隔离不同网络的两个链，与 docker 相同：第一个链匹配从某个 bridge 进入、发往其他网卡的数据包，
+	// 第二个链丢弃其中发往其他 bridge 的数据包，发往宿主机外部的数据包不受影响
+	isolationChain1 = "FAKEDOCKER-ISOLATION-STAGE-1"
+	isolationChain2 = "FAKEDOCKER-ISOLATION-STAGE-2"
+)
+
+// iptablesCmd 执行 iptables 命令，ipv6 为 true 时执行 ip6tables，测试中替换为假的实现
+var iptablesCmd = func(ipv6 bool, args ...string) ([]byte, error) {
+	// -w 等待 xtables 锁，多个 fakedocker 进程同时修改规则时不会失败
+	return exec.Command(iptablesName(ipv6), append([]string{"-w"}, args...)...).CombinedOutput()
+}
+
+func iptablesName(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func iptables(ipv6 bool, args ...string) error {
+	out, err := iptablesCmd(ipv6, args...)
+	if err != nil {
+		return fmt.Errorf("%s %s error: %v: %s", iptablesName(ipv6), strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// iptablesRule 是 table 表中 chain 链上的一条规则，ipv6 为 true 时是 ip6tables 的规则
+type iptablesRule struct {
+	table string
+	chain string
+	args  []string
+	ipv6  bool
+}
+
+// exists 通过 -C 判断规则是否存在
+func (r *iptablesRule) exists() bool {
+	_, err := iptablesCmd(r.ipv6, append([]string{"-t", r.table, "-C", r.chain}, r.args...)...)
+	return err == nil
+}
+
+// append 在规则不存在时将其追加到链的末尾
+func (r *iptablesRule) append() error {
+	if r.exists() {
+		return nil
+	}
+	return iptables(r.ipv6, append([]string{"-t", r.table, "-A", r.chain}, r.args...)...)
+}
+
+// insert 在规则不存在时将其插入到链的开头，宿主机上已有的 DROP 规则不会影响它
+func (r *iptablesRule) insert() error {
+	if r.exists() {
+		return nil
+	}
+	return iptables(r.ipv6, append([]string{"-t", r.table, "-I", r.chain}, r.args...)...)
+}
+
+// delete 删除规则，规则不存在时不返回错误
+func (r *iptablesRule) delete() error {
+	if !r.exists() {
+		return nil
+	}
+	return iptables(r.ipv6, append([]string{"-t", r.table, "-D", r.chain}, r.args...)...)
+}
+
+// ensureChain 在 table 表中创建链，已经存在时直接返回
+func ensureChain(ipv6 bool, table, chain string) error {
+	if _, err := iptablesCmd(ipv6, "-t", table, "-n", "-L", chain); err == nil {
+		return nil
+	}
+	return iptables(ipv6, "-t", table, "-N", chain)
+}
+
+// families 返回网络使用的地址族，false 为 IPv4，true 为 IPv6
+func (n *Network) families() []bool {
+	if n.IPv6 != nil {
+		return []bool{false, true}
+	}
+	return []bool{false}
+}
+
+// setUpBridgeRules 配置 bridge 网络需要的转发和 NAT 规则，双栈网络同时用 ip6tables 配置 IPv6 的规则：
+//  1. 开启 ip_forward，容器发往外部的数据包经过 MASQUERADE 后从宿主机的网卡发出，
+//     IPv6 使用 routed 模式时不做 MASQUERADE
+//  2. 允许 bridge 发出的数据包和返回给 bridge 的数据包通过 FORWARD 链
+//  3. 目的地址为宿主机的数据包交给 nat 表的 FAKEDOCKER 链做端口映射，
+//     发往 bridge 的数据包交给 filter 表的 FAKEDOCKER 链放行映射的端口
+//  4. 丢弃不同网络的 bridge 之间转发的数据包
+//  5. 宿主机上的进程通过 127.0.0.1 访问映射的端口时，DNAT 之后数据包的源地址仍然是 127.0.0.1，
+//     需要开启 bridge 的 route_localnet 才能路由到 bridge 上，再 MASQUERADE 成 bridge 的地址，
+//     同时丢弃从 bridge 进入、发往回环地址的数据包。
+//     IPv6 的 ::1 不能路由到其他网卡，映射到 ::1 的端口只能从其他地址访问
+func (n *Network) setUpBridgeRules() error {
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		zlog.New().Error("enable ip forward error", zap.Error(err))
+		return fmt.Errorf("enable ip forward error: %v", err)
+	}
+	p := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", n.Bridge)
+	if err := ioutil.WriteFile(p, []byte("1"), 0644); err != nil {
+		zlog.New().Error("enable route_localnet error", zap.String("bridge", n.Bridge), zap.Error(err))
+		return fmt.Errorf("enable route_localnet on bridge %s error: %v", n.Bridge, err)
+	}
+	if n.IPv6 != nil {
+		// 开启转发之后，accept_ra 为 1 的网卡不再接收路由通告，宿主机通过 SLAAC 获得的默认路由过期后会丢失，
+		// 所以先将默认路由所在网卡的 accept_ra 改为 2
+		if err := keepAcceptingRA(); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+			zlog.New().Error("enable ipv6 forwarding error", zap.Error(err))
+			return fmt.Errorf("enable ipv6 forwarding error: %v", err)
+		}
+	}
+
+	for _, ipv6 := range n.families() {
+		for _, c := range [][2]string{
+			{"nat", iptablesChain},
+			{"filter", iptablesChain},
+			{"filter", isolationChain1},
+			{"filter", isolationChain2},
+		} {
+			if err := ensureChain(ipv6, c[0], c[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	appends, inserts := n.bridgeRules()
+	for _, r := range appends {
+		if err := r.append(); err != nil {
+			return err
+		}
+	}
+	// 所有网络共用的规则
+	for _, ipv6 := range n.families() {
+		// 宿主机上的进程访问映射的端口，IPv6 回环地址的数据包不能 DNAT 到 bridge 上
+		output := []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", iptablesChain}
+		if ipv6 {
+			output = append([]string{"!", "-d", "::1/128"}, output...)
+		}
+		inserts = append(inserts,
+			&iptablesRule{"nat", "PREROUTING", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", iptablesChain}, ipv6},
+			&iptablesRule{"nat", "OUTPUT", output, ipv6},
+		)
+	}
+	for _, r := range inserts {
+		if err := r.insert(); err != nil {
+			return err
+		}
+	}
+
+	// 隔离规则必须在 FORWARD 链的最前面，否则后创建的网络插入的 ACCEPT 规则会先匹配，
+	// 所以每次都删除之后重新插入
+	for _, ipv6 := range n.families() {
+		jump := &iptablesRule{"filter", "FORWARD", []string{"-j", isolationChain1}, ipv6}
+		if err := jump.delete(); err != nil {
+			return err
+		}
+		if err := jump.insert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepAcceptingRA 将 IPv6 默认路由所在网卡的 accept_ra 从 1 改为 2，开启转发之后仍然接收路由通告，
+// 为 0 的网卡不接收路由通告，为 2 的已经满足要求，都保持不变
+func keepAcceptingRA() error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return fmt.Errorf("list ipv6 default routes error: %v", err)
+	}
+	for _, r := range routes {
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			continue
+		}
+		p := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", link.Attrs().Name)
+		b, err := ioutil.ReadFile(p)
+		if err != nil || strings.TrimSpace(string(b)) != "1" {
+			continue
+		}
+		if err := ioutil.WriteFile(p, []byte("2"), 0644); err != nil {
+			zlog.New().Error("set accept_ra error", zap.String("link", link.Attrs().Name), zap.Error(err))
+			return fmt.Errorf("set accept_ra of %s error: %v", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// tearDownBridgeRules 删除 setUpBridgeRules 为网络添加的规则，所有网络共用的链和规则保留
+func (n *Network) tearDownBridgeRules() error {
+	appends, inserts := n.bridgeRules()
+	for _, r := range append(appends, inserts...) {
+		if err := r.delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bridgeRules 返回网络自己的规则，分别为追加到链末尾的规则和插入到链开头的规则
+func (n *Network) bridgeRules() (appends, inserts []*iptablesRule) {
+	for _, ipv6 := range n.families() {
+		subnet := n.Subnet
+		if ipv6 {
+			subnet = n.IPv6.Subnet
+		}
+		if !ipv6 || n.IPv6.Mode != IPv6ModeRouted {
+			appends = append(appends, &iptablesRule{"nat", "POSTROUTING", []string{"-s", subnet, "!", "-o", n.Bridge, "-j", "MASQUERADE"}, ipv6})
+		}
+		if !ipv6 {
+			appends = append(appends, &iptablesRule{"nat", "POSTROUTING", []string{"-s", "127.0.0.0/8", "-o", n.Bridge, "-j", "MASQUERADE"}, ipv6})
+			// 开启 route_localnet 之后，容器和 bridge 上的其他主机发往 127.0.0.0/8 的数据包也会被路由到
+			// 宿主机只监听在回环地址上的服务（CVE-2020-8558），只放行已有连接的回包和端口映射 DNAT 的数据包
+			inserts = append(inserts, &iptablesRule{"filter", "INPUT", []string{
+				"-i", n.Bridge, "-d", "127.0.0.0/8", "!", "-s", "127.0.0.0/8",
+				"-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED,DNAT", "-j", "DROP",
+			}, ipv6})
+		}
+		inserts = append(inserts,
+			&iptablesRule{"filter", "FORWARD", []string{"-i", n.Bridge, "-j", "ACCEPT"}, ipv6},
+			&iptablesRule{"filter", "FORWARD", []string{"-o", n.Bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}, ipv6},
+			&iptablesRule{"filter", "FORWARD", []string{"-o", n.Bridge, "-j", iptablesChain}, ipv6},
+			&iptablesRule{"filter", isolationChain1, []string{"-i", n.Bridge, "!", "-o", n.Bridge, "-j", isolationChain2}, ipv6},
+			&iptablesRule{"filter", isolationChain2, []string{"-o", n.Bridge, "-j", "DROP"}, ipv6},
+		)
+	}
+	return appends, inserts
+}
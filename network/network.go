@@ -0,0 +1,163 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/ipam"
+)
+
+const (
+	// DefaultNetworkName 默认网络的名字，没有指定网络的容器都连接到这个网络
+	DefaultNetworkName = "bridge"
+	// DefaultBridgeName 默认网络使用的 bridge 设备
+	DefaultBridgeName = "fakedocker0"
+	// DefaultSubnet 默认网络的子网，避开 docker0 使用的 172.17.0.0/16
+	DefaultSubnet = "172.18.0.0/16"
+	// DefaultGateway 默认网络的网关
+	DefaultGateway = "172.18.0.1"
+	// DriverBridge 使用 bridge 连接容器的网络驱动
+	DriverBridge = "bridge"
+)
+
+// 除了连接到网络之外，run --network 还支持以下几种网络模式
+const (
+	// ModeHost 容器直接使用宿主机的 network namespace
+	ModeHost = "host"
+	// ModeNone 容器有自己的 network namespace，但是只有 lo
+	ModeNone = "none"
+	// ModeContainerPrefix container:<容器 ID> 表示加入另一个容器的 network namespace
+	ModeContainerPrefix = "container:"
+)
+
+// 网络的 IPv6 流量发往宿主机外部时的处理方式
+const (
+	// IPv6ModeNAT 与 IPv4 相同，经过 MASQUERADE 之后从宿主机的网卡发出
+	IPv6ModeNAT = "nat"
+	// IPv6ModeRouted 不做 NAT，容器直接使用自己的地址访问外部，需要上游路由器将子网路由到宿主机
+	IPv6ModeRouted = "routed"
+)
+
+// IsBridgeMode 判断网络模式 mode 是否为连接到一个 bridge 网络，为空时表示默认网络
+func IsBridgeMode(mode string) bool {
+	return mode != ModeHost && mode != ModeNone && !strings.HasPrefix(mode, ModeContainerPrefix)
+}
+
+// ipAllocator 为容器分配地址，多个 fakedocker 进程共享同一份分配记录
+var ipAllocator = ipam.New(ipam.DefaultStorePath)
+
+// Network 描述一个 bridge 网络，网络中的容器通过 veth pair 连接到同一个 bridge 上，
+// bridge 上配置网关地址，不同网络的 bridge 之间的流量会被 iptables 丢弃
+type Network struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Driver      string      `json:"driver"`         // 目前只支持 bridge
+	Bridge      string      `json:"bridge"`         // bridge 设备名
+	Subnet      string      `json:"subnet"`         // 子网，比如 172.18.0.0/16
+	Gateway     string      `json:"gateway"`        // 网关地址，为空时使用子网中的第一个地址
+	IPv6        *IPv6Config `json:"ipv6,omitempty"` // 为 nil 时网络只有 IPv4
+	CreatedTime string      `json:"created_time"`
+}
+
+// IPv6Config 双栈网络的 IPv6 配置
+type IPv6Config struct {
+	Subnet  string `json:"subnet"`  // 子网，比如 fd12:3456:789a::/64
+	Gateway string `json:"gateway"` // 网关地址，为空时使用子网中的第一个地址
+	Mode    string `json:"mode"`    // nat 或 routed
+}
+
+// Endpoint 记录容器连接到网络时的配置
+type Endpoint struct {
+	Network     string   `json:"network"`
+	HostVeth    string   `json:"host_veth"`              // veth pair 在宿主机上的一端，连接在 bridge 上
+	Interface   string   `json:"interface"`              // veth pair 在容器中的一端，比如 eth0
+	IPAddress   string   `json:"ip_address"`             // 容器网卡的地址，带前缀长度，比如 172.18.0.2/16
+	Gateway     string   `json:"gateway"`                // 网关地址
+	MacAddress  string   `json:"mac_address"`            // 容器网卡的 MAC 地址
+	IPv6Address string   `json:"ipv6_address,omitempty"` // 容器网卡的 IPv6 地址，网络没有 IPv6 时为空
+	IPv6Gateway string   `json:"ipv6_gateway,omitempty"`
+	Aliases     []string `json:"aliases"` // 容器在网络中的别名，同一网络中的其他容器可以通过别名访问它
+}
+
+// DefaultNetwork 返回默认网络
+func DefaultNetwork() *Network {
+	return &Network{Name: DefaultNetworkName, Driver: DriverBridge, Bridge: DefaultBridgeName, Subnet: DefaultSubnet, Gateway: DefaultGateway}
+}
+
+// subnet 解析网络的 IPv4 子网
+func (n *Network) subnet() (*net.IPNet, error) {
+	return parseSubnet(n.Name, n.Subnet, false)
+}
+
+// subnet6 解析网络的 IPv6 子网
+func (n *Network) subnet6() (*net.IPNet, error) {
+	if n.IPv6 == nil {
+		return nil, fmt.Errorf("network %s does not have IPv6 enabled", n.Name)
+	}
+	return parseSubnet(n.Name, n.IPv6.Subnet, true)
+}
+
+// gateway 返回网络的 IPv4 网关，带前缀长度，没有指定网关时使用子网中的第一个地址
+func (n *Network) gateway() (*net.IPNet, error) {
+	subnet, err := n.subnet()
+	if err != nil {
+		return nil, err
+	}
+	return subnetGateway(n.Name, subnet, n.Gateway)
+}
+
+// gateway6 返回网络的 IPv6 网关，带前缀长度
+func (n *Network) gateway6() (*net.IPNet, error) {
+	subnet, err := n.subnet6()
+	if err != nil {
+		return nil, err
+	}
+	return subnetGateway(n.Name, subnet, n.IPv6.Gateway)
+}
+
+// subnets 返回网络的所有子网，IPv4 在前
+func (n *Network) subnets() []string {
+	subnets := []string{n.Subnet}
+	if n.IPv6 != nil {
+		subnets = append(subnets, n.IPv6.Subnet)
+	}
+	return subnets
+}
+
+// parseSubnet 解析网络 name 的子网 s，ipv6 表示 s 应该是 IPv6 还是 IPv4 子网
+func parseSubnet(name, s string, ipv6 bool) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q of network %s: %v", s, name, err)
+	}
+	if ipv6 && subnet.IP.To4() != nil {
+		return nil, fmt.Errorf("subnet %s of network %s is not an IPv6 subnet", s, name)
+	}
+	if !ipv6 && subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %s of network %s is not an IPv4 subnet", s, name)
+	}
+	return subnet, nil
+}
+
+// subnetGateway 返回子网中的网关 gateway，为空时使用子网中的第一个地址
+func subnetGateway(name string, subnet *net.IPNet, gateway string) (*net.IPNet, error) {
+	if gateway == "" {
+		return &net.IPNet{IP: ipam.Gateway(subnet), Mask: subnet.Mask}, nil
+	}
+	ip := net.ParseIP(gateway)
+	if ip == nil || !subnet.Contains(ip) {
+		return nil, fmt.Errorf("gateway %q of network %s is not in subnet %s", gateway, name, subnet)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}, nil
+}
+
+// macAddress 根据 IPv4 地址生成 MAC 地址，与 docker 相同使用 02:42 前缀，
+// 02 表示本地管理的单播地址，同一个地址的容器重新创建后 MAC 地址不变，不需要刷新邻居的 ARP 缓存
+func macAddress(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	return net.HardwareAddr{0x02, 0x42, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
@@ -0,0 +1,27 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMacAddress(t *testing.T) {
+	if mac := macAddress(net.ParseIP("172.18.0.2")).String(); mac != "02:42:ac:12:00:02" {
+		t.Fatalf("mac = %s, want 02:42:ac:12:00:02", mac)
+	}
+}
+
+func TestIsBridgeMode(t *testing.T) {
+	for mode, want := range map[string]bool{
+		"":             true,
+		"bridge":       true,
+		"mynet":        true,
+		"host":         false,
+		"none":         false,
+		"container:ab": false,
+	} {
+		if got := IsBridgeMode(mode); got != want {
+			t.Fatalf("IsBridgeMode(%q) = %v, want %v", mode, got, want)
+		}
+	}
+}
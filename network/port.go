@@ -0,0 +1,125 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 端口映射支持的协议
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// PortMapping 将宿主机的端口映射到容器的端口
+type PortMapping struct {
+	HostIP        string `json:"host_ip"`   // 为空表示宿主机的所有地址
+	HostPort      int    `json:"host_port"` // 为 0 表示随机分配
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol"`
+}
+
+// String 返回 docker ps 风格的端口映射，比如 0.0.0.0:8080->80/tcp
+func (p *PortMapping) String() string {
+	return fmt.Sprintf("%s->%d/%s", p.HostAddress(), p.ContainerPort, p.Protocol)
+}
+
+// HostAddress 返回映射在宿主机上监听的地址，比如 0.0.0.0:8080
+func (p *PortMapping) HostAddress() string {
+	return net.JoinHostPort(p.hostIP(), strconv.Itoa(p.HostPort))
+}
+
+func (p *PortMapping) hostIP() string {
+	if p.HostIP == "" {
+		return "0.0.0.0"
+	}
+	return p.HostIP
+}
+
+// ParsePortMapping 解析 -p 参数，支持以下格式，都可以加上 /tcp 或 /udp 后缀，默认为 tcp：
+//
+//	containerPort                 宿主机端口随机分配
+//	hostPort:containerPort
+//	ip:hostPort:containerPort
+//	ip::containerPort             只监听 ip，宿主机端口随机分配
+//
+// IPv6 地址需要放在方括号中，比如 [::1]:8080:80；0.0.0.0 和 [::] 被当作不指定地址
+func ParsePortMapping(s string) (*PortMapping, error) {
+	p := &PortMapping{Protocol: ProtocolTCP}
+	spec := s
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		p.Protocol = strings.ToLower(spec[i+1:])
+		spec = spec[:i]
+		if p.Protocol != ProtocolTCP && p.Protocol != ProtocolUDP {
+			return nil, fmt.Errorf("invalid protocol %q in port mapping %q, only tcp and udp are supported", p.Protocol, s)
+		}
+	}
+
+	var hostPort, containerPort string
+	if strings.HasPrefix(spec, "[") {
+		i := strings.Index(spec, "]:")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid port mapping %q", s)
+		}
+		ip := net.ParseIP(spec[1:i])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid host IP %q in port mapping %q", spec[1:i], s)
+		}
+		p.HostIP = ip.String()
+		parts := strings.Split(spec[i+2:], ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid port mapping %q", s)
+		}
+		hostPort, containerPort = parts[0], parts[1]
+	} else {
+		parts := strings.Split(spec, ":")
+		switch len(parts) {
+		case 1:
+			containerPort = parts[0]
+		case 2:
+			hostPort, containerPort = parts[0], parts[1]
+		case 3:
+			p.HostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+			ip := net.ParseIP(p.HostIP)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid host IP %q in port mapping %q", p.HostIP, s)
+			}
+		default:
+			return nil, fmt.Errorf("invalid port mapping %q", s)
+		}
+	}
+	// 0.0.0.0 和 :: 与不指定地址相同，都表示宿主机的所有地址，规则中不能出现 -d 0.0.0.0，
+	// 检查端口冲突时也需要把它们当作通配地址
+	if ip := net.ParseIP(p.HostIP); ip != nil && ip.IsUnspecified() {
+		p.HostIP = ""
+	}
+
+	var err error
+	if p.ContainerPort, err = parsePort(containerPort); err != nil || p.ContainerPort == 0 {
+		return nil, fmt.Errorf("invalid container port %q in port mapping %q", containerPort, s)
+	}
+	if hostPort != "" {
+		if p.HostPort, err = parsePort(hostPort); err != nil || p.HostPort == 0 {
+			return nil, fmt.Errorf("invalid host port %q in port mapping %q", hostPort, s)
+		}
+	}
+	return p, nil
+}
+
+// ParseExposedPort 解析 --expose 参数，格式为 containerPort[/tcp|udp]，-P 时将它们映射到随机的宿主机端口
+func ParseExposedPort(s string) (*PortMapping, error) {
+	if strings.Contains(s, ":") {
+		return nil, fmt.Errorf("invalid exposed port %q, format is port[/tcp|udp]", s)
+	}
+	return ParsePortMapping(s)
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(port), nil
+}
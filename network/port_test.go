@@ -0,0 +1,61 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PortMapping
+	}{
+		{"80", PortMapping{"", 0, 80, "tcp"}},
+		{"8080:80", PortMapping{"", 8080, 80, "tcp"}},
+		{"8080:80/udp", PortMapping{"", 8080, 80, "udp"}},
+		{"127.0.0.1:8080:80/TCP", PortMapping{"127.0.0.1", 8080, 80, "tcp"}},
+		{"127.0.0.1::53/udp", PortMapping{"127.0.0.1", 0, 53, "udp"}},
+		{"[::1]:8080:80", PortMapping{"::1", 8080, 80, "tcp"}},
+		{"[fd00:0::1]::53/udp", PortMapping{"fd00::1", 0, 53, "udp"}},
+		// 未指定的地址表示宿主机的所有地址
+		{"0.0.0.0:8080:80", PortMapping{"", 8080, 80, "tcp"}},
+		{"0.0.0.0::80", PortMapping{"", 0, 80, "tcp"}},
+		{"[::]:8080:80/udp", PortMapping{"", 8080, 80, "udp"}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortMapping(tt.in)
+		if err != nil {
+			t.Fatalf("ParsePortMapping(%q) error: %v", tt.in, err)
+		}
+		if *got != tt.want {
+			t.Fatalf("ParsePortMapping(%q) = %+v, want %+v", tt.in, *got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "0", "http", "8080:0", "0:80", "65536:80", "8080:80/sctp", "localhost:8080:80", "1:2:3:4",
+		"::1:8080:80", "[::1]8080:80", "[::1]:80", "[127.0.0.1]:8080:80",
+	} {
+		if _, err := ParsePortMapping(in); err == nil {
+			t.Fatalf("ParsePortMapping(%q) should fail", in)
+		}
+	}
+
+	if _, err := ParseExposedPort("8080:80"); err == nil {
+		t.Fatal("ParseExposedPort with host port should fail")
+	}
+}
+
+func TestPortMappingString(t *testing.T) {
+	p := &PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	if s := p.String(); s != "0.0.0.0:8080->80/tcp" {
+		t.Fatalf("String() = %s", s)
+	}
+	p.HostIP = "127.0.0.1"
+	p.Protocol = "udp"
+	if s := p.String(); s != "127.0.0.1:8080->80/udp" {
+		t.Fatalf("String() = %s", s)
+	}
+	p.HostIP = "::1"
+	if s := p.String(); s != "[::1]:8080->80/udp" {
+		t.Fatalf("String() = %s", s)
+	}
+}
@@ -0,0 +1,221 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// 随机分配宿主机端口时最多尝试的次数
+const maxHostPortAttempts = 100
+
+// WithPortLock 加文件锁之后调用 fn，端口映射的规则不会占用宿主机的端口，检查冲突时只能依据其他容器
+// 记录下来的映射，所以读取 used、PublishPorts 和记录映射结果都需要在 fn 中完成，
+// 否则同时启动的两个容器可能映射到相同的宿主机端口
+func WithPortLock(fn func() error) error {
+	if err := os.MkdirAll(NetworkLocation, 0755); err != nil {
+		zlog.New().Error("mkdir network dir error", zap.String("path", NetworkLocation), zap.Error(err))
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(NetworkLocation, ".ports.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("lock ports error: %v", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+	return fn()
+}
+
+// PublishPorts 为连接在 ep 上的容器安装端口映射规则，HostPort 为 0 的映射分配一个随机的宿主机端口，
+// used 是其他运行中的容器已经映射的端口，返回实际生效的映射；安装失败时删除已经安装的规则。
+// 容器有 IPv6 地址时，没有指定宿主机地址的映射同时安装 IPv6 的规则。调用者需要持有 WithPortLock 的锁
+func PublishPorts(containerID string, ep *Endpoint, ports, used []*PortMapping) (published []*PortMapping, err error) {
+	defer func() {
+		if err != nil {
+			UnpublishPorts(containerID, ep, published)
+			published = nil
+		}
+	}()
+
+	for _, p := range ports {
+		mapping := *p
+		taken := append(append([]*PortMapping{}, used...), published...)
+		if mapping.HostPort == 0 {
+			if mapping.HostPort, err = allocateHostPort(&mapping, taken); err != nil {
+				return published, err
+			}
+		} else if err = checkHostPort(&mapping, taken); err != nil {
+			return published, err
+		}
+
+		var rules []*iptablesRule
+		if rules, err = endpointPortRules(containerID, ep, &mapping); err != nil {
+			return published, err
+		}
+		for _, r := range rules {
+			if err = r.append(); err != nil {
+				zlog.New().Error("install port mapping rule error", zap.String("mapping", mapping.String()), zap.Error(err))
+				return published, err
+			}
+		}
+		published = append(published, &mapping)
+	}
+	return published, nil
+}
+
+// UnpublishPorts 删除容器的端口映射规则，规则不存在时不返回错误，可以重复调用
+func UnpublishPorts(containerID string, ep *Endpoint, ports []*PortMapping) error {
+	var firstErr error
+	for _, p := range ports {
+		rules, err := endpointPortRules(containerID, ep, p)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, r := range rules {
+			if err := r.delete(); err != nil {
+				zlog.New().Error("delete port mapping rule error", zap.String("mapping", p.String()), zap.Error(err))
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// endpointPortRules 返回容器在 ep 上的端口映射 p 需要的规则，宿主机地址为 IPv4 地址时只映射到容器的 IPv4 地址，
+// 为 IPv6 地址时只映射到容器的 IPv6 地址，为空时映射到容器的所有地址
+func endpointPortRules(containerID string, ep *Endpoint, p *PortMapping) ([]*iptablesRule, error) {
+	var hostIPv6 bool
+	if p.HostIP != "" {
+		hostIPv6 = net.ParseIP(p.HostIP).To4() == nil
+	}
+	var rules []*iptablesRule
+	for _, addr := range []string{ep.IPAddress, ep.IPv6Address} {
+		if addr == "" {
+			continue
+		}
+		containerIP, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q of endpoint: %v", addr, err)
+		}
+		if p.HostIP != "" && hostIPv6 != (containerIP.To4() == nil) {
+			continue
+		}
+		rules = append(rules, portRules(containerID, containerIP, p)...)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("container has no IPv6 address on network %s for port mapping %s", ep.Network, p)
+	}
+	return rules, nil
+}
+
+// portRules 返回端口映射 p 需要的规则，规则中带有容器 ID 的注释，容器的地址被复用之后
+// 删除旧容器的规则也不会影响新容器：
+//  1. DNAT：发往宿主机端口的数据包转发到容器，不限制入口网卡，容器通过宿主机地址也能访问自己映射的端口
+//  2. hairpin：容器访问自己映射的端口时，DNAT 之后源地址和目的地址相同，需要 MASQUERADE 成网关地址，
+//     否则容器收到的回包的源地址不对，bridge 上的 veth 需要开启 hairpin 模式才能将数据包发回原来的端口
+//  3. 放行转发到容器端口的数据包
+func portRules(containerID string, containerIP net.IP, p *PortMapping) []*iptablesRule {
+	ipv6 := containerIP.To4() == nil
+	comment := []string{"-m", "comment", "--comment", containerID}
+	port := strconv.Itoa(p.ContainerPort)
+
+	dnat := []string{}
+	if p.HostIP != "" {
+		dnat = append(dnat, "-d", p.HostIP)
+	}
+	dnat = append(dnat,
+		"-p", p.Protocol, "-m", p.Protocol, "--dport", strconv.Itoa(p.HostPort),
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(containerIP.String(), port),
+	)
+
+	return []*iptablesRule{
+		{"nat", iptablesChain, append(dnat, comment...), ipv6},
+		{"nat", "POSTROUTING", append([]string{
+			"-s", containerIP.String(), "-d", containerIP.String(),
+			"-p", p.Protocol, "-m", p.Protocol, "--dport", port, "-j", "MASQUERADE",
+		}, comment...), ipv6},
+		{"filter", iptablesChain, append([]string{
+			"-d", containerIP.String(), "-p", p.Protocol, "-m", p.Protocol, "--dport", port, "-j", "ACCEPT",
+		}, comment...), ipv6},
+	}
+}
+
+// conflicts 判断两个映射是否占用了宿主机上相同的端口
+func conflicts(a, b *PortMapping) bool {
+	return a.Protocol == b.Protocol && a.HostPort == b.HostPort &&
+		(a.HostIP == "" || b.HostIP == "" || a.HostIP == b.HostIP)
+}
+
+// checkHostPort 检查宿主机端口没有被其他容器映射，也没有被宿主机上的进程监听
+func checkHostPort(p *PortMapping, taken []*PortMapping) error {
+	for _, t := range taken {
+		if conflicts(p, t) {
+			return fmt.Errorf("bind for %s:%d failed: port is already allocated", p.hostIP(), p.HostPort)
+		}
+	}
+	port, err := bindHostPort(p.Protocol, p.HostIP, p.HostPort)
+	if err != nil {
+		return err
+	}
+	if port != p.HostPort {
+		return fmt.Errorf("bind for %s:%d failed: got port %d", p.hostIP(), p.HostPort, port)
+	}
+	return nil
+}
+
+// allocateHostPort 由内核在临时端口范围中选择一个空闲的端口，并跳过已经被其他容器映射的端口
+func allocateHostPort(p *PortMapping, taken []*PortMapping) (int, error) {
+	for i := 0; i < maxHostPortAttempts; i++ {
+		port, err := bindHostPort(p.Protocol, p.HostIP, 0)
+		if err != nil {
+			return 0, err
+		}
+		candidate := *p
+		candidate.HostPort = port
+		free := true
+		for _, t := range taken {
+			if conflicts(&candidate, t) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no available host port for %d/%s", p.ContainerPort, p.Protocol)
+}
+
+// bindHostPort 尝试监听宿主机端口后立即关闭，返回实际监听的端口
+func bindHostPort(protocol, ip string, port int) (int, error) {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	family := "4"
+	if ip != "" && net.ParseIP(ip).To4() == nil {
+		family = "6"
+	}
+	if protocol == ProtocolUDP {
+		conn, err := net.ListenPacket("udp"+family, addr)
+		if err != nil {
+			return 0, fmt.Errorf("bind for %s/udp failed: %v", addr, err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	l, err := net.Listen("tcp"+family, addr)
+	if err != nil {
+		return 0, fmt.Errorf("bind for %s/tcp failed: %v", addr, err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,301 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestPublishPorts(t *testing.T) {
+	f := useFakeIptables(t)
+	for _, ipv6 := range []bool{false, true} {
+		for _, table := range []string{"nat", "filter"} {
+			if err := ensureChain(ipv6, table, iptablesChain); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ep := &Endpoint{Network: "bridge", HostVeth: "veth0123456", IPAddress: "172.18.0.2/16"}
+	ports := []*PortMapping{
+		{HostPort: 18080, ContainerPort: 80, Protocol: ProtocolTCP},
+		{HostIP: "127.0.0.1", ContainerPort: 53, Protocol: ProtocolUDP},
+	}
+
+	published, err := PublishPorts("c1", ep, ports, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 2 || published[0].HostPort != 18080 || published[1].HostPort == 0 {
+		t.Fatalf("published = %v", published)
+	}
+	if ports[1].HostPort != 0 {
+		t.Fatal("PublishPorts should not modify the requested mappings")
+	}
+	if n := f.count("nat", iptablesChain, "--dport 18080 -j DNAT --to-destination 172.18.0.2:80 -m comment --comment c1"); n != 1 {
+		t.Fatalf("dnat rules = %v", f.chains["nat/"+iptablesChain])
+	}
+	if n := f.count("nat", iptablesChain, "-d 127.0.0.1 -p udp"); n != 1 {
+		t.Fatalf("dnat rules = %v", f.chains["nat/"+iptablesChain])
+	}
+	if n := f.count("nat", "POSTROUTING", "-s 172.18.0.2 -d 172.18.0.2"); n != 2 {
+		t.Fatalf("hairpin rules = %v", f.chains["nat/POSTROUTING"])
+	}
+	if n := f.count("filter", iptablesChain, "-d 172.18.0.2"); n != 2 {
+		t.Fatalf("filter rules = %v", f.chains["filter/"+iptablesChain])
+	}
+
+	// 其他容器不能再映射相同的宿主机端口
+	other := &Endpoint{IPAddress: "172.18.0.3/16"}
+	if _, err := PublishPorts("c2", other, []*PortMapping{{HostIP: "127.0.0.1", HostPort: 18080, ContainerPort: 80, Protocol: ProtocolTCP}}, published); err == nil {
+		t.Fatal("publish allocated port should fail")
+	}
+	// 0.0.0.0 与不指定地址映射的是同一个端口
+	wildcard, err := ParsePortMapping("0.0.0.0:18080:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublishPorts("c2", other, []*PortMapping{wildcard}, published); err == nil {
+		t.Fatal("publish allocated port on 0.0.0.0 should fail")
+	}
+	// 失败时已经安装的规则会被删除
+	_, err = PublishPorts("c2", other, []*PortMapping{
+		{HostPort: 18081, ContainerPort: 80, Protocol: ProtocolTCP},
+		{HostPort: 18080, ContainerPort: 80, Protocol: ProtocolTCP},
+	}, published)
+	if err == nil {
+		t.Fatal("publish allocated port should fail")
+	}
+	if n := f.count("nat", iptablesChain, "c2"); n != 0 {
+		t.Fatalf("rules of failed container are not removed: %v", f.chains["nat/"+iptablesChain])
+	}
+
+	// 宿主机上已经被监听的端口
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	busy := &PortMapping{HostIP: "127.0.0.1", HostPort: l.Addr().(*net.TCPAddr).Port, ContainerPort: 80, Protocol: ProtocolTCP}
+	if _, err := PublishPorts("c2", other, []*PortMapping{busy}, nil); err == nil {
+		t.Fatal("publish port in use should fail")
+	}
+
+	if err := UnpublishPorts("c1", ep, published); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"nat/" + iptablesChain, "nat/POSTROUTING", "filter/" + iptablesChain} {
+		if len(f.chains[c]) != 0 {
+			t.Fatalf("rules in %s are not removed: %v", c, f.chains[c])
+		}
+	}
+	if err := UnpublishPorts("c1", ep, published); err != nil {
+		t.Fatalf("unpublish twice should not fail: %v", err)
+	}
+
+	// 双栈的容器同时映射 IPv6，指定了 IPv6 宿主机地址的映射只映射到容器的 IPv6 地址
+	if _, err := PublishPorts("c3", other, []*PortMapping{{HostIP: "::1", ContainerPort: 80, Protocol: ProtocolTCP}}, nil); err == nil {
+		t.Fatal("publish ipv6 host address for container without ipv6 address should fail")
+	}
+	dual := &Endpoint{IPAddress: "172.18.0.4/16", IPv6Address: "fd00::4/64"}
+	published, err = PublishPorts("c4", dual, []*PortMapping{
+		{HostPort: 18082, ContainerPort: 80, Protocol: ProtocolTCP},
+		{HostIP: "::1", ContainerPort: 81, Protocol: ProtocolTCP},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("nat", iptablesChain, "--dport 18082 -j DNAT --to-destination 172.18.0.4:80"); n != 1 {
+		t.Fatalf("dnat rules = %v", f.chains["nat/"+iptablesChain])
+	}
+	if n := f.count6("nat", iptablesChain, "--dport 18082 -j DNAT --to-destination [fd00::4]:80"); n != 1 {
+		t.Fatalf("ipv6 dnat rules = %v", f.chains6["nat/"+iptablesChain])
+	}
+	if n := f.count6("nat", iptablesChain, "-d ::1 -p tcp"); n != 1 || f.count("nat", iptablesChain, ":81") != 0 {
+		t.Fatalf("dnat rules = %v, ipv6 dnat rules = %v", f.chains["nat/"+iptablesChain], f.chains6["nat/"+iptablesChain])
+	}
+	if err := UnpublishPorts("c4", dual, published); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.chains6["nat/"+iptablesChain]) != 0 || len(f.chains6["filter/"+iptablesChain]) != 0 {
+		t.Fatalf("ipv6 rules are not removed: %v", f.chains6)
+	}
+}
+
+// addTestBridges 创建网络的 bridge，setUpBridgeRules 需要修改 bridge 的内核参数
+func addTestBridges(t *testing.T, networks ...*Network) {
+	for _, n := range networks {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = n.Bridge
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: attrs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// addTestUplink 创建一块带有 IPv6 默认路由、接收路由通告的网卡，模拟宿主机的上联网卡
+func addTestUplink(t *testing.T) string {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = "uplink0"
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: attrs, PeerName: "uplink0-peer"}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := netlink.LinkByName(attrs.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ key, value string }{{"disable_ipv6", "0"}, {"accept_ra", "1"}} {
+		p := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/%s", attrs.Name, c.key)
+		if err := ioutil.WriteFile(p, []byte(c.value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr, err := netlink.ParseAddr("2001:db8::2/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr.Flags = unix.IFA_F_NODAD
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		t.Fatal(err)
+	}
+	// veth 的两端都 up 之后网卡才有载波
+	for _, name := range []string{"uplink0-peer", attrs.Name} {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("2001:db8::1")}); err != nil {
+		t.Fatal(err)
+	}
+	return attrs.Name
+}
+
+func TestSetUpBridgeRules(t *testing.T) {
+	f := useFakeIptables(t)
+	n := &Network{Name: "test", Bridge: "br-test", Subnet: "10.10.0.0/24"}
+	other := &Network{Name: "other", Bridge: "br-other", Subnet: "10.20.0.0/24"}
+	withTestNetNS(t, func() {
+		addTestBridges(t, n, other)
+		for _, network := range []*Network{n, n, other} {
+			if err := network.setUpBridgeRules(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	// 重复调用不会添加重复的规则
+	if got := f.count("nat", "POSTROUTING", "-s 10.10.0.0/24 ! -o br-test -j MASQUERADE"); got != 1 {
+		t.Fatalf("masquerade rules = %v", f.chains["nat/POSTROUTING"])
+	}
+	if got := f.count("nat", "PREROUTING", "-j "+iptablesChain); got != 1 {
+		t.Fatalf("prerouting rules = %v", f.chains["nat/PREROUTING"])
+	}
+	if got := f.count("nat", "POSTROUTING", "-s 127.0.0.0/8 -o br-test -j MASQUERADE"); got != 1 {
+		t.Fatalf("localhost masquerade rules = %v", f.chains["nat/POSTROUTING"])
+	}
+	// 从 bridge 进入的发往回环地址的数据包被丢弃
+	guard := "-i br-test -d 127.0.0.0/8 ! -s 127.0.0.0/8 -m conntrack ! --ctstate RELATED,ESTABLISHED,DNAT -j DROP"
+	if got := f.count("filter", "INPUT", guard); got != 1 {
+		t.Fatalf("input rules = %v", f.chains["filter/INPUT"])
+	}
+	// 隔离规则在 FORWARD 链的最前面
+	forward := f.chains["filter/FORWARD"]
+	if len(forward) != 7 || forward[0] != "-j "+isolationChain1 {
+		t.Fatalf("forward rules = %v", forward)
+	}
+	if got := len(f.chains["filter/"+isolationChain1]); got != 2 {
+		t.Fatalf("isolation stage 1 rules = %v", f.chains["filter/"+isolationChain1])
+	}
+	if got := f.count("filter", isolationChain2, "-o br-other -j DROP"); got != 1 {
+		t.Fatalf("isolation stage 2 rules = %v", f.chains["filter/"+isolationChain2])
+	}
+
+	// 删除网络时只删除它自己的规则
+	if err := other.tearDownBridgeRules(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"nat/POSTROUTING", "filter/INPUT", "filter/FORWARD", "filter/" + isolationChain1, "filter/" + isolationChain2} {
+		for _, r := range f.chains[c] {
+			if strings.Contains(r, "br-other") || strings.Contains(r, "10.20.0.0/24") {
+				t.Fatalf("rule %q of removed network is left in %s", r, c)
+			}
+		}
+	}
+	if got := len(f.chains["filter/FORWARD"]); got != 4 {
+		t.Fatalf("forward rules = %v", f.chains["filter/FORWARD"])
+	}
+	if got := f.count("nat", "PREROUTING", "-j "+iptablesChain); got != 1 {
+		t.Fatalf("shared prerouting rule should be kept: %v", f.chains["nat/PREROUTING"])
+	}
+	if len(f.chains6["nat/POSTROUTING"]) != 0 {
+		t.Fatalf("ipv4 only network should not add ip6tables rules: %v", f.chains6)
+	}
+
+	// routed 模式的 IPv6 不做 MASQUERADE
+	dual := &Network{Name: "dual", Bridge: "br-dual", Subnet: "10.30.0.0/24", IPv6: &IPv6Config{Subnet: "fd00:30::/64", Mode: IPv6ModeRouted}}
+	withTestNetNS(t, func() {
+		addTestBridges(t, dual)
+		uplink := addTestUplink(t)
+		if err := dual.setUpBridgeRules(); err != nil {
+			t.Fatal(err)
+		}
+		// 开启 IPv6 转发之后宿主机的默认路由所在网卡仍然接收路由通告
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", uplink))
+		if err != nil || strings.TrimSpace(string(b)) != "2" {
+			t.Fatalf("accept_ra of %s = %q, %v", uplink, b, err)
+		}
+	})
+	if f.count("nat", "POSTROUTING", "-s 10.30.0.0/24") != 1 || f.count6("nat", "POSTROUTING", "fd00:30::/64") != 0 {
+		t.Fatalf("masquerade rules = %v, ipv6 = %v", f.chains["nat/POSTROUTING"], f.chains6["nat/POSTROUTING"])
+	}
+	if f.count6("filter", "FORWARD", "-i br-dual -j ACCEPT") != 1 || f.count6("nat", "OUTPUT", "! -d ::1/128") != 1 {
+		t.Fatalf("ipv6 rules = %v", f.chains6)
+	}
+}
+
+func TestWithPortLock(t *testing.T) {
+	useTestNetworkLocation(t)
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- WithPortLock(func() error {
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	// 锁被持有时其他调用者等待，直到锁被释放
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- WithPortLock(func() error { return nil })
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("port lock acquired twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("port lock is not released")
+	}
+}
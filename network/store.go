@@ -0,0 +1,419 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/ipam"
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// NetworkLocation 网络配置的存放目录，每个网络对应其中的一个文件 NetworkLocation/<网络名>.json
+var NetworkLocation = "/var/run/fakedocker/network/networks"
+
+// gatewayOwner 网关地址在 IPAM 中的使用者
+const gatewayOwner = "gateway"
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// CreateNetwork 创建一个网络并保存到 NetworkLocation 中，subnet 为空时从地址池中选择一个
+// 与其他网络不重叠的子网，gateway 为空时使用子网中的第一个地址；bridge 在第一个容器连接时创建。
+// ipv6 不为 nil 时创建双栈网络，其中的子网为空时生成一个随机的 ULA /64 子网
+func CreateNetwork(name, driver, subnet, gateway string, ipv6 *IPv6Config) (*Network, error) {
+	if !validNetworkName.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	if name == ModeHost || name == ModeNone {
+		return nil, fmt.Errorf("network name %s is reserved for network mode", name)
+	}
+	if driver != DriverBridge {
+		return nil, fmt.Errorf("network driver %q is not supported, only %s is supported", driver, DriverBridge)
+	}
+	if gateway != "" && subnet == "" {
+		return nil, fmt.Errorf("--gateway requires --subnet")
+	}
+	if ipv6 != nil {
+		v6 := *ipv6
+		if v6.Mode == "" {
+			v6.Mode = IPv6ModeNAT
+		}
+		if v6.Mode != IPv6ModeNAT && v6.Mode != IPv6ModeRouted {
+			return nil, fmt.Errorf("invalid IPv6 mode %q, only %s and %s are supported", v6.Mode, IPv6ModeNAT, IPv6ModeRouted)
+		}
+		if v6.Gateway != "" && v6.Subnet == "" {
+			return nil, fmt.Errorf("IPv6 gateway requires an IPv6 subnet")
+		}
+		ipv6 = &v6
+	}
+
+	id := newNetworkID()
+	n := &Network{
+		ID:          id,
+		Name:        name,
+		Driver:      driver,
+		Bridge:      "br-" + id[:12],
+		Gateway:     gateway,
+		IPv6:        ipv6,
+		CreatedTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	err := withNetworks(func(networks []*Network) error {
+		for _, other := range networks {
+			if other.Name == name {
+				return fmt.Errorf("network with name %s already exists", name)
+			}
+		}
+		if subnet == "" {
+			s, err := allocateSubnet(networks)
+			if err != nil {
+				return err
+			}
+			n.Subnet = s.String()
+		} else {
+			_, s, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return fmt.Errorf("invalid subnet %q: %v", subnet, err)
+			}
+			if other := overlappingNetwork(s, networks); other != nil {
+				return fmt.Errorf("subnet %s overlaps with network %s (%s)", s, other.Name, other.Subnet)
+			}
+			n.Subnet = s.String()
+		}
+		gateway, err := n.gateway()
+		if err != nil {
+			return err
+		}
+		n.Gateway = gateway.IP.String()
+		if ipv6 != nil {
+			if err := n.setUpSubnet6(networks); err != nil {
+				return err
+			}
+		}
+		if err := n.reserveGateway(); err != nil {
+			return err
+		}
+		if err := saveNetwork(n); err != nil {
+			n.releaseGateway()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// setUpSubnet6 检查或者生成网络的 IPv6 子网，并填充 IPv6 网关
+func (n *Network) setUpSubnet6(networks []*Network) error {
+	if n.IPv6.Subnet == "" {
+		s, err := allocateSubnet6(networks)
+		if err != nil {
+			return err
+		}
+		n.IPv6.Subnet = s.String()
+	} else {
+		_, s, err := net.ParseCIDR(n.IPv6.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid IPv6 subnet %q: %v", n.IPv6.Subnet, err)
+		}
+		if s.IP.To4() != nil {
+			return fmt.Errorf("subnet %s is not an IPv6 subnet", s)
+		}
+		if other := overlappingNetwork(s, networks); other != nil {
+			return fmt.Errorf("subnet %s overlaps with network %s (%s)", s, other.Name, strings.Join(other.subnets(), ", "))
+		}
+		n.IPv6.Subnet = s.String()
+	}
+	gateway, err := n.gateway6()
+	if err != nil {
+		return err
+	}
+	n.IPv6.Gateway = gateway.IP.String()
+	return nil
+}
+
+// LoadNetwork 读取名为 name 的网络
+func LoadNetwork(name string) (*Network, error) {
+	var result *Network
+	err := withNetworks(func(networks []*Network) error {
+		for _, n := range networks {
+			if n.Name == name {
+				result = n
+				return nil
+			}
+		}
+		return fmt.Errorf("network %s not found", name)
+	})
+	return result, err
+}
+
+// ListNetworks 返回所有网络，按名字排序
+func ListNetworks() ([]*Network, error) {
+	var result []*Network
+	err := withNetworks(func(networks []*Network) error {
+		result = networks
+		return nil
+	})
+	return result, err
+}
+
+// RemoveNetwork 删除网络的 bridge 和 iptables 规则，并删除网络的配置，默认网络不能删除。
+// inUse 在网络的锁中检查是否还有运行中的容器连接在网络上，返回错误时不删除
+func RemoveNetwork(name string, inUse func(name string) error) error {
+	if name == DefaultNetworkName {
+		return fmt.Errorf("%s is a pre-defined network and cannot be removed", name)
+	}
+	return withNetworks(func(networks []*Network) error {
+		for _, n := range networks {
+			if n.Name != name {
+				continue
+			}
+			if err := inUse(name); err != nil {
+				return err
+			}
+			if err := n.destroy(); err != nil {
+				return err
+			}
+			n.releaseGateway()
+			p := filepath.Join(NetworkLocation, n.Name+".json")
+			if err := os.Remove(p); err != nil {
+				zlog.New().Error("remove network config error", zap.String("path", p), zap.Error(err))
+				return err
+			}
+			return nil
+		}
+		return fmt.Errorf("network %s not found", name)
+	})
+}
+
+// withNetworks 加文件锁之后读取所有网络并调用 fn，默认网络不存在时先创建它
+func withNetworks(fn func(networks []*Network) error) error {
+	if err := os.MkdirAll(NetworkLocation, 0755); err != nil {
+		zlog.New().Error("mkdir network dir error", zap.String("path", NetworkLocation), zap.Error(err))
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(NetworkLocation, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("lock %s error: %v", NetworkLocation, err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	entries, err := ioutil.ReadDir(NetworkLocation)
+	if err != nil {
+		return err
+	}
+	var networks []*Network
+	hasDefault := false
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(NetworkLocation, e.Name()))
+		if err != nil {
+			return err
+		}
+		n := &Network{}
+		if err := json.Unmarshal(b, n); err != nil {
+			zlog.New().Error("decode network config error", zap.String("name", e.Name()), zap.Error(err))
+			continue
+		}
+		if n.Name == DefaultNetworkName {
+			hasDefault = true
+		}
+		networks = append(networks, n)
+	}
+	if !hasDefault {
+		n := DefaultNetwork()
+		n.ID = newNetworkID()
+		n.CreatedTime = time.Now().Format("2006-01-02 15:04:05")
+		if err := saveNetwork(n); err != nil {
+			return err
+		}
+		networks = append(networks, n)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return fn(networks)
+}
+
+// saveNetwork 将网络配置写入 NetworkLocation/<网络名>.json
+func saveNetwork(n *Network) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(NetworkLocation, n.Name+".json")
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		zlog.New().Error("write network config error", zap.String("path", p), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// PruneAddresses 回收使用者已经不存在的地址：网关地址所在的网络已经被删除，或者 exists 返回 false 的容器。
+// 容器信息和网络配置都在 /var/run 中，宿主机重启之后它们都不存在了，而 IPAM 的记录会保留下来。
+// 在网络的锁中执行，不会回收正在创建的网络的网关
+func PruneAddresses(exists func(containerID string) bool) error {
+	return withNetworks(func(networks []*Network) error {
+		gateways := make(map[string]bool)
+		for _, n := range networks {
+			addrs, err := n.gateways()
+			if err != nil {
+				return err
+			}
+			for _, g := range addrs {
+				gateways[g.ip.String()] = true
+			}
+		}
+		return ipAllocator.Prune(func(subnet, ip, owner string) bool {
+			if owner == gatewayOwner {
+				return gateways[ip]
+			}
+			return exists(owner)
+		})
+	})
+}
+
+// reserveGateway 在 IPAM 中占用自定义的网关地址，默认的网关 IPAM 本身就不会分配
+func (n *Network) reserveGateway() error {
+	gateways, err := n.gateways()
+	if err != nil {
+		return err
+	}
+	for i, g := range gateways {
+		if g.ip.Equal(ipam.Gateway(g.subnet)) {
+			continue
+		}
+		if err := ipAllocator.Reserve(g.subnet, g.ip, gatewayOwner); err != nil {
+			for _, reserved := range gateways[:i] {
+				ipAllocator.Release(reserved.subnet, reserved.ip, gatewayOwner)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Network) releaseGateway() {
+	gateways, err := n.gateways()
+	if err != nil {
+		return
+	}
+	for _, g := range gateways {
+		ipAllocator.Release(g.subnet, g.ip, gatewayOwner)
+	}
+}
+
+// gatewayAddr 子网和其中的网关地址
+type gatewayAddr struct {
+	ip     net.IP
+	subnet *net.IPNet
+}
+
+// gateways 返回网络每个子网的网关
+func (n *Network) gateways() ([]gatewayAddr, error) {
+	subnet, err := n.subnet()
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := n.gateway()
+	if err != nil {
+		return nil, err
+	}
+	result := []gatewayAddr{{gateway.IP, subnet}}
+	if n.IPv6 != nil {
+		subnet6, err := n.subnet6()
+		if err != nil {
+			return nil, err
+		}
+		gateway6, err := n.gateway6()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, gatewayAddr{gateway6.IP, subnet6})
+	}
+	return result, nil
+}
+
+// subnetPool 自动分配子网的地址池，与 docker 相同，先使用 172.16.0.0/12 中的 /16，
+// 再使用 192.168.0.0/16 中的 /20
+func subnetPool() []*net.IPNet {
+	var pool []*net.IPNet
+	for i := 19; i <= 31; i++ {
+		pool = append(pool, &net.IPNet{IP: net.IPv4(172, byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)})
+	}
+	for i := 0; i < 256; i += 16 {
+		pool = append(pool, &net.IPNet{IP: net.IPv4(192, 168, byte(i), 0).To4(), Mask: net.CIDRMask(20, 32)})
+	}
+	return pool
+}
+
+// allocateSubnet 从地址池中选择一个与已有网络都不重叠的子网
+func allocateSubnet(networks []*Network) (*net.IPNet, error) {
+	for _, s := range subnetPool() {
+		if overlappingNetwork(s, networks) == nil {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no available subnet in the default address pool, please specify one with --subnet")
+}
+
+// allocateSubnet6 按照 RFC 4193 生成一个随机的 ULA /64 子网，fd 之后的 40 位为随机的全局 ID
+func allocateSubnet6(networks []*Network) (*net.IPNet, error) {
+	for i := 0; i < 10; i++ {
+		ip := make(net.IP, net.IPv6len)
+		ip[0] = 0xfd
+		if _, err := rand.Read(ip[1:6]); err != nil {
+			return nil, err
+		}
+		s := &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+		if overlappingNetwork(s, networks) == nil {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no available IPv6 subnet, please specify one with --subnet")
+}
+
+// overlappingNetwork 返回子网与 s 重叠的网络，IPv4 和 IPv6 的子网不会重叠
+func overlappingNetwork(s *net.IPNet, networks []*Network) *Network {
+	for _, n := range networks {
+		for _, subnet := range n.subnets() {
+			_, other, err := net.ParseCIDR(subnet)
+			if err != nil {
+				continue
+			}
+			if other.Contains(s.IP) || s.Contains(other.IP) {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// newNetworkID 生成一个 64 位的随机十六进制字符串作为网络 ID
+func newNetworkID() string {
+	return randomHex(32)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		zlog.New().Panic("generate random id error", zap.Error(err))
+	}
+	return hex.EncodeToString(b)
+}
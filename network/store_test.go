@@ -0,0 +1,177 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/ipam"
+)
+
+// useTestNetworkLocation 将网络配置保存在临时目录中
+func useTestNetworkLocation(t *testing.T) {
+	origin := NetworkLocation
+	NetworkLocation = t.TempDir()
+	t.Cleanup(func() { NetworkLocation = origin })
+}
+
+func TestNetworkStore(t *testing.T) {
+	useTestNetworkLocation(t)
+	useTestIPAM(t)
+
+	// 默认网络总是存在
+	networks, err := ListNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 1 || networks[0].Name != DefaultNetworkName || networks[0].ID == "" {
+		t.Fatalf("networks = %+v", networks)
+	}
+
+	n1, err := CreateNetwork("test1", DriverBridge, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1.Subnet != "172.19.0.0/16" || n1.Gateway != "172.19.0.1" || n1.Bridge != "br-"+n1.ID[:12] {
+		t.Fatalf("unexpected network %+v", n1)
+	}
+	n2, err := CreateNetwork("test2", DriverBridge, "10.30.0.0/24", "10.30.0.254", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated, err := ipAllocator.Allocated(&net.IPNet{IP: net.IPv4(10, 30, 0, 0), Mask: net.CIDRMask(24, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated["10.30.0.254"] != gatewayOwner {
+		t.Fatalf("gateway is not reserved: %v", allocated)
+	}
+
+	invalid := []struct {
+		name, driver, subnet, gateway string
+	}{
+		{"test1", DriverBridge, "", ""},                      // 名字重复
+		{"-bad", DriverBridge, "", ""},                       // 名字不合法
+		{"host", DriverBridge, "", ""},                       // 保留的名字
+		{"test3", "overlay", "", ""},                         // 不支持的驱动
+		{"test3", DriverBridge, "172.19.1.0/24", ""},         // 与 test1 重叠
+		{"test3", DriverBridge, "10.30.0.0/16", ""},          // 包含 test2
+		{"test3", DriverBridge, "10.40.0.0/24", "10.50.0.1"}, // 网关不在子网中
+		{"test3", DriverBridge, "", "10.40.0.1"},             // 指定网关时必须指定子网
+	}
+	for _, tt := range invalid {
+		if _, err := CreateNetwork(tt.name, tt.driver, tt.subnet, tt.gateway, nil); err == nil {
+			t.Fatalf("CreateNetwork(%q, %q, %q, %q) should fail", tt.name, tt.driver, tt.subnet, tt.gateway)
+		}
+	}
+
+	// 双栈网络，没有指定 IPv6 子网时生成随机的 ULA 子网
+	n3, err := CreateNetwork("dual1", DriverBridge, "", "", &IPv6Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subnet6, err := net.ParseCIDR(n3.IPv6.Subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ones, _ := subnet6.Mask.Size(); subnet6.IP[0] != 0xfd || ones != 64 || n3.IPv6.Mode != IPv6ModeNAT ||
+		n3.IPv6.Gateway != ipam.Gateway(subnet6).String() {
+		t.Fatalf("unexpected ipv6 config %+v", n3.IPv6)
+	}
+	n4, err := CreateNetwork("dual2", DriverBridge, "", "", &IPv6Config{Subnet: "fd00:40::/64", Gateway: "fd00:40::fe", Mode: IPv6ModeRouted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n4.Subnet != "172.21.0.0/16" || n4.IPv6.Gateway != "fd00:40::fe" {
+		t.Fatalf("unexpected network %+v", n4)
+	}
+	_, subnet6, _ = net.ParseCIDR("fd00:40::/64")
+	if allocated, _ := ipAllocator.Allocated(subnet6); allocated["fd00:40::fe"] != gatewayOwner {
+		t.Fatalf("ipv6 gateway is not reserved: %v", allocated)
+	}
+	for _, v6 := range []*IPv6Config{
+		{Subnet: "fd00:40:0:0:1::/80"},                  // 与 dual2 重叠
+		{Subnet: "10.60.0.0/24"},                        // 不是 IPv6 子网
+		{Subnet: "fd00:60::/64", Gateway: "fd00:61::1"}, // 网关不在子网中
+		{Gateway: "fd00:60::1"},                         // 指定网关时必须指定子网
+		{Mode: "bridge"},                                // 不支持的模式
+	} {
+		if _, err := CreateNetwork("dual3", DriverBridge, "", "", v6); err == nil {
+			t.Fatalf("CreateNetwork with ipv6 config %+v should fail", v6)
+		}
+	}
+
+	n, err := LoadNetwork("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *n != *n2 {
+		t.Fatalf("LoadNetwork = %+v, want %+v", n, n2)
+	}
+	if _, err := LoadNetwork("test3"); err == nil {
+		t.Fatal("load nonexistent network should fail")
+	}
+
+	notInUse := func(name string) error { return nil }
+	if err := RemoveNetwork(DefaultNetworkName, notInUse); err == nil {
+		t.Fatal("remove default network should fail")
+	}
+	// 有运行中的容器时不删除
+	if err := RemoveNetwork("test2", func(name string) error { return fmt.Errorf("%s in use", name) }); err == nil {
+		t.Fatal("remove network in use should fail")
+	}
+	if _, err := LoadNetwork("test2"); err != nil {
+		t.Fatalf("network in use should not be removed: %v", err)
+	}
+	useFakeIptables(t)
+	withTestNetNS(t, func() {
+		if err := RemoveNetwork("test2", notInUse); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocated, _ := ipAllocator.Allocated(&net.IPNet{IP: net.IPv4(10, 30, 0, 0), Mask: net.CIDRMask(24, 32)}); len(allocated) != 0 {
+		t.Fatalf("gateway should be released: %v", allocated)
+	}
+	networks, err = ListNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 4 || networks[0].Name != DefaultNetworkName || networks[3].Name != n1.Name {
+		t.Fatalf("networks = %+v", networks)
+	}
+}
+
+func TestPruneAddresses(t *testing.T) {
+	useTestNetworkLocation(t)
+	useTestIPAM(t)
+
+	n, err := CreateNetwork("pruned", DriverBridge, "10.40.0.0/24", "10.40.0.254", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnet := &net.IPNet{IP: net.IPv4(10, 40, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}
+	for _, owner := range []string{"alive", "removed"} {
+		if _, err := ipAllocator.Allocate(subnet, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 宿主机重启之前删除的网络留下的网关
+	_, removed, _ := net.ParseCIDR("10.50.0.0/24")
+	if err := ipAllocator.Reserve(removed, net.ParseIP("10.50.0.254"), gatewayOwner); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneAddresses(func(id string) bool { return id == "alive" }); err != nil {
+		t.Fatal(err)
+	}
+	allocated, err := ipAllocator.Allocated(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 2 || allocated[n.Gateway] != gatewayOwner || allocated["10.40.0.2"] != "alive" {
+		t.Fatalf("allocated after prune = %v", allocated)
+	}
+	if allocated, _ := ipAllocator.Allocated(removed); len(allocated) != 0 {
+		t.Fatalf("gateway of removed network should be released: %v", allocated)
+	}
+}
@@ -0,0 +1,244 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/fakedocke/zlog"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Address 容器中内置 DNS 服务器监听的地址，与 docker 相同
+	Address = "127.0.0.11"
+	// ttl 容器名字解析结果的 TTL，单位为秒
+	ttl = 600
+	// forwardTimeout 等待上游服务器响应的时间
+	forwardTimeout = 2 * time.Second
+	// maxMessageSize DNS over TCP 的消息最大长度
+	maxMessageSize = 65535
+)
+
+// LookupFunc 查找名字 name 对应的地址，name 的末尾没有点；name 不是容器的名字或者别名时
+// 返回 false，查询会被转发给上游服务器
+type LookupFunc func(name string) (ips []net.IP, ok bool)
+
+// Server 是一个简单的 DNS 服务器，自己回答容器名字的 A 和 AAAA 查询，其他查询转发给上游服务器
+type Server struct {
+	udp       net.PacketConn
+	tcp       net.Listener
+	upstreams []string // 上游服务器的地址，格式为 ip:port
+	lookup    LookupFunc
+	wg        sync.WaitGroup
+}
+
+// New 返回一个在 udp 和 tcp 上提供服务的 Server，upstreams 为上游服务器的 IP 地址，
+// 可以带端口，默认为 53
+func New(udp net.PacketConn, tcp net.Listener, upstreams []string, lookup LookupFunc) *Server {
+	s := &Server{udp: udp, tcp: tcp, lookup: lookup}
+	for _, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		s.upstreams = append(s.upstreams, u)
+	}
+	return s
+}
+
+// Serve 在后台处理查询，直到 Close 被调用
+func (s *Server) Serve() {
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+}
+
+// Close 关闭监听的 socket 并等待后台的 goroutine 退出
+func (s *Server) Close() error {
+	err := s.udp.Close()
+	if err2 := s.tcp.Close(); err == nil {
+		err = err2
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if resp := s.handle(query, "udp"); resp != nil {
+				s.udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// 一个连接上可以有多个查询，空闲一段时间之后关闭
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := s.handle(query, "tcp")
+				if resp == nil {
+					return
+				}
+				if err := writeTCPMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle 处理一个查询，返回响应，查询无法解析时返回 nil，不做响应
+func (s *Server) handle(query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return reply(h, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	if h.OpCode == 0 && q.Class == dnsmessage.ClassINET {
+		name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+		if ips, ok := s.lookup(name); ok {
+			return reply(h, &q, dnsmessage.RCodeSuccess, answers(q, ips))
+		}
+	}
+
+	resp, err := s.forward(query, network)
+	if err != nil {
+		zlog.New().Warn("forward dns query error", zap.String("name", q.Name.String()), zap.Error(err))
+		return reply(h, &q, dnsmessage.RCodeServerFailure, nil)
+	}
+	return resp
+}
+
+// answers 从 ips 中选出与查询类型相同的地址，A 查询返回 IPv4 地址，AAAA 查询返回 IPv6 地址，
+// 其他类型的查询返回空的应答
+func answers(q dnsmessage.Question, ips []net.IP) []dnsmessage.Resource {
+	var result []dnsmessage.Resource
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+		ip4 := ip.To4()
+		switch {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			result = append(result, dnsmessage.Resource{Header: header, Body: r})
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil && ip.To16() != nil:
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip.To16())
+			result = append(result, dnsmessage.Resource{Header: header, Body: r})
+		}
+	}
+	return result
+}
+
+// reply 构造查询 h 的响应
+func reply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			Authoritative:      rcode == dnsmessage.RCodeSuccess && q != nil,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Answers: answers,
+	}
+	if q != nil {
+		msg.Questions = []dnsmessage.Question{*q}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		zlog.New().Error("pack dns response error", zap.Error(err))
+		return nil
+	}
+	return b
+}
+
+// forward 依次将查询转发给上游服务器，返回第一个响应；udp 的响应被截断时由客户端改用 tcp 重试
+func (s *Server) forward(query []byte, network string) ([]byte, error) {
+	err := io.ErrUnexpectedEOF
+	for _, upstream := range s.upstreams {
+		var resp []byte
+		if resp, err = exchange(query, network, upstream); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+func exchange(query []byte, network, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readTCPMessage 读取一个 DNS over TCP 的消息，消息前有 2 字节的长度
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,98 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+)
+
+// startServer 在 127.0.0.1 的随机端口上启动一个 Server，返回它的地址
+func startServer(t *testing.T, upstreams []string, lookup LookupFunc) string {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// udp 和 tcp 使用相同的端口
+	tcp, err := net.Listen("tcp4", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+	s := New(udp, tcp, upstreams, lookup)
+	s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return udp.LocalAddr().String()
+}
+
+func newResolver(addr string, network string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestServer(t *testing.T) {
+	upstream := startServer(t, nil, func(name string) ([]net.IP, bool) {
+		if name == "example.com" {
+			return []net.IP{net.ParseIP("93.184.216.34")}, true
+		}
+		return nil, false
+	})
+	addr := startServer(t, []string{upstream}, func(name string) ([]net.IP, bool) {
+		switch name {
+		case "web":
+			return []net.IP{net.ParseIP("172.19.0.2"), net.ParseIP("172.19.0.3"), net.ParseIP("fd00::2")}, true
+		case "db":
+			return []net.IP{net.ParseIP("172.19.0.4")}, true
+		}
+		return nil, false
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		r := newResolver(addr, network)
+		ctx := context.Background()
+
+		ips, err := r.LookupIP(ctx, "ip4", "web")
+		if err != nil {
+			t.Fatalf("%s: lookup web error: %v", network, err)
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		sort.Strings(got)
+		if len(got) != 2 || got[0] != "172.19.0.2" || got[1] != "172.19.0.3" {
+			t.Fatalf("%s: web = %v", network, got)
+		}
+
+		ips, err = r.LookupIP(ctx, "ip6", "web")
+		if err != nil || len(ips) != 1 || ips[0].String() != "fd00::2" {
+			t.Fatalf("%s: AAAA of web = %v, %v", network, ips, err)
+		}
+		// 没有 IPv6 地址的容器 AAAA 查询返回空的应答
+		if ips, err := r.LookupIP(ctx, "ip6", "db"); err == nil {
+			t.Fatalf("%s: AAAA of db = %v", network, ips)
+		}
+
+		// 其他名字转发给上游服务器
+		ips, err = r.LookupIP(ctx, "ip4", "example.com")
+		if err != nil || len(ips) != 1 || ips[0].String() != "93.184.216.34" {
+			t.Fatalf("%s: example.com = %v, %v", network, ips, err)
+		}
+		// 上游服务器也无法回答时返回 SERVFAIL
+		if ips, err := r.LookupIP(ctx, "ip4", "unknown.test"); err == nil {
+			t.Fatalf("%s: unknown.test = %v", network, ips)
+		}
+	}
+}
+
+func TestServerWithoutUpstream(t *testing.T) {
+	addr := startServer(t, []string{"127.0.0.1:1"}, func(string) ([]net.IP, bool) { return nil, false })
+	if _, err := newResolver(addr, "udp").LookupIP(context.Background(), "ip4", "example.com"); err == nil {
+		t.Fatal("lookup should fail when upstream is unreachable")
+	}
+}